@@ -0,0 +1,155 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/gortc/stun"
+	"github.com/pkg/errors"
+)
+
+// attrAckRequest marks a data indication whose receiver must reply with
+// a success response of the same transaction ID.
+const attrAckRequest stun.AttrType = 0x8050
+
+var (
+	stunDataSuccess = stun.NewType(stun.MethodData, stun.ClassSuccessResponse)
+
+	errAckTimeout  = errors.New("data indication is not acknowledged")
+	errUnknownPeer = errors.New("peer is not in the session table")
+)
+
+// ackRequest requests an acknowledgement of a data indication.
+type ackRequest struct{}
+
+// AddTo writes the acknowledgement request on given STUN message.
+func (ackRequest) AddTo(m *stun.Message) error {
+	m.Add(attrAckRequest, nil)
+	return nil
+}
+
+// DeliverMsgTo sends a message of the default topic to given peers, or to all
+// peers when `pids` is nil, then waits for their acknowledgements in
+// the background. Unacknowledged peers are retried with exponential backoff.
+// If `done` is not nil, it is called once for each peer with the result of
+// the delivery.
+func (overlay *OverlayConn) DeliverMsgTo(b []byte, pids []PeerID, done func(PeerID, error)) (int, error) {
+	return overlay.DeliverTopicTo(topicDefault, b, pids, done)
+}
+
+// deliverFrameTo sends a framed message like DeliverMsgTo.
+func (overlay *OverlayConn) deliverFrameTo(b []byte, pids []PeerID, done func(PeerID, error)) (int, error) {
+	current := overlay.automata.Current()
+	switch current {
+	case stateListening, stateProcessingMessage:
+	default:
+		return 0, fmt.Errorf("connection (state: %d) is not ready", current)
+	}
+	if done == nil {
+		done = func(PeerID, error) {}
+	}
+	if len(b) > stunMaxPacketDataSize {
+		// multi-packets messages are acknowledged by DataSuccess
+		if (len(b)+stunSequenceDataSize-1)/stunSequenceDataSize > maxTransferSequences {
+			return 0, errTransferTooLarge
+		}
+		overlay.RLock()
+		defer overlay.RUnlock()
+		for id, addrs := range overlay.sessions(pids) {
+			go func(id PeerID, addrs Session) {
+				done(id, overlay.sendMultiPackets(id, overlay.peerAddr(addrs), b))
+			}(id, addrs)
+		}
+		return len(b), nil
+	}
+
+	overlay.RLock()
+	defer overlay.RUnlock()
+	for id := range overlay.sessions(pids) {
+		go func(id PeerID) {
+			done(id, overlay.deliverMessage(b, id))
+		}(id)
+	}
+	return len(b), nil
+}
+
+// deliverMessage sends a data indication to a peer until it is acknowledged or
+// AckMaxRetries is reached.
+func (overlay *OverlayConn) deliverMessage(data PeerMessage, pid PeerID) error {
+	tid := transactionID(stun.NewTransactionID())
+	msg, err := stun.Build(
+		stun.NewTransactionIDSetter(tid),
+		stunDataIndication,
+		data,
+		ackRequest{},
+		&overlay.ID,
+		stun.NewShortTermIntegrity(overlay.Config.StunPassword),
+		stun.Fingerprint,
+	)
+	if err != nil {
+		return errors.Wrap(err, "failed create data request message")
+	}
+
+	c := overlay.transfers.open(tid)
+	defer overlay.transfers.close(tid)
+
+	wait := overlay.Config.AckWait * time.Second
+	for i := 0; i < overlay.Config.AckMaxRetries; i++ {
+		overlay.RLock()
+		if addrs, ok := overlay.peers[pid]; ok {
+			err = overlay.writeToPeer(msg.Raw, pid, addrs)
+		} else {
+			err = errUnknownPeer
+		}
+		overlay.RUnlock()
+		if err == errUnknownPeer {
+			return err
+		} else if err != nil {
+			log.Printf("WARNING: failed sending data request to %s - %v", pid, err)
+		}
+
+		select {
+		case <-c:
+			log.Printf("-> %s acknowledged data request", pid)
+			return nil
+		case <-time.After(wait):
+			err = errAckTimeout
+		}
+		wait *= 2
+	}
+	return err
+}
+
+// ackKey returns the key of a data indication in the cache of acknowledged
+// indications.
+func ackKey(pid PeerID, req *stun.Message) []byte {
+	return append(pid[:], req.TransactionID[:]...)
+}
+
+// ackDataIndication replies a success response to a data indication that
+// requests an acknowledgement.
+func (overlay *OverlayConn) ackDataIndication(pid PeerID, req *stun.Message) error {
+	msg, err := stun.Build(
+		stun.NewTransactionIDSetter(req.TransactionID),
+		stunDataSuccess,
+		&overlay.ID,
+		stun.NewShortTermIntegrity(overlay.Config.StunPassword),
+		stun.Fingerprint,
+	)
+	if err != nil {
+		return errors.Wrap(err, "failed building data success response")
+	}
+	overlay.RLock()
+	defer overlay.RUnlock()
+	if addrs, ok := overlay.peers[pid]; ok {
+		err = overlay.writeToPeer(msg.Raw, pid, addrs)
+	} else if overlay.conn != nil {
+		_, err = overlay.conn.conn.WriteToUDP(msg.Raw, overlay.senderAddr)
+	}
+	return err
+}
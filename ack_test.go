@@ -0,0 +1,34 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/gortc/stun"
+)
+
+func TestAckRequest(t *testing.T) {
+	m, err := stun.Build(stun.TransactionID, stunDataIndication, PeerMessage("data"), ackRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !m.Contains(attrAckRequest) {
+		t.Error("message does not request acknowledgement")
+	}
+
+	pid := PeerID{1, 2, 3, 4, 5, 6}
+	key := ackKey(pid, m)
+	if !bytes.Equal(key[:len(pid)], pid[:]) || !bytes.Equal(key[len(pid):], m.TransactionID[:]) {
+		t.Errorf("invalid ack key %x", key)
+	}
+
+	acked := newGossipCache(8, time.Minute)
+	if !acked.add(key) || acked.add(key) {
+		t.Error("second indication must be a duplicate")
+	}
+	acked.remove(key)
+	if !acked.add(key) {
+		t.Error("removed indication must not be a duplicate")
+	}
+}
@@ -1,7 +1,6 @@
 package main
 
 import (
-	"crypto/rsa"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -13,6 +12,7 @@ import (
 	"path"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -23,8 +23,6 @@ import (
 	"github.com/pkg/errors"
 	"github.com/syncthing/syncthing/lib/nat"
 	"github.com/syncthing/syncthing/lib/upnp"
-	"github.com/valyala/fasthttp"
-	"github.com/zeebo/bencode"
 	lumberjack "gopkg.in/natefinch/lumberjack.v2"
 )
 
@@ -32,23 +30,18 @@ var (
 	errUpdateIsAlreadyExist     = errors.New("update is already exist")
 	errUpdateIsOlder            = errors.New("update is older")
 	errUpdateVerificationFailed = errors.New("update verification failed")
-
-	readBuffer       [64 * 1024]byte
-	bufNotification  Notification
-	bufNotifications = make(map[string]*Notification)
 )
 
 // Agent is a representation of update agent.
 type Agent struct {
 	sync.RWMutex
 
-	Config    *Config
-	Overlay   *OverlayConn
-	PublicKey *rsa.PublicKey
+	Config   *Config
+	Clusters map[string]*Cluster
 
-	updates       map[string]*Update
 	api           API
 	torrentClient *torrent.Client
+	peerFilter    *clusterFilter
 	quit          chan interface{}
 
 	dataDir     string
@@ -57,12 +50,34 @@ type Agent struct {
 
 // BitTorrentConfig holds configurations of BitTorrent client.
 type BitTorrentConfig struct {
+	// Tracker is the announce URL of the torrents whose notifications have
+	// no trackers, such as compact notifications (default: the embedded
+	// tracker of the server)
 	Tracker     string `json:"tracker"`
 	Debug       bool   `json:"debug"`
 	PieceLength int64  `json:"piece-length"`
 	Port        int    `json:"port"`
 	NoDHT       bool   `json:"no-dht"`
 
+	// PrivateDHT=true means the DHT only bootstraps from and talks to
+	// the peers of the clusters
+	PrivateDHT bool `json:"private-dht"`
+
+	// ClusterPeersOnly=true means the client only accepts the peers of
+	// the clusters and of PeerAllowlist (IP addresses or CIDR networks)
+	ClusterPeersOnly bool     `json:"cluster-peers-only"`
+	PeerAllowlist    []string `json:"peer-allowlist,omitempty"`
+
+	// ForceEncryption=true means the client only accepts encrypted peer
+	// connections (MSE/PE)
+	ForceEncryption bool `json:"force-encryption"`
+
+	// WebSeedAddress is the HTTP address where the data directory is served
+	// for web seeding (empty = disabled), and WebSeedWait is the time of
+	// downloading from the swarm before using the web seeds of a torrent
+	WebSeedAddress string `json:"web-seed-address,omitempty"`
+	WebSeedWait    int    `json:"web-seed-wait"` // in seconds
+
 	externalPort int
 }
 
@@ -86,11 +101,29 @@ type Config struct {
 	LogFile   string `json:"log-file"`
 	NoUDP     bool   `json:"no-udp"`
 
-	ReadTCPInterval int `json:"read-tcp-interval"`
+	// NATDiscovery=true means the agent discovers the NAT behavior of each
+	// cluster in the background, then selects direct or relayed overlay
+	NATDiscovery bool `json:"nat-discovery"`
+
+	ReadTCPInterval     int `json:"read-tcp-interval"`
+	PushWait            int `json:"push-wait"`             // in seconds, 0 = polling every ReadTCPInterval
+	AntiEntropyInterval int `json:"anti-entropy-interval"` // in seconds, 0 = disabled
+
+	// Sources of update files other than BitTorrent, which are HTTP(S) URLs,
+	// file URLs, or (mounted) directories where the files are named after
+	// the torrents
+	Sources []string `json:"sources,omitempty"`
 
 	// Public key file for verification
 	PublicKey Key `json:"public-key"`
 
+	// Keyring has the trusted keys in addition to `PublicKey`
+	Keyring KeyringConfig `json:"keyring,omitempty"`
+
+	// Clusters that the agent joins. If it is empty, then the agent joins
+	// a single cluster using `Server`, `PublicKey` and `Keyring`.
+	Clusters []ClusterConfig `json:"clusters,omitempty"`
+
 	// Proxy=true means the agent will not deploy the update
 	// on local node
 	Proxy bool `json:"proxy"`
@@ -105,7 +138,7 @@ type Config struct {
 	BitTorrent BitTorrentConfig `json:"bittorrent"`
 }
 
-func (a *Agent) torrentClientConfig() *torrent.Config {
+func (a *Agent) torrentClientConfig() (*torrent.Config, error) {
 	addr := strings.Trim(a.Config.Address, " \t\n\r")
 	overlayPort := 0
 	if ok, err := regexp.MatchString(`^.*:[0-9]+$`, addr); ok && err == nil {
@@ -118,7 +151,7 @@ func (a *Agent) torrentClientConfig() *torrent.Config {
 		a.Config.BitTorrent.Port = bindRandomPort()
 	}
 
-	return &torrent.Config{
+	cfg := &torrent.Config{
 		ListenPort:       a.Config.BitTorrent.Port,
 		DataDir:          a.dataDir,
 		Seed:             true,
@@ -127,6 +160,21 @@ func (a *Agent) torrentClientConfig() *torrent.Config {
 		Debug:            a.Config.BitTorrent.Debug,
 		DhtStartingNodes: dht.GlobalBootstrapAddrs,
 	}
+	cfg.EncryptionPolicy.ForceEncryption = a.Config.BitTorrent.ForceEncryption
+	if a.Config.BitTorrent.PrivateDHT || a.Config.BitTorrent.ClusterPeersOnly {
+		allowlist, err := parseAllowlist(a.Config.BitTorrent.PeerAllowlist)
+		if err != nil {
+			return nil, err
+		}
+		a.peerFilter = newClusterFilter(allowlist)
+	}
+	if a.Config.BitTorrent.PrivateDHT {
+		cfg.DhtStartingNodes = a.peerFilter.startingNodes
+	}
+	if a.Config.BitTorrent.ClusterPeersOnly {
+		cfg.IPBlocklist = a.peerFilter
+	}
+	return cfg, nil
 }
 
 func (a *Agent) createDirs() error {
@@ -149,14 +197,24 @@ func NewConfig(filename string) (Config, error) {
 	)
 
 	cfg := DefaultConfig()
+	cfg.BitTorrent.Tracker = ""
 
 	if f, err = os.Open(filename); err == nil {
 		err = json.NewDecoder(f).Decode(&cfg)
 	}
+	if len(cfg.BitTorrent.Tracker) == 0 {
+		cfg.BitTorrent.Tracker = serverTracker(cfg.Server)
+	}
 
 	return cfg, err
 }
 
+// serverTracker returns the announce URL of the embedded tracker of given
+// server.
+func serverTracker(server string) string {
+	return fmt.Sprintf("http://%s%s", server, pathAnnounce)
+}
+
 // DefaultConfig returns default agent configurations.
 func DefaultConfig() Config {
 	homeDir := "~/"
@@ -175,8 +233,9 @@ func DefaultConfig() Config {
 			Address: defaultUnixSocket,
 		},
 		BitTorrent: BitTorrentConfig{
-			Tracker:     DefaultTracker,
+			Tracker:     serverTracker(fmt.Sprintf("%s:%d", defaultServerAddr, defaultServerPort)),
 			PieceLength: DefaultPieceLength,
+			WebSeedWait: 60,
 		},
 		Overlay: OverlayConfig{
 			StunPassword:        defaultStunPassword,
@@ -187,8 +246,24 @@ func DefaultConfig() Config {
 			ListeningBufferSize: 64 * 1024,
 			ErrorBackoff:        10,
 			ChannelLifespan:     60,
+			TransferWait:        5,
+			TransferMaxErrors:   5,
+			GossipFanout:        4,
+			GossipTTL:           6,
+			GossipCacheSize:     1024,
+			GossipCacheLifespan: 600,
+			PeerLifetime:        300,
+			RelayTimeout:        120,
+			PunchTimeout:        10,
+			PunchRetry:          300,
+			AckWait:             2,
+			AckMaxRetries:       5,
+			PEXInterval:         60,
 		},
-		ReadTCPInterval: 60,
+		NATDiscovery:        true,
+		ReadTCPInterval:     60,
+		PushWait:            50,
+		AntiEntropyInterval: 60,
 	}
 }
 
@@ -210,9 +285,9 @@ func NewAgent(cfg Config) (*Agent, error) {
 	log.Printf("creating agent with config: %s", string(j))
 
 	a := &Agent{
-		Config:  &cfg,
-		updates: make(map[string]*Update),
-		quit:    make(chan interface{}),
+		Config:   &cfg,
+		Clusters: make(map[string]*Cluster),
+		quit:     make(chan interface{}),
 	}
 	a.api.agent = a
 
@@ -234,30 +309,41 @@ func NewAgent(cfg Config) (*Agent, error) {
 	}
 
 	// create Torrent Client
-	a.torrentClient, err = torrent.NewClient(a.torrentClientConfig())
+	tcfg, err := a.torrentClientConfig()
+	if err != nil {
+		return nil, fmt.Errorf("ERROR: invalid BitTorrent config: %v", err)
+	}
+	a.torrentClient, err = torrent.NewClient(tcfg)
 	if err != nil {
 		return nil, fmt.Errorf("ERROR: failed creating Torrent client: %v", err)
 	}
 	log.Printf("Torrent Client listen at %v", a.torrentClient.ListenAddrs())
+	// the blocklist of the client also applies to the DHT, which is only
+	// restricted to the clusters in private mode
+	for _, s := range a.torrentClient.DhtServers() {
+		if a.Config.BitTorrent.PrivateDHT {
+			s.SetIPBlockList(a.peerFilter)
+		} else {
+			s.SetIPBlockList(nil)
+		}
+	}
 
-	// create Overlay network
-	if a.Config.NoUDP {
-		log.Println("overlay is disabled since NoUDP = true")
-	} else {
-		// updated Overlay config
-		a.Config.Overlay.Address = a.Config.Address
-		a.Config.Overlay.Server = a.Config.Server
-		a.Config.Overlay.torrentPorts = [2]int{a.Config.BitTorrent.Port, a.Config.BitTorrent.Port}
-
-		// start Overlay network
-		if a.Overlay, err = NewOverlayConn(a.Config.Overlay); err != nil {
+	// join clusters, only the first overlay uses the configured port
+	a.Config.Overlay.torrentPorts = [2]int{a.Config.BitTorrent.Port, a.Config.BitTorrent.Port}
+	address := a.Config.Address
+	for _, cc := range a.Config.clusterConfigs() {
+		if _, ok := a.Clusters[cc.Name]; ok {
+			return nil, fmt.Errorf("ERROR: duplicate cluster name '%s'", cc.Name)
+		}
+		c, err := newCluster(cc, a, address)
+		if err != nil {
 			return nil, err
 		}
+		a.Clusters[cc.Name] = c
+		address = anyPortAddress(address)
 	}
-
-	// load public key file
-	if a.PublicKey, err = LoadPublicKey(cfg.PublicKey.Filename); err != nil {
-		return nil, fmt.Errorf("ERROR: failed loading public key file '%s: %v", cfg.PublicKey.Filename, err)
+	if a.peerFilter != nil {
+		a.peerFilter.setClusters(a.Clusters)
 	}
 
 	// load update from local database
@@ -265,7 +351,12 @@ func NewAgent(cfg Config) (*Agent, error) {
 
 	go a.startCatchingSignals()
 	go a.api.Start()
-	go a.startGossip()
+	if len(a.Config.BitTorrent.WebSeedAddress) > 0 {
+		go a.serveWebSeed()
+	}
+	for _, c := range a.Clusters {
+		c.start()
+	}
 
 	j, _ = json.Marshal(cfg)
 	log.Printf("created agent with config: %s", string(j))
@@ -308,71 +399,20 @@ func (a *Agent) startCatchingSignals() {
 	}
 }
 
-func (a *Agent) startGossip() {
-	counter := 0
-	a.readTCP()
-	for {
-		if a.Overlay == nil || !a.Overlay.Ready() {
-			counter++
-			time.Sleep(time.Second)
-			if counter > a.Config.ReadTCPInterval {
-				counter = 0
-				a.readTCP()
-			}
-		} else {
-			counter = 0
-			a.readOverlay()
-		}
-	}
-}
-
+// readTCP reads updates from the servers of all clusters.
 func (a *Agent) readTCP() error {
-	log.Println("readTCP - starting")
-	url := fmt.Sprintf("http://%s", a.Config.Server)
-	code, body, err := fasthttp.Get(nil, url)
-	if code != 200 || err != nil {
-		err := errors.Errorf("readTCP - failed getting updates from %s, status code: %d, error: %v", url, code, err)
-		log.Println(err)
-		return err
-	}
-	if err := json.Unmarshal(body, &bufNotifications); err != nil {
-		err := errors.Errorf("readTCP - failed decoding notifications from %s, body: %s, : %v", url, string(body), err)
-		log.Println(err)
-		return err
-	}
-	for _, notification := range bufNotifications {
-		u := NewUpdate(*notification, a)
-		if err := u.Start(a); err != nil {
-			switch err {
-			case errUpdateIsAlreadyExist, errUpdateIsOlder, errUpdateVerificationFailed:
-				log.Printf("readTCP - ignored the update: %v", err)
-			default:
-				log.Printf("readTCP - failed adding the torrent-file++ to TorrentClient: %v", err)
-			}
+	var err error
+	for _, c := range a.Clusters {
+		if e := c.readTCP(); e != nil {
+			err = e
 		}
 	}
-	log.Println("readTCP - finished")
-	return nil
+	return err
 }
 
-func (a *Agent) readOverlay() {
-	log.Println("readOverlay - starting")
-	if n, err := a.Overlay.Read(readBuffer[:]); err != nil {
-		log.Println("readOverlay - failed reading", err)
-	} else {
-		if err := bencode.DecodeBytes(readBuffer[:n], &bufNotification); err != nil {
-			log.Printf("readOverlay - the gossip message is not a notification: %v", err)
-		}
-		if err = NewUpdate(bufNotification, a).Start(a); err != nil {
-			switch err {
-			case errUpdateIsAlreadyExist, errUpdateIsOlder, errUpdateVerificationFailed:
-				log.Printf("readOverlay - ignored the update: %v", err)
-			default:
-				log.Printf("readOverlay - failed adding the torrent-file++ to TorrentClient: %v", err)
-			}
-		}
-	}
-	log.Println("readOverlay - finished")
+// cluster returns the cluster of given name, or nil if the agent does not join it.
+func (a *Agent) cluster(name string) *Cluster {
+	return a.Clusters[name]
 }
 
 // loadUpdates loads existing updates from local database (or files).
@@ -383,6 +423,7 @@ func (a *Agent) loadUpdates() {
 	if err != nil {
 		log.Fatalf("cannot read metadata dir: %s", a.metadataDir)
 	}
+	var updates []*Update
 	for _, f := range files {
 		filename := filepath.Join(a.metadataDir, f.Name())
 		u, err := LoadUpdateFromFile(filename, a)
@@ -390,14 +431,31 @@ func (a *Agent) loadUpdates() {
 			log.Printf("failed loading update metadata file %s: %v", f.Name(), err)
 			continue
 		}
-		if err = u.Verify(a); err != nil {
+		updates = append(updates, u)
+	}
+	// the keyring notifications are applied in version order before
+	// the other updates are verified, because they may add or revoke keys
+	sort.SliceStable(updates, func(i, j int) bool {
+		return updates[i].Notification.Version < updates[j].Notification.Version
+	})
+	for _, u := range updates {
+		if u.Notification.UUID != UUIDKeyring {
+			continue
+		}
+		if _, err := u.cluster.Keyring.applyChange(&u.Notification); err != nil {
+			log.Printf("failed applying keyring of cluster '%s' version:%d - %v",
+				u.Cluster, u.Notification.Version, err)
+		}
+	}
+	for _, u := range updates {
+		if err := u.Verify(a); err != nil {
 			log.Printf("update verification failed uuid:%s version:%d",
 				u.Notification.UUID, u.Notification.Version)
 			continue
 		}
 		u.Start(a)
 	}
-	log.Printf("Loaded %d updates", len(a.updates))
+	log.Printf("Loaded %d updates", len(a.getUpdates()))
 }
 
 func bindRandomPort() int {
@@ -420,7 +478,7 @@ func (a *Agent) addUpdate(u *Update) (*Update, error) {
 	a.Lock()
 	defer a.Unlock()
 	uuid := u.Notification.UUID
-	old, ok := a.updates[uuid]
+	old, ok := u.cluster.updates[uuid]
 	if ok {
 		if old.Notification.Version > u.Notification.Version {
 			return nil, errUpdateIsOlder
@@ -428,36 +486,49 @@ func (a *Agent) addUpdate(u *Update) (*Update, error) {
 			return nil, errUpdateIsAlreadyExist
 		}
 	}
-	a.updates[uuid] = u
+	u.cluster.updates[uuid] = u
 	return old, nil
 }
 
-func (a *Agent) deleteUpdate(uuid string) *Update {
+func (a *Agent) deleteUpdate(c *Cluster, uuid string) *Update {
 	a.Lock()
 	defer a.Unlock()
-	u, ok := a.updates[uuid]
-	delete(a.updates, uuid)
+	u, ok := c.updates[uuid]
+	delete(c.updates, uuid)
 	if ok {
 		return u
 	}
 	return nil
 }
 
-func (a *Agent) getUpdate(uuid string) *Update {
+func (a *Agent) getUpdate(c *Cluster, uuid string) *Update {
 	a.RLock()
 	defer a.RUnlock()
-	if u, ok := a.updates[uuid]; ok {
+	if u, ok := c.updates[uuid]; ok {
 		return u
 	}
 	return nil
 }
 
-func (a *Agent) getUpdateUUIDs() []string {
+func (a *Agent) getUpdateUUIDs(c *Cluster) []string {
 	a.RLock()
 	defer a.RUnlock()
-	keys := make([]string, 0, len(a.updates))
-	for k := range a.updates {
+	keys := make([]string, 0, len(c.updates))
+	for k := range c.updates {
 		keys = append(keys, k)
 	}
 	return keys
 }
+
+// getUpdates returns the updates of all clusters.
+func (a *Agent) getUpdates() []*Update {
+	a.RLock()
+	defer a.RUnlock()
+	var updates []*Update
+	for _, c := range a.Clusters {
+		for _, u := range c.updates {
+			updates = append(updates, u)
+		}
+	}
+	return updates
+}
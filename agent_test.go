@@ -7,6 +7,8 @@ import (
 	"os"
 	"os/user"
 	"testing"
+
+	"github.com/anacrolix/torrent/metainfo"
 )
 
 func TestAgentReadTCP(t *testing.T) {
@@ -38,3 +40,20 @@ func TestAgentReadTCP(t *testing.T) {
 		t.Errorf("failed readTCP: %v", err)
 	}
 }
+
+func TestDefaultTracker(t *testing.T) {
+	cfg := DefaultConfig()
+	a := &Agent{Config: &cfg}
+	a.Config.BitTorrent.Tracker = "http://server/announce"
+
+	var mi metainfo.MetaInfo
+	a.defaultTracker(&mi)
+	if mi.Announce != "http://server/announce" {
+		t.Errorf("announce: got %s, expected the agent's tracker", mi.Announce)
+	}
+	mi = metainfo.MetaInfo{AnnounceList: [][]string{{"http://other/announce"}}}
+	a.defaultTracker(&mi)
+	if len(mi.Announce) > 0 {
+		t.Errorf("the trackers of a notification should not be replaced, got %s", mi.Announce)
+	}
+}
@@ -0,0 +1,104 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"log"
+
+	"github.com/zeebo/bencode"
+)
+
+// Digest is a compact summary of the updates held by an agent.
+type Digest struct {
+	// Versions maps update UUIDs to their versions
+	Versions map[string]uint64 `bencode:"versions"`
+
+	// Reply is true if the digest is sent in response to other digest
+	Reply bool `bencode:"reply,omitempty"`
+}
+
+// digest returns a Digest of the cluster's updates.
+func (c *Cluster) digest() Digest {
+	c.agent.RLock()
+	defer c.agent.RUnlock()
+	d := Digest{
+		Versions: make(map[string]uint64, len(c.updates)),
+	}
+	for uuid, u := range c.updates {
+		d.Versions[uuid] = u.Notification.Version
+	}
+	return d
+}
+
+// antiEntropy sends the cluster's digest to a random peer, which will reply with
+// the notifications that are newer than ours.
+func (c *Cluster) antiEntropy() {
+	if !c.Gossip.Ready() {
+		return
+	}
+	pids := c.Overlay.RandomPeers(1)
+	if len(pids) == 0 {
+		return
+	}
+	if err := c.sendDigest(pids[0], c.digest()); err != nil {
+		log.Printf("antiEntropy - failed sending digest to %s: %v", pids[0], err)
+	}
+}
+
+func (c *Cluster) sendDigest(pid PeerID, d Digest) error {
+	b, err := bencode.EncodeBytes(d)
+	if err != nil {
+		return err
+	}
+	return c.Gossip.WriteMsgTo(gossipDigest, b, pid)
+}
+
+// processDigest sends the notifications that are newer than the ones in given
+// digest to the peer. It also replies with our own digest if the peer has
+// newer updates, so that the peer sends them back.
+func (c *Cluster) processDigest(pid PeerID, data []byte) {
+	var d Digest
+	if err := bencode.DecodeBytes(data, &d); err != nil {
+		log.Printf("processDigest - %s sent an invalid digest: %v", pid, err)
+		return
+	}
+
+	var (
+		newer  []Notification
+		behind bool
+	)
+	c.agent.RLock()
+	for uuid, u := range c.updates {
+		if ver, ok := d.Versions[uuid]; !ok || ver < u.Notification.Version {
+			newer = append(newer, u.Notification)
+		}
+	}
+	for uuid, ver := range d.Versions {
+		if u, ok := c.updates[uuid]; !ok || u.Notification.Version < ver {
+			behind = true
+		}
+	}
+	c.agent.RUnlock()
+
+	for i := range newer {
+		w := new(bytes.Buffer)
+		if err := newer[i].Write(w); err != nil {
+			log.Printf("processDigest - failed encoding notification uuid:%s version:%d - %v",
+				newer[i].UUID, newer[i].Version, err)
+		} else if err = c.Gossip.WriteMsgTo(gossipNotification, w.Bytes(), pid); err != nil {
+			log.Printf("processDigest - failed sending notification uuid:%s version:%d to %s - %v",
+				newer[i].UUID, newer[i].Version, pid, err)
+		}
+	}
+	if behind && !d.Reply {
+		reply := c.digest()
+		reply.Reply = true
+		if err := c.sendDigest(pid, reply); err != nil {
+			log.Printf("processDigest - failed replying digest to %s: %v", pid, err)
+		}
+	}
+	log.Printf("processDigest - sent %d notifications to %s", len(newer), pid)
+}
@@ -29,6 +29,8 @@ var (
 	pathConfig          = []byte("/config")
 	pathOverlay         = []byte("/overlay")
 	pathOverlayPeers    = []byte("/overlay/peers")
+	pathOverlayGossip   = []byte("/overlay/gossip")
+	pathOverlayNodes    = []byte("/overlay/nodes")
 	pathUpdate          = []byte("/update")
 	pathTorrentDhtNodes = []byte("/torrent/dht/nodes")
 )
@@ -56,6 +58,10 @@ func (a *API) requestHandler(ctx *fasthttp.RequestCtx) {
 		a.requestConfig(ctx)
 	case bytes.Compare(ctx.Path(), pathOverlayPeers) == 0:
 		a.requestOverlayPeers(ctx)
+	case bytes.Compare(ctx.Path(), pathOverlayGossip) == 0:
+		a.requestOverlayGossip(ctx)
+	case bytes.Compare(ctx.Path(), pathOverlayNodes) == 0:
+		a.requestOverlayNodes(ctx)
 	case bytes.Compare(ctx.Path(), pathOverlay) == 0:
 		a.requestOverlay(ctx)
 	case rUpdateURL.Match(ctx.Path()):
@@ -107,40 +113,50 @@ func (a *API) requestUpdate(ctx *fasthttp.RequestCtx) {
 	case bytes.Compare(ctx.Method(), strPOST) == 0:
 		a.requestPostUpdate(ctx)
 	case bytes.Compare(ctx.Method(), strGET) == 0:
-		doJSONWrite(ctx, 200, a.agent.getUpdateUUIDs())
+		c := a.requestCluster(ctx)
+		if c == nil {
+			ctx.Response.SetStatusCode(404)
+			return
+		}
+		doJSONWrite(ctx, 200, a.agent.getUpdateUUIDs(c))
 	default:
 		ctx.Response.SetStatusCode(400)
 	}
 }
 
 func (a *API) requestUpdateWithParam(ctx *fasthttp.RequestCtx) {
+	c := a.requestCluster(ctx)
+	if c == nil {
+		ctx.Response.SetStatusCode(404)
+		return
+	}
 	switch {
 	case bytes.Compare(ctx.Method(), strGET) == 0:
-		a.requestGetUpdateWithUUID(ctx, ctx.Path()[8:])
+		a.requestGetUpdateWithUUID(ctx, c, ctx.Path()[8:])
 	case bytes.Compare(ctx.Method(), strDELETE) == 0:
-		a.requestDeleteUpdate(ctx, ctx.Path()[8:])
+		a.requestDeleteUpdate(ctx, c, ctx.Path()[8:])
 	case bytes.Compare(ctx.Method(), strPATCH) == 0:
-		a.requestBroadcastUpdateWithUUID(ctx, ctx.Path()[8:])
+		a.requestBroadcastUpdateWithUUID(ctx, c, ctx.Path()[8:])
 	default:
 		ctx.Response.SetStatusCode(400)
 	}
 }
 
-func (a *API) requestBroadcastUpdateWithUUID(ctx *fasthttp.RequestCtx, uuid []byte) {
-	update := a.agent.getUpdate(string(uuid))
+func (a *API) requestBroadcastUpdateWithUUID(ctx *fasthttp.RequestCtx, c *Cluster, uuid []byte) {
+	update := a.agent.getUpdate(c, string(uuid))
 	if update == nil {
 		ctx.Response.SetStatusCode(404)
 		return
 	}
-	if err := update.Notification.Write(a.agent.Overlay); err != nil {
+	if err := update.Notification.Write(c.Gossip); err != nil {
 		log.Printf("requestBroadcastUpdateWithUUID - failed uuid:%s - %v",
 			string(uuid), err)
 		ctx.Response.SetStatusCode(500)
 	}
 }
 
-func (a *API) requestGetUpdateWithUUID(ctx *fasthttp.RequestCtx, uuid []byte) {
-	update := a.agent.getUpdate(string(uuid))
+func (a *API) requestGetUpdateWithUUID(ctx *fasthttp.RequestCtx, c *Cluster, uuid []byte) {
+	update := a.agent.getUpdate(c, string(uuid))
 	if update == nil {
 		ctx.Response.SetStatusCode(404)
 		return
@@ -148,8 +164,8 @@ func (a *API) requestGetUpdateWithUUID(ctx *fasthttp.RequestCtx, uuid []byte) {
 	doJSONWrite(ctx, 200, update)
 }
 
-func (a *API) requestDeleteUpdate(ctx *fasthttp.RequestCtx, uuid []byte) {
-	if update := a.agent.deleteUpdate(string(uuid)); update != nil {
+func (a *API) requestDeleteUpdate(ctx *fasthttp.RequestCtx, c *Cluster, uuid []byte) {
+	if update := a.agent.deleteUpdate(c, string(uuid)); update != nil {
 		update.Stop()
 		if err := update.Delete(); err != nil {
 			log.Printf("failed deleting update uuid:%s - %v", uuid, err)
@@ -172,6 +188,11 @@ func (a *API) requestPostUpdate(ctx *fasthttp.RequestCtx) {
 		return
 	}
 	u.agent = a.agent
+	if u.cluster = a.agent.cluster(u.Cluster); u.cluster == nil {
+		log.Printf("agent does not join cluster '%s'", u.Cluster)
+		ctx.Response.SetStatusCode(404)
+		return
+	}
 
 	if _, err = os.Stat(u.Source); err == nil {
 		dest := filepath.Join(a.agent.dataDir, u.Notification.Info.Name)
@@ -187,6 +208,16 @@ func (a *API) requestPostUpdate(ctx *fasthttp.RequestCtx) {
 		ctx.Response.SetStatusCode(404)
 		return
 	}
+	if u.Notification.Delta != nil && len(u.DeltaSource) > 0 {
+		dest := filepath.Join(a.agent.dataDir, u.Notification.Delta.Info.Name)
+		cmd := exec.Command("cp", "-af", u.DeltaSource, dest)
+		if err := cmd.Run(); err != nil {
+			log.Printf("failed copying patch file from '%s' to '%s': %v",
+				u.DeltaSource, dest, err)
+			ctx.Response.SetStatusCode(403)
+			return
+		}
+	}
 
 	if err = u.Start(a.agent); err != nil {
 		switch err {
@@ -201,20 +232,20 @@ func (a *API) requestPostUpdate(ctx *fasthttp.RequestCtx) {
 		}
 		log.Printf("failed to activating the torrent: %v", err)
 	} else {
-		go a.rebroadcastUpdate(string(u.Notification.UUID), u.Notification.Version)
+		go a.rebroadcastUpdate(u.cluster, string(u.Notification.UUID), u.Notification.Version)
 		ctx.Response.SetStatusCode(200)
 	}
 }
 
 // rebroadcastUpdate broadcasts given update every minute within 5 minutes.
-func (a *API) rebroadcastUpdate(uuid string, version uint64) {
+func (a *API) rebroadcastUpdate(c *Cluster, uuid string, version uint64) {
 	var update *Update
 	for i := 0; i < 5; i++ {
-		update = a.agent.getUpdate(uuid)
+		update = a.agent.getUpdate(c, uuid)
 		if update == nil || update.Notification.Version != version {
 			break
 		}
-		update.Notification.Write(a.agent.Overlay)
+		update.Notification.Write(c.Gossip)
 		time.Sleep(time.Minute)
 	}
 }
@@ -222,8 +253,42 @@ func (a *API) rebroadcastUpdate(uuid string, version uint64) {
 func (a *API) requestOverlayPeers(ctx *fasthttp.RequestCtx) {
 	switch {
 	case bytes.Compare(ctx.Method(), strGET) == 0:
-		ctx.Response.Header.Set("Content-Type", "application/json")
-		ctx.Response.SetBody(a.agent.Overlay.peers.JSON())
+		c := a.requestCluster(ctx)
+		if c == nil || c.Overlay == nil {
+			ctx.Response.SetStatusCode(404)
+			return
+		}
+		doJSONWrite(ctx, 200, c.Overlay.PeerStates())
+	default:
+		ctx.Response.SetStatusCode(400)
+	}
+}
+
+func (a *API) requestOverlayGossip(ctx *fasthttp.RequestCtx) {
+	switch {
+	case bytes.Compare(ctx.Method(), strGET) == 0:
+		c := a.requestCluster(ctx)
+		if c == nil || c.Gossip == nil {
+			ctx.Response.SetStatusCode(404)
+			return
+		}
+		doJSONWrite(ctx, 200, c.Gossip.Stats())
+	default:
+		ctx.Response.SetStatusCode(400)
+	}
+}
+
+// requestOverlayNodes returns the torrent clients of the cluster's peers,
+// which are given as DHT nodes to the submitted notifications.
+func (a *API) requestOverlayNodes(ctx *fasthttp.RequestCtx) {
+	switch {
+	case bytes.Compare(ctx.Method(), strGET) == 0:
+		c := a.requestCluster(ctx)
+		if c == nil || c.Overlay == nil {
+			ctx.Response.SetStatusCode(404)
+			return
+		}
+		doJSONWrite(ctx, 200, c.Overlay.TorrentNodes())
 	default:
 		ctx.Response.SetStatusCode(400)
 	}
@@ -232,17 +297,33 @@ func (a *API) requestOverlayPeers(ctx *fasthttp.RequestCtx) {
 func (a *API) requestOverlay(ctx *fasthttp.RequestCtx) {
 	switch {
 	case bytes.Compare(ctx.Method(), strGET) == 0:
-		ctx.Response.Header.Set("Content-Type", "application/json")
+		c := a.requestCluster(ctx)
+		if c == nil {
+			ctx.Response.SetStatusCode(404)
+			return
+		}
 		state := struct {
-			ID           string   `json:"id"`
-			State        string   `json:"state"`
-			InternalAddr net.Addr `json:"internal-address"`
-			ExternalAddr net.Addr `json:"external-address"`
+			Cluster      string       `json:"cluster"`
+			ID           string       `json:"id,omitempty"`
+			State        string       `json:"state"`
+			Mode         string       `json:"mode"`
+			NAT          *NATBehavior `json:"nat"`
+			Relay        bool         `json:"relay"`
+			InternalAddr net.Addr     `json:"internal-address"`
+			ExternalAddr net.Addr     `json:"external-address"`
 		}{
-			ID:           a.agent.Overlay.ID.String(),
-			State:        a.agent.Overlay.automata.Current().String(),
-			InternalAddr: a.agent.Overlay.InternalAddr(),
-			ExternalAddr: a.agent.Overlay.ExternalAddr(),
+			Cluster: c.Name,
+			State:   "disabled",
+		}
+		a.agent.RLock()
+		state.Mode, state.NAT = c.Mode, c.NAT
+		a.agent.RUnlock()
+		if c.Overlay != nil {
+			state.ID = c.Overlay.ID.String()
+			state.State = c.Overlay.automata.Current().String()
+			state.InternalAddr = c.Overlay.InternalAddr()
+			state.ExternalAddr = c.Overlay.ExternalAddr()
+			state.Relay = c.Overlay.RelayAllocated()
 		}
 		doJSONWrite(ctx, 200, state)
 	default:
@@ -250,6 +331,12 @@ func (a *API) requestOverlay(ctx *fasthttp.RequestCtx) {
 	}
 }
 
+// requestCluster returns the cluster given by query argument `cluster`, or
+// the cluster with an empty name if the argument is not given.
+func (a *API) requestCluster(ctx *fasthttp.RequestCtx) *Cluster {
+	return a.agent.cluster(string(ctx.QueryArgs().Peek("cluster")))
+}
+
 func doJSONWrite(ctx *fasthttp.RequestCtx, code int, obj interface{}) {
 	ctx.Response.Header.SetCanonical(strContentType, strApplicationJSON)
 	ctx.Response.SetStatusCode(code)
@@ -30,6 +30,7 @@ const (
 	eventUnderLimit
 	eventOverLimit
 	eventChannelExpired
+	eventDetached
 )
 
 // Automata is a simple Finite State Machine (FSM). We can assign a callback function
@@ -140,6 +141,8 @@ func (e Event) String() string {
 		return "channelExpired"
 	case eventClose:
 		return "close"
+	case eventDetached:
+		return "detached"
 	case eventError:
 		return "error"
 	case eventOpen:
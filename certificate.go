@@ -0,0 +1,105 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"time"
+)
+
+// certificateSigner is a private key with its certificate chain, whose
+// signatures carry the chain in `Signature.Certificate` (BEP 35).
+type certificateSigner struct {
+	crypto.Signer
+
+	// chain is the concatenated DER certificates, where the first one is
+	// the certificate of the key followed by the intermediates
+	chain []byte
+}
+
+// LoadCertificateSigner returns the signer of given private key whose
+// certificate chain is in given PEM file.
+func LoadCertificateSigner(key crypto.Signer, filename string) (crypto.Signer, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed reading file %s: %v", filename, err)
+	}
+	var chain bytes.Buffer
+	for block, rest := pem.Decode(b); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type == "CERTIFICATE" {
+			chain.Write(block.Bytes)
+		}
+	}
+	certs, err := x509.ParseCertificates(chain.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("failed parsing certificates in file %s: %v", filename, err)
+	} else if len(certs) == 0 {
+		return nil, fmt.Errorf("file %s has no certificates", filename)
+	}
+	certID, err := keyID(certs[0].PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	if id, err := keyID(key.Public()); err != nil || id != certID {
+		return nil, fmt.Errorf("certificate in file %s does not match the private key", filename)
+	}
+	return &certificateSigner{Signer: key, chain: chain.Bytes()}, nil
+}
+
+// loadCertPool returns the pool of given CA certificates, or nil if there is
+// none.
+func loadCertPool(keys []Key) (*x509.CertPool, error) {
+	if len(keys) == 0 {
+		return nil, nil
+	}
+	pool := x509.NewCertPool()
+	for _, k := range keys {
+		b := []byte(k.Value)
+		if len(b) == 0 {
+			var err error
+			if b, err = ioutil.ReadFile(k.Filename); err != nil {
+				return nil, fmt.Errorf("failed reading CA file %s: %v", k.Filename, err)
+			}
+		}
+		if !pool.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("no CA certificates in '%s'", k.Filename)
+		}
+	}
+	return pool, nil
+}
+
+// verifyChain verifies given certificate chain against the CA roots of
+// the keyring. It returns the public key of the first certificate, which
+// must be valid now and allowed for code signing.
+func (kr *Keyring) verifyChain(chain []byte) (crypto.PublicKey, error) {
+	certs, err := x509.ParseCertificates(chain)
+	if err != nil {
+		return nil, err
+	} else if len(certs) == 0 {
+		return nil, fmt.Errorf("certificate chain is empty")
+	}
+	leaf := certs[0]
+	if leaf.KeyUsage != 0 && leaf.KeyUsage&x509.KeyUsageDigitalSignature == 0 {
+		return nil, fmt.Errorf("certificate of %s is not allowed for digital signature", leaf.Subject)
+	}
+	intermediates := x509.NewCertPool()
+	for _, c := range certs[1:] {
+		intermediates.AddCert(c)
+	}
+	if _, err = leaf.Verify(x509.VerifyOptions{
+		Roots:         kr.Roots,
+		Intermediates: intermediates,
+		CurrentTime:   time.Now(),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+	}); err != nil {
+		return nil, err
+	}
+	return leaf.PublicKey, nil
+}
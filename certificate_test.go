@@ -0,0 +1,119 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  crypto.Signer
+}
+
+// newTestCert returns a certificate of a new ECDSA key that is issued by
+// `parent`, or a self-signed CA certificate if `parent` is nil.
+func newTestCert(t *testing.T, parent *testCert, ca bool, usage []x509.ExtKeyUsage, notAfter time.Time) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: "test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              notAfter,
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           usage,
+		BasicConstraintsValid: true,
+		IsCA:                  ca,
+	}
+	if ca {
+		tmpl.KeyUsage |= x509.KeyUsageCertSign
+	}
+	issuer, signer := tmpl, crypto.Signer(key)
+	if parent != nil {
+		issuer, signer = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, issuer, key.Public(), signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{cert: cert, key: key}
+}
+
+func pemCerts(certs ...*testCert) []byte {
+	var b []byte
+	for _, c := range certs {
+		b = append(b, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.cert.Raw})...)
+	}
+	return b
+}
+
+func TestCertificateSignature(t *testing.T) {
+	dir, err := ioutil.TempDir("", "certs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	later := time.Now().Add(time.Hour)
+	codeSigning := []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning}
+	root := newTestCert(t, nil, true, nil, later)
+	intermediate := newTestCert(t, root, true, nil, later)
+	otherRoot := newTestCert(t, nil, true, nil, later)
+
+	kr, err := loadKeyring(Key{}, KeyringConfig{
+		CertificateAuthorities: []Key{{Value: string(pemCerts(root))}},
+	})
+	if err != nil {
+		t.Fatalf("failed loading keyring: %v", err)
+	}
+
+	for _, tc := range []struct {
+		name  string
+		chain []*testCert
+		valid bool
+	}{
+		{"valid", []*testCert{newTestCert(t, intermediate, false, codeSigning, later), intermediate}, true},
+		{"expired", []*testCert{newTestCert(t, intermediate, false, codeSigning, time.Now().Add(-time.Minute)), intermediate}, false},
+		{"server-auth", []*testCert{newTestCert(t, intermediate, false, []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}, later), intermediate}, false},
+		{"no-intermediate", []*testCert{newTestCert(t, intermediate, false, codeSigning, later)}, false},
+		{"other-root", []*testCert{newTestCert(t, otherRoot, false, codeSigning, later)}, false},
+	} {
+		filename := filepath.Join(dir, tc.name)
+		ioutil.WriteFile(filename, pemCerts(tc.chain...), 0644)
+		key, err := LoadCertificateSigner(tc.chain[0].key, filename)
+		if err != nil {
+			t.Fatalf("%s: failed loading certificate: %v", tc.name, err)
+		}
+		n := newTestNotification(t, key)
+		if s := n.Signatures[signatureName]; len(s.Certificate) == 0 {
+			t.Errorf("%s: signature has no certificate", tc.name)
+		}
+		if err = n.Verify(kr); (err == nil) != tc.valid {
+			t.Errorf("%s: got verification error %v", tc.name, err)
+		}
+	}
+
+	_, other, _ := ed25519.GenerateKey(rand.Reader)
+	ioutil.WriteFile(filepath.Join(dir, "root"), pemCerts(root), 0644)
+	if _, err = LoadCertificateSigner(other, filepath.Join(dir, "root")); err == nil {
+		t.Errorf("a certificate of another key should not be loaded")
+	}
+}
@@ -0,0 +1,261 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"path/filepath"
+	"time"
+
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/pkg/errors"
+	"github.com/valyala/fasthttp"
+	"github.com/zeebo/bencode"
+)
+
+// ClusterConfig holds configurations of a cluster, which is a group of peers
+// that share a rendezvous server and a signing key.
+type ClusterConfig struct {
+	Name         string `json:"name"`
+	Server       string `json:"server"`
+	StunPassword string `json:"stun-password,omitempty"`
+	PublicKey    Key    `json:"public-key"`
+
+	// Keyring has the trusted keys in addition to `PublicKey`, and
+	// the threshold of signatures
+	Keyring KeyringConfig `json:"keyring,omitempty"`
+}
+
+// Cluster is a membership of the agent in a cluster. Each cluster has its own
+// overlay network, trusted keys, and updates namespace.
+type Cluster struct {
+	Name    string
+	Config  ClusterConfig
+	Overlay *OverlayConn
+	Gossip  *Gossip
+	Keyring *Keyring
+
+	// NAT is the discovered NAT behavior, or nil if it is unknown
+	NAT *NATBehavior
+	// Mode is the overlay mode selected from the NAT behavior
+	Mode string
+
+	// state of the server's push channel
+	pushRevision    uint64
+	pushETag        string
+	pushUnsupported bool
+
+	agent   *Agent
+	updates map[string]*Update
+
+	// info-hashes of compact notifications whose info are being fetched
+	fetching map[metainfo.Hash]struct{}
+}
+
+// clusterConfigs returns the configurations of clusters that the agent joins.
+// If none is specified, then the agent joins a cluster with an empty name using
+// `Server`, `PublicKey`, `Keyring`, and `Overlay.StunPassword`.
+func (cfg *Config) clusterConfigs() []ClusterConfig {
+	if len(cfg.Clusters) == 0 {
+		return []ClusterConfig{
+			ClusterConfig{
+				Server:       cfg.Server,
+				StunPassword: cfg.Overlay.StunPassword,
+				PublicKey:    cfg.PublicKey,
+				Keyring:      cfg.Keyring,
+			},
+		}
+	}
+	ccs := make([]ClusterConfig, len(cfg.Clusters))
+	for i, cc := range cfg.Clusters {
+		if len(cc.StunPassword) == 0 {
+			cc.StunPassword = cfg.Overlay.StunPassword
+		}
+		ccs[i] = cc
+	}
+	return ccs
+}
+
+// newCluster creates a cluster membership of given agent. `address` is
+// the local address of the cluster's overlay.
+func newCluster(cfg ClusterConfig, a *Agent, address string) (*Cluster, error) {
+	var err error
+
+	c := &Cluster{
+		Name:    cfg.Name,
+		Config:  cfg,
+		agent:   a,
+		updates: make(map[string]*Update),
+	}
+
+	// load trusted keys
+	if c.Keyring, err = loadKeyring(cfg.PublicKey, cfg.Keyring); err != nil {
+		return nil, fmt.Errorf("ERROR: failed loading keyring of cluster '%s': %v", cfg.Name, err)
+	}
+
+	// create Overlay network
+	if a.Config.NoUDP {
+		log.Printf("overlay of cluster '%s' is disabled since NoUDP = true", cfg.Name)
+		c.Mode = overlayModeTCP
+		return c, nil
+	}
+	c.Mode = overlayModeDirect
+	ocfg := a.Config.Overlay
+	ocfg.Address = address
+	ocfg.Server = cfg.Server
+	ocfg.StunPassword = cfg.StunPassword
+	ocfg.peersFile = c.peersFile()
+	ocfg.peersAdded = c.addTorrentPeers
+	if c.Overlay, err = NewOverlayConn(ocfg); err != nil {
+		return nil, errors.Wrapf(err, "failed creating overlay of cluster '%s'", cfg.Name)
+	}
+	c.Gossip = NewGossip(c.Overlay)
+	if a.Config.NATDiscovery {
+		go c.discoverNAT(anyPortAddress(address))
+	}
+	return c, nil
+}
+
+// discoverNAT discovers the NAT behavior of the cluster's overlay, which
+// switches to relay mode if the peers cannot reach it directly. Discovery
+// is repeated while the server does not respond, and the overlay stays in
+// direct mode until the behavior is known.
+func (c *Cluster) discoverNAT(local string) {
+	for {
+		nb, err := DiscoverNAT(c.Config.Server, c.Config.StunPassword, local)
+		if err == errNoResponse {
+			log.Printf("NAT discovery of cluster '%s' failed: %v, retry in %v", c.Name, err, natDiscoveryInterval)
+			time.Sleep(natDiscoveryInterval)
+			continue
+		} else if err != nil {
+			log.Printf("NAT discovery of cluster '%s' failed: %v", c.Name, err)
+			return
+		}
+		c.agent.Lock()
+		c.NAT, c.Mode = nb, nb.OverlayMode()
+		c.agent.Unlock()
+		log.Printf("NAT of cluster '%s': %s, overlay mode: %s", c.Name, nb, nb.OverlayMode())
+		if nb.OverlayMode() == overlayModeRelay {
+			c.Overlay.Lock()
+			c.Overlay.Config.Relay = true
+			c.Overlay.Unlock()
+		}
+		return
+	}
+}
+
+// peersFile returns the file of the cluster's peer table in the data dir.
+func (c *Cluster) peersFile() string {
+	if len(c.Name) == 0 {
+		return filepath.Join(c.agent.Config.DataDir, "peers.json")
+	}
+	return filepath.Join(c.agent.Config.DataDir, fmt.Sprintf("peers-%s.json", url.PathEscape(c.Name)))
+}
+
+// anyPortAddress returns given address with port zero, so that
+// the system picks an available port.
+func anyPortAddress(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return net.JoinHostPort(host, "0")
+	}
+	return addr
+}
+
+func (c *Cluster) start() {
+	go c.startGossip()
+	if c.Gossip != nil && c.agent.Config.AntiEntropyInterval > 0 {
+		ExecEvery(time.Duration(c.agent.Config.AntiEntropyInterval)*time.Second, c.antiEntropy)
+	}
+}
+
+func (c *Cluster) startGossip() {
+	counter := 0
+	c.readTCP()
+	for {
+		if c.Overlay != nil && c.Overlay.Ready() {
+			counter = 0
+			c.readOverlay()
+		} else if counter == 0 && c.pushEnabled() && c.readPush() == nil {
+			// the server has pushed new notifications, or the wait has expired
+		} else {
+			// poll the server, or back off before retrying the push channel
+			counter++
+			time.Sleep(time.Second)
+			if counter > c.agent.Config.ReadTCPInterval {
+				counter = 0
+				if !c.pushEnabled() {
+					c.readTCP()
+				}
+			}
+		}
+	}
+}
+
+func (c *Cluster) readTCP() error {
+	log.Printf("readTCP[%s] - starting", c.Name)
+	url := fmt.Sprintf("http://%s", c.Config.Server)
+	code, body, err := fasthttp.Get(nil, url)
+	if code != 200 || err != nil {
+		err := errors.Errorf("readTCP[%s] - failed getting updates from %s, status code: %d, error: %v", c.Name, url, code, err)
+		log.Println(err)
+		return err
+	}
+	notifications := make(map[string]*Notification)
+	if err := json.Unmarshal(body, &notifications); err != nil {
+		err := errors.Errorf("readTCP[%s] - failed decoding notifications from %s, body: %s, : %v", c.Name, url, string(body), err)
+		log.Println(err)
+		return err
+	}
+	c.startNotifications("readTCP", notifications)
+	log.Printf("readTCP[%s] - finished", c.Name)
+	return nil
+}
+
+// startNotifications starts the updates of given notifications that are
+// received from the server by function `caller`.
+func (c *Cluster) startNotifications(caller string, notifications map[string]*Notification) {
+	for _, notification := range notifications {
+		u := NewUpdate(*notification, c)
+		if err := u.Start(c.agent); err != nil {
+			switch err {
+			case errUpdateIsAlreadyExist, errUpdateIsOlder, errUpdateVerificationFailed:
+				log.Printf("%s[%s] - ignored the update: %v", caller, c.Name, err)
+			default:
+				log.Printf("%s[%s] - failed adding the torrent-file++ to TorrentClient: %v", caller, c.Name, err)
+			}
+		}
+	}
+}
+
+func (c *Cluster) readOverlay() {
+	log.Printf("readOverlay[%s] - starting", c.Name)
+	if m, sender, err := c.Gossip.ReadMsgFrom(); err != nil {
+		log.Printf("readOverlay[%s] - failed reading %v", c.Name, err)
+	} else if m.Kind == gossipDigest {
+		c.processDigest(sender, m.Data)
+	} else if m.Kind == gossipCompact {
+		c.processCompact(sender, m)
+	} else {
+		var notification Notification
+		if err = bencode.DecodeBytes(m.Data, &notification); err != nil {
+			log.Printf("readOverlay[%s] - the gossip message is not a notification: %v", c.Name, err)
+		} else if err = notification.Verify(c.Keyring); err == nil {
+			c.Gossip.Forward(m, sender)
+		}
+		if err = NewUpdate(notification, c).Start(c.agent); err != nil {
+			switch err {
+			case errUpdateIsAlreadyExist, errUpdateIsOlder, errUpdateVerificationFailed:
+				log.Printf("readOverlay[%s] - ignored the update: %v", c.Name, err)
+			default:
+				log.Printf("readOverlay[%s] - failed adding the torrent-file++ to TorrentClient: %v", c.Name, err)
+			}
+		}
+	}
+	log.Printf("readOverlay[%s] - finished", c.Name)
+}
@@ -3,7 +3,7 @@ package main
 import (
 	"bufio"
 	"bytes"
-	"crypto/rsa"
+	"crypto"
 	"crypto/x509"
 	"encoding/binary"
 	"encoding/hex"
@@ -23,9 +23,6 @@ import (
 )
 
 const (
-	// DefaultTracker is the default BitTorrent tracker address
-	DefaultTracker = "http://fruit-testbed.org:6969/announce"
-
 	// DefaultPieceLength is the default length of BitTorrent file-piece
 	DefaultPieceLength = 32 * 1024
 )
@@ -45,6 +42,7 @@ const (
 
 var (
 	stunDataIndication        = stun.NewType(stun.MethodData, stun.ClassIndication)
+	stunSendIndication        = stun.NewType(stun.MethodSend, stun.ClassIndication)
 	stunBindingIndication     = stun.NewType(stun.MethodBinding, stun.ClassIndication)
 	stunChannelBindIndication = stun.NewType(stun.MethodChannelBind, stun.ClassIndication)
 
@@ -133,10 +131,45 @@ func (s Session) Equal(ss Session) bool {
 	return true
 }
 
+// valid returns true if the session has at least the external and internal
+// addresses, and none of its addresses is nil.
+func (s Session) valid() bool {
+	if len(s) < 2 {
+		return false
+	}
+	for _, addr := range s {
+		if addr == nil {
+			return false
+		}
+	}
+	return true
+}
+
 // SessionTable is a map whose keys are Peer IDs
 // and values are pairs of [external-addr, internal-addr].
+// A peer whose session is empty has been removed from the table, and a peer
+// whose session has a fifth address can be reached through the server's relay.
 type SessionTable map[PeerID]Session
 
+// LastSeenTable is a map whose keys are Peer IDs and values are
+// the last time the peers were seen.
+type LastSeenTable map[PeerID]time.Time
+
+// Expired returns the IDs of peers that have not been seen within
+// given lifetime.
+func (ls LastSeenTable) Expired(lifetime time.Duration) []PeerID {
+	var (
+		pids    []PeerID
+		expired = time.Now().Add(-lifetime)
+	)
+	for pid, t := range ls {
+		if t.Before(expired) {
+			pids = append(pids, pid)
+		}
+	}
+	return pids
+}
+
 // JSON marshals the SessionTable to JSON and then returns it.
 func (st *SessionTable) JSON() []byte {
 	var buf bytes.Buffer
@@ -372,38 +405,78 @@ func ExecEvery(t time.Duration, f func()) chan struct{} {
 	return quit
 }
 
-// LoadPrivateKey reads and returns a private-key from given filename.
-func LoadPrivateKey(filename string) (*rsa.PrivateKey, error) {
+// LoadPrivateKey reads and returns a private-key from given filename. The key
+// is an RSA, ECDSA P-256 or Ed25519 key in PKCS#1, SEC 1, PKCS#8 or
+// unencrypted OpenSSH format.
+func LoadPrivateKey(filename string) (crypto.Signer, error) {
 	b, err := ioutil.ReadFile(filename)
 	if err != nil {
 		return nil, fmt.Errorf("failed reading file %s: %v", filename, err)
 	}
 	block, _ := pem.Decode(b)
-	if block == nil || block.Type != "RSA PRIVATE KEY" {
-		return nil, fmt.Errorf("failed decoding public key in file %s", filename)
+	if block == nil {
+		return nil, fmt.Errorf("failed decoding private key in file %s", filename)
+	}
+	var key interface{}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "OPENSSH PRIVATE KEY":
+		key, err = parseOpenSSHPrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported private key type '%s' in file %s", block.Type, filename)
 	}
-	return x509.ParsePKCS1PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed parsing private key in file %s: %v", filename, err)
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("key type in file %s is not supported", filename)
+	}
+	if _, err = keyAlgorithm(signer.Public()); err != nil {
+		return nil, fmt.Errorf("private key in file %s: %v", filename, err)
+	}
+	return signer, nil
 }
 
-// LoadPublicKey reads and returns a public-key from given filename.
-func LoadPublicKey(filename string) (*rsa.PublicKey, error) {
+// LoadPublicKey reads and returns a public-key from given filename. The key
+// is an RSA, ECDSA P-256 or Ed25519 key in PKIX or OpenSSH format.
+func LoadPublicKey(filename string) (crypto.PublicKey, error) {
 	b, err := ioutil.ReadFile(filename)
 	if err != nil {
 		return nil, fmt.Errorf("failed reading file %s: %v", filename, err)
 	}
-	block, _ := pem.Decode(b)
-	if block == nil || block.Type != "PUBLIC KEY" {
-		return nil, fmt.Errorf("failed decoding public key in file %s", filename)
-	}
-	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	pub, err := parsePublicKey(b)
 	if err != nil {
 		return nil, fmt.Errorf("failed parsing public key in file %s: %v", filename, err)
 	}
-	switch pub := pub.(type) {
-	case *rsa.PublicKey:
-		return pub, nil
+	return pub, nil
+}
+
+// parsePublicKey returns the public key of given PEM block or OpenSSH line.
+func parsePublicKey(b []byte) (crypto.PublicKey, error) {
+	var (
+		pub crypto.PublicKey
+		err error
+	)
+	if block, _ := pem.Decode(b); block == nil {
+		pub, err = parseOpenSSHPublicKey(b)
+	} else if block.Type == "PUBLIC KEY" {
+		pub, err = x509.ParsePKIXPublicKey(block.Bytes)
+	} else {
+		return nil, fmt.Errorf("unsupported public key type '%s'", block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if _, err = keyAlgorithm(pub); err != nil {
+		return nil, err
 	}
-	return nil, fmt.Errorf("key type in file %s is not RSA", filename)
+	return pub, nil
 }
 
 var stunMessagePool = sync.Pool{
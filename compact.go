@@ -0,0 +1,241 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"time"
+
+	torrentbencode "github.com/anacrolix/torrent/bencode"
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/zeebo/bencode"
+)
+
+const (
+	// compactSignatureName is the name of the signature over the compact
+	// form of a notification
+	compactSignatureName = signatureName + ".info-hash"
+
+	// metadataTimeout is the maximum time of fetching the info dictionary of
+	// a compact notification from the peers
+	metadataTimeout = 5 * time.Minute
+)
+
+// CompactNotification is the magnet-style form of a Notification, which
+// carries the info-hash instead of the info dictionary. The info dictionary
+// is fetched from the peers with the metadata extension (BEP 9).
+type CompactNotification struct {
+	UUID       string               `bencode:"uuid"`
+	Version    uint64               `bencode:"version"`
+	InfoHash   []byte               `bencode:"info-hash"`
+	Length     int64                `bencode:"length"`
+	Signatures map[string]Signature `bencode:"signatures,omitempty"`
+}
+
+// compact returns the compact form of the Notification, which has
+// the compact signatures of the Notification if they are available.
+func (mi *Notification) compact() (*CompactNotification, error) {
+	ih, err := mi.infoHash()
+	if err != nil {
+		return nil, err
+	}
+	cn := CompactNotification{
+		UUID:     mi.UUID,
+		Version:  mi.Version,
+		InfoHash: ih.Bytes(),
+		Length:   mi.Info.TotalLength(),
+	}
+	for name, s := range mi.Signatures {
+		if name == compactSignatureName || strings.HasPrefix(name, compactSignatureName+signatureKeySeparator) {
+			if cn.Signatures == nil {
+				cn.Signatures = make(map[string]Signature)
+			}
+			cn.Signatures[name] = s
+		}
+	}
+	return &cn, nil
+}
+
+// coveredByCompact returns true if the Notification has no fields other than
+// those of its compact form and its info dictionary, like a Notification of
+// a compact notification.
+func (mi *Notification) coveredByCompact() bool {
+	return len(mi.Announce) == 0 && len(mi.AnnounceList) == 0 && len(mi.Nodes) == 0 &&
+		len(mi.URLList) == 0 && mi.CreationDate == 0 && len(mi.CreatedBy) == 0 &&
+		len(mi.Encoding) == 0 && mi.Delta == nil && mi.Keyring == nil
+}
+
+// hashed returns the SHA-256 hash of the signed payload of the compact
+// notification in given signature format.
+func (cn *CompactNotification) hashed(format int) ([]byte, error) {
+	var (
+		data []byte
+		err  error
+	)
+	unsigned := *cn
+	unsigned.Signatures = nil
+	switch format {
+	case signatureFormatJSON:
+		data, err = json.Marshal(unsigned)
+	case signatureFormatBencode:
+		data, err = bencode.EncodeBytes(unsigned)
+	default:
+		return nil, fmt.Errorf("unsupported signature format %d", format)
+	}
+	if err != nil {
+		return nil, err
+	}
+	hashed := sha256.Sum256(data)
+	return hashed[:], nil
+}
+
+// sign returns the compact signature using given private key.
+func (cn *CompactNotification) sign(key crypto.Signer) (Signature, error) {
+	hashed, err := cn.hashed(signatureFormatBencode)
+	if err != nil {
+		return Signature{}, err
+	}
+	sig, err := signHashed(key, hashed)
+	sig.Format = signatureFormatBencode
+	return sig, err
+}
+
+// Verify verifies the compact signatures using given keyring.
+func (cn *CompactNotification) Verify(kr *Keyring) error {
+	if !hasSignature(cn.Signatures, compactSignatureName) {
+		return fmt.Errorf("compact signature is not available")
+	}
+	return kr.verify(cn.Signatures, compactSignatureName, cn.hashed)
+}
+
+// Write writes the compact notification to given Writer.
+func (cn *CompactNotification) Write(w io.Writer) error {
+	b, err := bencode.EncodeBytes(*cn)
+	if err != nil {
+		return fmt.Errorf("failed to generating bencode from CompactNotification: %v", err)
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+// gossipData returns the kind and the data of the gossip message of
+// the Notification, which is the compact form if `compact` is true or
+// the Notification is too large for a packet, and the Notification has
+// a compact signature. A keyring notification is always sent in full,
+// because the compact signatures do not cover its keyring change.
+func (mi *Notification) gossipData(compact bool) (string, []byte, error) {
+	var b bytes.Buffer
+	if err := mi.Write(&b); err != nil {
+		return "", nil, err
+	}
+	if mi.Keyring != nil || !hasSignature(mi.Signatures, compactSignatureName) || (!compact && b.Len() <= stunMaxPacketDataSize) {
+		return gossipNotification, b.Bytes(), nil
+	}
+	cn, err := mi.compact()
+	if err != nil {
+		return "", nil, err
+	}
+	b.Reset()
+	if err = cn.Write(&b); err != nil {
+		return "", nil, err
+	}
+	return gossipCompact, b.Bytes(), nil
+}
+
+// notification returns the Notification of given info dictionary, after
+// checking that it matches the info-hash and the length.
+func (cn *CompactNotification) notification(infoBytes []byte) (*Notification, error) {
+	if h := sha1.Sum(infoBytes); !bytes.Equal(h[:], cn.InfoHash) {
+		return nil, fmt.Errorf("info dictionary does not match info-hash %x", cn.InfoHash)
+	}
+	n := Notification{
+		UUID:       cn.UUID,
+		Version:    cn.Version,
+		Signatures: cn.Signatures,
+	}
+	if err := torrentbencode.Unmarshal(infoBytes, &n.Info); err != nil {
+		return nil, fmt.Errorf("failed decoding info dictionary: %v", err)
+	} else if n.Info.TotalLength() != cn.Length {
+		return nil, fmt.Errorf("length of info dictionary is %d, expected %d", n.Info.TotalLength(), cn.Length)
+	}
+	return &n, nil
+}
+
+// processCompact verifies the compact notification of given gossip message
+// and forwards it, then fetches its info dictionary if the update is new.
+func (c *Cluster) processCompact(sender PeerID, m *gossipMessage) {
+	var cn CompactNotification
+	if err := bencode.DecodeBytes(m.Data, &cn); err != nil {
+		log.Printf("processCompact[%s] - %s sent an invalid compact notification: %v", c.Name, sender, err)
+		return
+	} else if len(cn.InfoHash) != metainfo.HashSize {
+		log.Printf("processCompact[%s] - %s sent an invalid info-hash", c.Name, sender)
+		return
+	} else if err = cn.Verify(c.Keyring); err != nil {
+		log.Printf("processCompact[%s] - verification failed: %v", c.Name, err)
+		return
+	}
+	c.Gossip.Forward(m, sender)
+	if u := c.agent.getUpdate(c, cn.UUID); u != nil && u.Notification.Version >= cn.Version {
+		return
+	}
+	var ih metainfo.Hash
+	copy(ih[:], cn.InfoHash)
+
+	c.agent.Lock()
+	if c.fetching == nil {
+		c.fetching = make(map[metainfo.Hash]struct{})
+	}
+	_, ok := c.fetching[ih]
+	c.fetching[ih] = struct{}{}
+	c.agent.Unlock()
+	if !ok {
+		go c.fetchMetadata(&cn, ih)
+	}
+}
+
+// fetchMetadata fetches the info dictionary of given compact notification
+// from the peers, then starts the update.
+func (c *Cluster) fetchMetadata(cn *CompactNotification, ih metainfo.Hash) {
+	defer func() {
+		c.agent.Lock()
+		delete(c.fetching, ih)
+		c.agent.Unlock()
+	}()
+
+	// the torrent belongs to an update if it is not new
+	t, isNew := c.agent.torrentClient.AddTorrentInfoHash(ih)
+	t.AddPeers(c.torrentPeers(nil))
+	if tracker := c.agent.Config.BitTorrent.Tracker; len(tracker) > 0 {
+		t.AddTrackers([][]string{{tracker}})
+	}
+	select {
+	case <-t.GotInfo():
+	case <-time.After(metadataTimeout):
+		log.Printf("fetchMetadata[%s] - timeout fetching info of uuid:%s version:%d", c.Name, cn.UUID, cn.Version)
+		if isNew {
+			t.Drop()
+		}
+		return
+	}
+	n, err := cn.notification(t.Metainfo().InfoBytes)
+	if err == nil {
+		err = NewUpdate(*n, c).Start(c.agent)
+	}
+	if err != nil {
+		log.Printf("fetchMetadata[%s] - ignored the update uuid:%s version:%d: %v", c.Name, cn.UUID, cn.Version, err)
+		if isNew {
+			t.Drop()
+		}
+	}
+}
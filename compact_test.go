@@ -0,0 +1,93 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	torrentbencode "github.com/anacrolix/torrent/bencode"
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/zeebo/bencode"
+)
+
+func newTestNotification(t *testing.T, key crypto.Signer) *Notification {
+	f, err := ioutil.TempFile("", "update")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.Write(make([]byte, minPieceLength+1))
+	f.Close()
+	n, err := NewNotification(f.Name(), UUIDShell, 1, [][]string{{"http://localhost/announce"}},
+		nil, nil, minPieceLength, key)
+	if err != nil {
+		t.Fatalf("failed creating notification: %v", err)
+	}
+	return n
+}
+
+func TestCompactNotification(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kr := newTestKeyring(t, 1, &key.PublicKey)
+	n := newTestNotification(t, key)
+	if err = n.Verify(kr); err != nil {
+		t.Fatalf("failed verifying notification: %v", err)
+	}
+
+	kind, b, err := n.gossipData(true)
+	if err != nil || kind != gossipCompact {
+		t.Fatalf("gossip data: got kind '%s', %v", kind, err)
+	}
+	var cn CompactNotification
+	if err = bencode.DecodeBytes(b, &cn); err != nil {
+		t.Fatalf("failed decoding compact notification: %v", err)
+	} else if err = cn.Verify(kr); err != nil {
+		t.Errorf("failed verifying compact notification: %v", err)
+	}
+	if cn.Length != minPieceLength+1 || len(cn.InfoHash) != 20 {
+		t.Errorf("compact notification: got %+v", cn)
+	}
+	cn.Version++
+	if err = cn.Verify(kr); err == nil {
+		t.Errorf("a modified compact notification should not be verified")
+	}
+	cn.Version--
+
+	infoBytes, err := torrentbencode.Marshal(n.Info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nn, err := cn.notification(infoBytes)
+	if err != nil {
+		t.Fatalf("failed creating notification of info: %v", err)
+	} else if err = nn.Verify(kr); err != nil {
+		t.Errorf("failed verifying notification of compact notification: %v", err)
+	}
+	if _, err = cn.notification(infoBytes[1:]); err == nil {
+		t.Errorf("info that does not match the info-hash should be rejected")
+	}
+
+	// the compact signature does not cover the other fields of a full
+	// notification whose full signature is stripped
+	stripped := *n
+	stripped.Signatures = cn.Signatures
+	if err = stripped.Verify(kr); err == nil {
+		t.Errorf("a notification with only the compact signature should not be verified")
+	}
+	stripped = *nn
+	stripped.Nodes = []metainfo.Node{"10.0.0.1:6881"}
+	stripped.URLList = []string{"http://attacker/"}
+	if err = stripped.Verify(kr); err == nil {
+		t.Errorf("a notification of compact notification with added fields should not be verified")
+	}
+
+	if kind, _, err = n.gossipData(false); err != nil || kind != gossipNotification {
+		t.Errorf("a small notification should be gossiped in full, got kind '%s', %v", kind, err)
+	}
+}
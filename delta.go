@@ -0,0 +1,440 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/pkg/errors"
+)
+
+const (
+	// deltaMagic is the header of a patch file
+	deltaMagic = "p2pdelta1"
+
+	// deltaBlockSize is the size of the blocks of a base payload that
+	// a patch can copy
+	deltaBlockSize = 32
+
+	// deltaHashBase is the base of the rolling hash of blocks
+	deltaHashBase = 257
+
+	// operations of a patch
+	deltaCopy = 'c'
+	deltaAdd  = 'a'
+
+	// deltaDir is the directory in the data directory where base payloads
+	// are kept and patches are applied
+	deltaDir = ".delta"
+
+	// deltaStallTimeout is the maximum time that the download of a patch
+	// makes no progress, after which the full payload is downloaded instead
+	deltaStallTimeout = 5 * time.Minute
+)
+
+var errInvalidDelta = errors.New("invalid delta patch")
+
+// Delta is a binary patch that produces the payload of a Notification from
+// the payload of a base version. It is only applied when the agent has
+// the base version, otherwise the agent downloads the full payload.
+type Delta struct {
+	BaseVersion  uint64        `bencode:"base-version"`
+	BaseInfoHash []byte        `bencode:"base-info-hash"`
+	Info         metainfo.Info `bencode:"info"`
+}
+
+// NewDelta creates the patch from file `base` of version `baseVersion` to
+// the payload of given notification, which is written to the temporary
+// directory. It returns the Delta and the filename of the patch.
+func NewDelta(n *Notification, filename, base string, baseVersion uint64) (*Delta, string, error) {
+	if n.Info.IsDir() {
+		return nil, "", fmt.Errorf("delta of a directory is not supported")
+	}
+	bn := Notification{Info: metainfo.Info{PieceLength: n.Info.PieceLength}}
+	if err := bn.Info.BuildFromFilePath(base); err != nil {
+		return nil, "", errors.Wrapf(err, "failed reading base file %s", base)
+	}
+	bn.Info.Name = fmt.Sprintf("%s-v%d-%s", n.UUID, baseVersion, bn.Info.Name)
+	ih, err := bn.infoHash()
+	if err != nil {
+		return nil, "", err
+	}
+
+	baseData, err := ioutil.ReadFile(base)
+	if err != nil {
+		return nil, "", err
+	}
+	targetData, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, "", err
+	}
+	// the patch is a new file, so that it cannot be a link planted by
+	// another user or collide with a concurrent submission
+	f, err := ioutil.TempFile("", fmt.Sprintf("%s-v%d-delta-v%d-", n.UUID, n.Version, baseVersion))
+	if err != nil {
+		return nil, "", err
+	}
+	patch := f.Name()
+	if err = f.Chmod(0644); err == nil {
+		err = writeDelta(f, baseData, targetData)
+	}
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		os.Remove(patch)
+		return nil, "", errors.Wrap(err, "failed writing patch")
+	}
+
+	d := Delta{
+		BaseVersion:  baseVersion,
+		BaseInfoHash: ih.Bytes(),
+		Info:         metainfo.Info{PieceLength: n.Info.PieceLength},
+	}
+	if err = d.Info.BuildFromFilePath(patch); err != nil {
+		return nil, "", err
+	}
+	return &d, patch, nil
+}
+
+// torrentMetainfo returns the torrent Metainfo of the patch, which has
+// the trackers and the nodes of given notification.
+func (d *Delta) torrentMetainfo(n *Notification) (*metainfo.MetaInfo, error) {
+	p := *n
+	p.Info = d.Info
+	return p.torrentMetainfo()
+}
+
+// infoHash returns the info-hash of the patch of given notification.
+func (d *Delta) infoHash(n *Notification) (metainfo.Hash, error) {
+	mm, err := d.torrentMetainfo(n)
+	if err != nil {
+		return metainfo.Hash{}, err
+	}
+	return mm.HashInfoBytes(), nil
+}
+
+// blockHash returns the rolling hash of given block.
+func blockHash(b []byte) uint32 {
+	var h uint32
+	for _, c := range b {
+		h = h*deltaHashBase + uint32(c)
+	}
+	return h
+}
+
+// writeDelta writes the patch that produces `target` from `base` to `w`.
+// The patch is a gzipped sequence of operations that copy a range of
+// the base or add literal bytes.
+func writeDelta(w io.Writer, base, target []byte) error {
+	// index the blocks of the base by their hashes
+	index := make(map[uint32]int)
+	for i := 0; i+deltaBlockSize <= len(base); i += deltaBlockSize {
+		h := blockHash(base[i : i+deltaBlockSize])
+		if _, ok := index[h]; !ok {
+			index[h] = i
+		}
+	}
+	// the factor of the outgoing byte of the rolling hash
+	var out uint32 = 1
+	for i := 1; i < deltaBlockSize; i++ {
+		out *= deltaHashBase
+	}
+
+	zw := gzip.NewWriter(w)
+	bw := bufio.NewWriter(zw)
+	buf := make([]byte, binary.MaxVarintLen64)
+	uvarint := func(n int) {
+		bw.Write(buf[:binary.PutUvarint(buf, uint64(n))])
+	}
+	bw.WriteString(deltaMagic)
+	uvarint(len(target))
+
+	add := 0
+	flush := func(end int) {
+		if end > add {
+			bw.WriteByte(deltaAdd)
+			uvarint(end - add)
+			bw.Write(target[add:end])
+		}
+	}
+	var h uint32
+	if len(target) >= deltaBlockSize {
+		h = blockHash(target[:deltaBlockSize])
+	}
+	for i := 0; i+deltaBlockSize <= len(target); {
+		if j, ok := index[h]; ok && bytes.Equal(base[j:j+deltaBlockSize], target[i:i+deltaBlockSize]) {
+			n := deltaBlockSize
+			for j+n < len(base) && i+n < len(target) && base[j+n] == target[i+n] {
+				n++
+			}
+			flush(i)
+			bw.WriteByte(deltaCopy)
+			uvarint(j)
+			uvarint(n)
+			i += n
+			add = i
+			if i+deltaBlockSize <= len(target) {
+				h = blockHash(target[i : i+deltaBlockSize])
+			}
+			continue
+		}
+		if i+deltaBlockSize < len(target) {
+			h = (h-uint32(target[i])*out)*deltaHashBase + uint32(target[i+deltaBlockSize])
+		}
+		i++
+	}
+	flush(len(target))
+
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// applyDelta writes the result of applying given patch to `base` to `w`.
+// The patch must produce `expected` bytes, which is checked before writing
+// so that an invalid patch cannot fill the disk.
+func applyDelta(base io.ReaderAt, patch io.Reader, w io.Writer, expected int64) error {
+	zr, err := gzip.NewReader(patch)
+	if err != nil {
+		return errors.Wrap(errInvalidDelta, err.Error())
+	}
+	r := bufio.NewReader(zr)
+	magic := make([]byte, len(deltaMagic))
+	if _, err = io.ReadFull(r, magic); err != nil || string(magic) != deltaMagic {
+		return errInvalidDelta
+	}
+	length, err := binary.ReadUvarint(r)
+	if err != nil {
+		return errInvalidDelta
+	} else if expected < 0 || length != uint64(expected) {
+		return fmt.Errorf("patch produces %d bytes, expected %d", length, expected)
+	}
+	var written uint64
+	for written < length {
+		op, err := r.ReadByte()
+		if err != nil {
+			return errInvalidDelta
+		}
+		switch op {
+		case deltaCopy:
+			offset, err := binary.ReadUvarint(r)
+			if err != nil {
+				return errInvalidDelta
+			}
+			n, err := binary.ReadUvarint(r)
+			if err != nil || n > length-written || offset > math.MaxInt64-n {
+				return errInvalidDelta
+			}
+			if _, err = io.CopyN(w, io.NewSectionReader(base, int64(offset), int64(n)), int64(n)); err != nil {
+				return errors.Wrap(errInvalidDelta, err.Error())
+			}
+			written += n
+		case deltaAdd:
+			n, err := binary.ReadUvarint(r)
+			if err != nil || n > length-written {
+				return errInvalidDelta
+			}
+			if _, err = io.CopyN(w, r, int64(n)); err != nil {
+				return errors.Wrap(errInvalidDelta, err.Error())
+			}
+			written += n
+		default:
+			return errInvalidDelta
+		}
+	}
+	if written != length {
+		return fmt.Errorf("patch produced %d bytes, expected %d", written, length)
+	}
+	return nil
+}
+
+// keepDeltaBase moves the payload of the old update to the delta directory
+// if it is the base of the update's Delta, so that it is not deleted with
+// the old update. It returns the filename of the base, or an empty string.
+// The caller must hold the lock.
+func (u *Update) keepDeltaBase(old *Update) string {
+	d := u.Notification.Delta
+	if d == nil || old.Notification.Version != d.BaseVersion || old.Notification.Info.IsDir() {
+		return ""
+	}
+	if ih, err := old.Notification.infoHash(); err != nil || !bytes.Equal(ih.Bytes(), d.BaseInfoHash) {
+		return ""
+	}
+	dir := filepath.Join(u.agent.dataDir, deltaDir)
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		log.Printf("WARNING: failed creating directory %s - %v", dir, err)
+		return ""
+	}
+	base := filepath.Join(dir, old.Notification.Info.Name)
+	if err := os.Rename(filepath.Join(u.agent.dataDir, old.Notification.Info.Name), base); err != nil {
+		log.Printf("base of delta uuid:%s version:%d is not available - %v",
+			u.Notification.UUID, u.Notification.Version, err)
+		return ""
+	}
+	return base
+}
+
+// deltaFetcher downloads the patch of an update, which it seeds until it is
+// stopped. If the base payload is available, it applies the patch to
+// the base, then writes the verified pieces of the result to the torrent of
+// the update. The torrent of the update only downloads the full payload
+// after the patch has been applied or has failed, or when the download of
+// the patch stalls for deltaStallTimeout.
+type deltaFetcher struct {
+	client  *torrent.Client
+	mi      *metainfo.MetaInfo
+	dataDir string
+	base    string
+	tf      *torrentFetcher
+	target  *torrent.Torrent
+	patch   *torrent.Torrent
+	done    chan struct{}
+	quit    chan struct{}
+	once    sync.Once
+	doneOne sync.Once
+}
+
+// newDeltaFetcher returns the fetcher of the patch of torrent Metainfo `mi`.
+// It must be created before torrent fetcher `tf` is started.
+func newDeltaFetcher(client *torrent.Client, mi *metainfo.MetaInfo, dataDir, base string, tf *torrentFetcher) *deltaFetcher {
+	f := &deltaFetcher{
+		client:  client,
+		mi:      mi,
+		dataDir: dataDir,
+		base:    base,
+		tf:      tf,
+		done:    make(chan struct{}),
+		quit:    make(chan struct{}),
+	}
+	if len(base) > 0 {
+		tf.wait = f.done
+	}
+	return f
+}
+
+// finish lets the torrent fetcher download the full payload.
+func (f *deltaFetcher) finish() {
+	f.doneOne.Do(func() { close(f.done) })
+}
+
+func (f *deltaFetcher) Start() error {
+	var err error
+	f.target = f.tf.t
+	if f.patch, err = f.client.AddTorrent(f.mi); err != nil {
+		f.finish()
+		return fmt.Errorf("failed adding patch torrent: %v", err)
+	}
+	f.patch.DownloadAll()
+	if len(f.base) > 0 {
+		go f.run()
+	} else {
+		f.finish()
+	}
+	return nil
+}
+
+func (f *deltaFetcher) run() {
+	defer f.finish()
+	defer os.Remove(f.base)
+	completed, progressed := f.patch.BytesCompleted(), time.Now()
+	for f.patch.BytesMissing() > 0 {
+		select {
+		case <-f.quit:
+			return
+		case <-f.target.Closed():
+			return
+		case <-time.After(time.Second):
+		}
+		if n := f.patch.BytesCompleted(); n > completed {
+			completed, progressed = n, time.Now()
+		} else if time.Since(progressed) > deltaStallTimeout {
+			log.Printf("deltaFetcher - patch %s has made no progress for %v, downloading the full payload",
+				f.patch.Name(), deltaStallTimeout)
+			return
+		}
+	}
+	if f.target.BytesMissing() == 0 {
+		return
+	}
+	if err := f.apply(); err != nil {
+		log.Printf("deltaFetcher - failed applying patch to %s: %v", f.base, err)
+	}
+}
+
+// apply applies the patch to the base in a temporary directory, then
+// copies the verified pieces of the result to the target torrent.
+func (f *deltaFetcher) apply() error {
+	info := f.target.Info()
+	dir, err := ioutil.TempDir(filepath.Dir(f.base), "apply")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	base, err := os.Open(f.base)
+	if err != nil {
+		return err
+	}
+	defer base.Close()
+	patch, err := os.Open(filepath.Join(f.dataDir, f.patch.Info().Name))
+	if err != nil {
+		return err
+	}
+	defer patch.Close()
+	out, err := os.Create(filepath.Join(dir, info.Name))
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(out)
+	if err = applyDelta(base, patch, bw, info.TotalLength()); err == nil {
+		err = bw.Flush()
+	}
+	if e := out.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		return err
+	}
+
+	sf := newSourceFetcher(dirSource(dir), f.target, 0, 0)
+	n := sf.fetch()
+	log.Printf("deltaFetcher - patched %d of %d pieces of %s", n, f.target.NumPieces(), info.Name)
+	return nil
+}
+
+func (f *deltaFetcher) Progress() (int64, int64) {
+	return f.target.BytesCompleted(), f.target.BytesMissing()
+}
+
+func (f *deltaFetcher) Complete() bool {
+	return f.target.BytesMissing() == 0
+}
+
+func (f *deltaFetcher) Stop() {
+	f.once.Do(func() {
+		close(f.quit)
+		f.finish()
+		if f.patch != nil {
+			f.patch.Drop()
+			<-f.patch.Closed()
+		}
+	})
+}
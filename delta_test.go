@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"crypto/rsa"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/zeebo/bencode"
+)
+
+func TestDelta(t *testing.T) {
+	base := make([]byte, 10000)
+	rand.Read(base)
+	target := append([]byte("prefix"), base[:4000]...)
+	target = append(target, []byte("changed")...)
+	target = append(target, base[5000:]...)
+
+	for _, tc := range []struct{ base, target []byte }{
+		{base, target},
+		{base, nil},
+		{nil, target},
+		{base[:10], base[:20]},
+	} {
+		var patch, out bytes.Buffer
+		if err := writeDelta(&patch, tc.base, tc.target); err != nil {
+			t.Fatalf("failed writing delta: %v", err)
+		}
+		if err := applyDelta(bytes.NewReader(tc.base), &patch, &out, int64(len(tc.target))); err != nil {
+			t.Fatalf("failed applying delta: %v", err)
+		}
+		if !bytes.Equal(out.Bytes(), tc.target) {
+			t.Errorf("delta of %d to %d bytes produced %d bytes", len(tc.base), len(tc.target), out.Len())
+		}
+	}
+
+	var patch, out bytes.Buffer
+	writeDelta(&patch, base, target)
+	if patch.Len() > len(target)/2 {
+		t.Errorf("patch has %d bytes, target has %d", patch.Len(), len(target))
+	}
+	if err := applyDelta(bytes.NewReader(base[:100]), bytes.NewReader(patch.Bytes()), &out, int64(len(target))); err == nil {
+		t.Errorf("a patch of a different base should not be applied")
+	}
+	if err := applyDelta(bytes.NewReader(base), bytes.NewReader(target), &out, int64(len(target))); err == nil {
+		t.Errorf("an invalid patch should not be applied")
+	}
+	out.Reset()
+	if err := applyDelta(bytes.NewReader(base), bytes.NewReader(patch.Bytes()), &out, int64(len(target)-1)); err == nil || out.Len() > 0 {
+		t.Errorf("a patch of another length should not be applied")
+	}
+
+	// the operations cannot write more than the declared length
+	var long bytes.Buffer
+	zw := gzip.NewWriter(&long)
+	zw.Write(append([]byte(deltaMagic), 10, deltaAdd, 100))
+	zw.Write(make([]byte, 100))
+	zw.Close()
+	out.Reset()
+	if err := applyDelta(bytes.NewReader(nil), &long, &out, 10); err == nil || out.Len() > 10 {
+		t.Errorf("an operation beyond the declared length should not be applied")
+	}
+}
+
+func TestNewDelta(t *testing.T) {
+	dir, err := ioutil.TempDir("", "delta")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	data := make([]byte, 3*minPieceLength)
+	rand.Read(data)
+	base, filename := filepath.Join(dir, "base"), filepath.Join(dir, "update")
+	ioutil.WriteFile(base, data, 0644)
+	copy(data[minPieceLength:], "changed")
+	ioutil.WriteFile(filename, data, 0644)
+
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kr := newTestKeyring(t, 1, &key.PublicKey)
+	n, err := NewNotification(filename, UUIDShell, 2, [][]string{{"http://localhost/announce"}},
+		nil, nil, minPieceLength, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var patch string
+	if n.Delta, patch, err = NewDelta(n, filename, base, 1); err != nil {
+		t.Fatalf("failed creating delta: %v", err)
+	}
+	defer os.Remove(patch)
+	if err = n.Sign(key); err != nil {
+		t.Fatal(err)
+	}
+	if n.Delta.BaseVersion != 1 || len(n.Delta.BaseInfoHash) != 20 || n.Delta.Info.TotalLength() >= int64(len(data)) {
+		t.Errorf("delta: got %+v", n.Delta)
+	}
+
+	// the delta is part of the signed notification
+	var b bytes.Buffer
+	if err = n.Write(&b); err != nil {
+		t.Fatal(err)
+	}
+	var d Notification
+	if err = bencode.DecodeBytes(b.Bytes(), &d); err != nil {
+		t.Fatalf("failed decoding notification: %v", err)
+	} else if d.Delta == nil || d.Delta.Info.Name != n.Delta.Info.Name {
+		t.Fatalf("decoded delta: got %+v", d.Delta)
+	} else if err = d.Verify(kr); err != nil {
+		t.Errorf("failed verifying notification with delta: %v", err)
+	}
+	d.Delta.BaseVersion++
+	if err = d.Verify(kr); err == nil {
+		t.Errorf("a modified delta should not be verified")
+	}
+
+	if _, err = d.Delta.torrentMetainfo(n); err != nil {
+		t.Errorf("failed generating patch metainfo: %v", err)
+	}
+}
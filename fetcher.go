@@ -0,0 +1,335 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/pkg/errors"
+	"github.com/valyala/fasthttp"
+)
+
+// errInvalidPiece is the cause of the error of a piece that has been read
+// but does not match its hash.
+var errInvalidPiece = errors.New("invalid hash")
+
+// missingFileError is the cause of the error of a piece whose file is missing
+// or shorter at the source, so the other pieces of the file cannot be read
+// either until the source is updated.
+type missingFileError struct {
+	path string
+	err  error
+}
+
+func (e *missingFileError) Error() string {
+	return e.err.Error()
+}
+
+// Fetcher downloads the content of an update.
+type Fetcher interface {
+	// Start starts downloading in background.
+	Start() error
+
+	// Progress returns the numbers of completed and missing bytes.
+	Progress() (int64, int64)
+
+	// Complete returns true if every piece has been downloaded and verified.
+	Complete() bool
+
+	// Stop stops downloading.
+	Stop()
+}
+
+// torrentFetcher downloads an update from the BitTorrent swarm. The torrent
+// is the storage of the other fetchers, and it verifies the pieces that they
+// write.
+type torrentFetcher struct {
+	client *torrent.Client
+	mi     *metainfo.MetaInfo
+	peers  []torrent.Peer
+	t      *torrent.Torrent
+
+	// wait defers downloading until it is closed, if it is not nil
+	wait <-chan struct{}
+}
+
+func newTorrentFetcher(client *torrent.Client, mi *metainfo.MetaInfo, peers []torrent.Peer) *torrentFetcher {
+	return &torrentFetcher{
+		client: client,
+		mi:     mi,
+		peers:  peers,
+	}
+}
+
+func (f *torrentFetcher) Start() error {
+	var err error
+	if f.t, err = f.client.AddTorrent(f.mi); err != nil {
+		return fmt.Errorf("failed adding torrent: %v", err)
+	}
+	f.t.AddPeers(f.peers)
+	go func() {
+		select {
+		case <-f.t.GotInfo():
+		case <-f.t.Closed():
+			return
+		}
+		if f.wait != nil {
+			select {
+			case <-f.wait:
+			case <-f.t.Closed():
+				return
+			}
+		}
+		f.t.DownloadAll()
+	}()
+	return nil
+}
+
+func (f *torrentFetcher) Progress() (int64, int64) {
+	return f.t.BytesCompleted(), f.t.BytesMissing()
+}
+
+func (f *torrentFetcher) Complete() bool {
+	return f.t.BytesMissing() == 0
+}
+
+func (f *torrentFetcher) Stop() {
+	f.t.Drop()
+	<-f.t.Closed()
+}
+
+// pieceSource reads the parts of pieces from the files of a torrent.
+type pieceSource interface {
+	readRange(info *metainfo.Info, r fileRange) ([]byte, error)
+	String() string
+}
+
+// readPiece reads given piece from a source, then verifies it against
+// the piece hash. The cause of the error is errInvalidPiece if the piece
+// has been read but its hash does not match, or a *missingFileError if
+// a file of the piece is missing or shorter at the source.
+func readPiece(src pieceSource, info *metainfo.Info, piece int) ([]byte, error) {
+	var buf bytes.Buffer
+	for _, r := range pieceRanges(info, piece) {
+		b, err := src.readRange(info, r)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed reading piece %d from %s", piece, src)
+		}
+		buf.Write(b)
+	}
+	if metainfo.Hash(sha1.Sum(buf.Bytes())) != info.Piece(piece).Hash() {
+		return nil, errors.Wrapf(errInvalidPiece, "piece %d from %s", piece, src)
+	}
+	return buf.Bytes(), nil
+}
+
+// httpSource reads files from an HTTP(S) server, whose URLs are resolved as
+// web seeds (BEP 19).
+type httpSource string
+
+func (src httpSource) readRange(info *metainfo.Info, r fileRange) ([]byte, error) {
+	req := fasthttp.AcquireRequest()
+	res := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseRequest(req)
+	defer fasthttp.ReleaseResponse(res)
+	req.SetRequestURI(webSeedURL(string(src), info, r.Path))
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", r.Offset, r.Offset+r.Length-1))
+	if err := fasthttp.DoTimeout(req, res, webSeedTimeout); err != nil {
+		return nil, err
+	}
+	body := res.Body()
+	err := fmt.Errorf("status code %d with %d bytes", res.StatusCode(), len(body))
+	switch {
+	case res.StatusCode() == 206 && int64(len(body)) == r.Length:
+		return append([]byte(nil), body...), nil
+	case res.StatusCode() == 200 && int64(len(body)) >= r.Offset+r.Length:
+		return append([]byte(nil), body[r.Offset:r.Offset+r.Length]...), nil
+	case res.StatusCode() == 200, res.StatusCode() == 404, res.StatusCode() == 416:
+		return nil, &missingFileError{path: filepath.Join(r.Path...), err: err}
+	}
+	return nil, err
+}
+
+func (src httpSource) String() string {
+	return string(src)
+}
+
+// dirSource reads files from a local or mounted directory, where the files
+// of a torrent are named after the torrent.
+type dirSource string
+
+func (src dirSource) readRange(info *metainfo.Info, r fileRange) ([]byte, error) {
+	filename := filepath.Join(append([]string{string(src), info.Name}, r.Path...)...)
+	f, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return nil, &missingFileError{path: filepath.Join(r.Path...), err: err}
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	b := make([]byte, r.Length)
+	if _, err = f.ReadAt(b, r.Offset); err != nil && err != io.EOF {
+		return nil, err
+	} else if err == io.EOF {
+		return nil, &missingFileError{
+			path: filepath.Join(r.Path...),
+			err:  fmt.Errorf("%s is shorter than %d bytes", filename, r.Offset+r.Length),
+		}
+	}
+	return b, nil
+}
+
+func (src dirSource) String() string {
+	return string(src)
+}
+
+// newPieceSource returns the source of given HTTP(S) URL, file URL or
+// directory.
+func newPieceSource(s string) (pieceSource, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "http", "https":
+		return httpSource(s), nil
+	case "file":
+		return dirSource(u.Path), nil
+	case "":
+		return dirSource(s), nil
+	}
+	return nil, fmt.Errorf("unsupported source '%s'", s)
+}
+
+// sourceFetcher downloads the pieces of a torrent from a source, then writes
+// them to the torrent's storage. It retries the missing pieces every
+// `interval` after waiting `delay`.
+type sourceFetcher struct {
+	src      pieceSource
+	t        *torrent.Torrent
+	delay    time.Duration
+	interval time.Duration
+	quit     chan struct{}
+	once     sync.Once
+}
+
+func newSourceFetcher(src pieceSource, t *torrent.Torrent, delay, interval time.Duration) *sourceFetcher {
+	return &sourceFetcher{
+		src:      src,
+		t:        t,
+		delay:    delay,
+		interval: interval,
+		quit:     make(chan struct{}),
+	}
+}
+
+func (f *sourceFetcher) Start() error {
+	go f.run()
+	return nil
+}
+
+func (f *sourceFetcher) run() {
+	wait := f.delay
+	for {
+		select {
+		case <-f.quit:
+			return
+		case <-f.t.Closed():
+			return
+		case <-time.After(wait):
+		}
+		wait = f.interval
+		if f.Complete() {
+			return
+		}
+		if n := f.fetch(); n > 0 {
+			log.Printf("sourceFetcher - downloaded %d pieces of %s from %s", n, f.t.Name(), f.src)
+		}
+	}
+}
+
+// fetch downloads the incomplete pieces, and returns the number of pieces
+// that have been written to the storage. The pieces of a file that is
+// missing or shorter at the source are skipped, while it stops at the first
+// piece that cannot be read otherwise, because the source is unavailable
+// until the next retry.
+func (f *sourceFetcher) fetch() int {
+	var (
+		info    = f.t.Info()
+		missing = make(map[string]bool)
+		n       = 0
+	)
+	for i := 0; i < f.t.NumPieces(); i++ {
+		select {
+		case <-f.quit:
+			return n
+		case <-f.t.Closed():
+			return n
+		default:
+		}
+		if f.t.PieceState(i).Complete || readsMissingFile(info, i, missing) {
+			continue
+		}
+		b, err := readPiece(f.src, info, i)
+		if mf, ok := errors.Cause(err).(*missingFileError); ok {
+			log.Printf("sourceFetcher - %v", err)
+			missing[mf.path] = true
+			continue
+		} else if errors.Cause(err) == errInvalidPiece {
+			log.Printf("sourceFetcher - %v", err)
+			continue
+		} else if err != nil {
+			log.Printf("sourceFetcher - %v", err)
+			return n
+		}
+		p := f.t.Piece(i)
+		if _, err = p.Storage().WriteAt(b, 0); err != nil {
+			log.Printf("sourceFetcher - failed writing piece %d of %s: %v", i, f.t.Name(), err)
+			return n
+		}
+		// the torrent verifies the piece again before marking it complete
+		p.VerifyData()
+		n++
+	}
+	return n
+}
+
+// readsMissingFile returns true if given piece has a part of a file in
+// `missing`.
+func readsMissingFile(info *metainfo.Info, piece int, missing map[string]bool) bool {
+	if len(missing) == 0 {
+		return false
+	}
+	for _, r := range pieceRanges(info, piece) {
+		if missing[filepath.Join(r.Path...)] {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *sourceFetcher) Progress() (int64, int64) {
+	return f.t.BytesCompleted(), f.t.BytesMissing()
+}
+
+func (f *sourceFetcher) Complete() bool {
+	return f.t.BytesMissing() == 0
+}
+
+func (f *sourceFetcher) Stop() {
+	f.once.Do(func() { close(f.quit) })
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/pkg/errors"
+	"github.com/valyala/fasthttp"
+)
+
+func TestReadPiece(t *testing.T) {
+	dir, err := ioutil.TempDir("", "webseed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "update")
+	data := make([]byte, 3*minPieceLength/2)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	if err = ioutil.WriteFile(filename, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	info := metainfo.Info{PieceLength: minPieceLength}
+	if err = info.BuildFromFilePath(filename); err != nil {
+		t.Fatal(err)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go fasthttp.Serve(ln, newWebSeedHandler(dir, len(pathData)-1, nil))
+	seed := fmt.Sprintf("http://%s%s", ln.Addr(), pathData)
+
+	for _, s := range []string{seed, "file://" + dir, dir} {
+		src, err := newPieceSource(s)
+		if err != nil {
+			t.Fatalf("failed creating source %s: %v", s, err)
+		}
+		b, err := readPiece(src, &info, 1)
+		if err != nil {
+			t.Errorf("failed reading piece: %v", err)
+		} else if len(b) != minPieceLength/2 || b[0] != data[minPieceLength] {
+			t.Errorf("piece 1 from %s: got %d bytes", s, len(b))
+		}
+	}
+	if _, err = readPiece(httpSource(seed+"missing/"), &info, 1); err == nil {
+		t.Errorf("a missing file should fail to be read")
+	} else if _, ok := errors.Cause(err).(*missingFileError); !ok {
+		t.Errorf("a missing file should be reported as missing, got %v", err)
+	}
+	if _, err = newPieceSource("ftp://a/b"); err == nil {
+		t.Errorf("an unsupported scheme should fail")
+	}
+
+	info.Pieces[0] ^= 0xff
+	if _, err = readPiece(dirSource(dir), &info, 0); errors.Cause(err) != errInvalidPiece {
+		t.Errorf("a piece with an invalid hash should be rejected, got %v", err)
+	}
+}
+
+func TestSourceFetcher(t *testing.T) {
+	src, err := ioutil.TempDir("", "source")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(src)
+	dest, err := ioutil.TempDir("", "dest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dest)
+	filename := filepath.Join(src, "update")
+	if err = ioutil.WriteFile(filename, make([]byte, 2*minPieceLength+1), 0644); err != nil {
+		t.Fatal(err)
+	}
+	n := Notification{Info: metainfo.Info{PieceLength: minPieceLength}}
+	if err = n.Info.BuildFromFilePath(filename); err != nil {
+		t.Fatal(err)
+	}
+	mi, err := n.torrentMetainfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := torrent.NewClient(&torrent.Config{
+		DataDir:         dest,
+		NoDHT:           true,
+		DisableTrackers: true,
+		DisableIPv6:     true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	tf := newTorrentFetcher(client, mi, nil)
+	if err = tf.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer tf.Stop()
+	sf := newSourceFetcher(dirSource(src), tf.t, 0, time.Second)
+	sf.Start()
+	defer sf.Stop()
+
+	for i := 0; !tf.Complete(); i++ {
+		if i > 50 {
+			completed, missing := sf.Progress()
+			t.Fatalf("fetcher has not completed: %d completed, %d missing", completed, missing)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if b, err := ioutil.ReadFile(filepath.Join(dest, "update")); err != nil || len(b) != 2*minPieceLength+1 {
+		t.Errorf("downloaded file: got %d bytes, %v", len(b), err)
+	}
+}
+
+func TestSourceFetcherMissingFile(t *testing.T) {
+	src, err := ioutil.TempDir("", "source")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(src)
+	dest, err := ioutil.TempDir("", "dest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dest)
+	dir := filepath.Join(src, "update")
+	if err = os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a", "b"} {
+		if err = ioutil.WriteFile(filepath.Join(dir, name), make([]byte, minPieceLength), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	n := Notification{Info: metainfo.Info{PieceLength: minPieceLength}}
+	if err = n.Info.BuildFromFilePath(dir); err != nil {
+		t.Fatal(err)
+	}
+	mi, err := n.torrentMetainfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the first file is missing at the source
+	if err = os.Remove(filepath.Join(dir, "a")); err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := torrent.NewClient(&torrent.Config{
+		DataDir:         dest,
+		NoDHT:           true,
+		DisableTrackers: true,
+		DisableIPv6:     true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	tf := newTorrentFetcher(client, mi, nil)
+	if err = tf.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer tf.Stop()
+	<-tf.t.GotInfo()
+
+	sf := newSourceFetcher(dirSource(src), tf.t, 0, time.Second)
+	if n := sf.fetch(); n != 1 {
+		t.Errorf("fetched pieces: got %d, expected the piece of the second file", n)
+	}
+}
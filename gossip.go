@@ -0,0 +1,302 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/rand"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/zeebo/bencode"
+)
+
+const gossipIDSize = 16
+
+// topicGossip is the overlay topic of gossip messages.
+const topicGossip = "gossip"
+
+// Kinds of gossip messages.
+const (
+	gossipNotification = ""
+	gossipDigest       = "digest"
+	gossipCompact      = "compact"
+)
+
+// GossipStats holds the counters of gossip messages.
+type GossipStats struct {
+	Sent       uint64 `json:"sent"`
+	Received   uint64 `json:"received"`
+	Forwarded  uint64 `json:"forwarded"`
+	Duplicates uint64 `json:"duplicates"`
+	Expired    uint64 `json:"expired"`
+	Invalid    uint64 `json:"invalid"`
+}
+
+// gossipMessage is the envelope of every message gossiped over the overlay.
+// A message whose TTL is zero is a direct message that is never forwarded.
+type gossipMessage struct {
+	ID   []byte `bencode:"id"`
+	Kind string `bencode:"kind,omitempty"`
+	TTL  int    `bencode:"ttl"`
+	Data []byte `bencode:"data"`
+}
+
+// newGossipMessage returns an encoded gossip message of given kind and data
+// with a random ID.
+func newGossipMessage(kind string, data []byte, ttl int) (*gossipMessage, []byte, error) {
+	m := gossipMessage{
+		ID:   make([]byte, gossipIDSize),
+		Kind: kind,
+		TTL:  ttl,
+		Data: data,
+	}
+	if _, err := rand.Read(m.ID); err != nil {
+		return nil, nil, errors.Wrap(err, "failed generating gossip ID")
+	}
+	b, err := bencode.EncodeBytes(m)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed encoding gossip message")
+	}
+	return &m, b, nil
+}
+
+// gossipCache holds the IDs of messages that have been seen.
+type gossipCache struct {
+	sync.Mutex
+	size     int
+	lifespan time.Duration
+	entries  map[string]time.Time
+}
+
+func newGossipCache(size int, lifespan time.Duration) *gossipCache {
+	return &gossipCache{
+		size:     size,
+		lifespan: lifespan,
+		entries:  make(map[string]time.Time),
+	}
+}
+
+// add adds given ID into the cache. It returns false if the ID has been seen.
+func (c *gossipCache) add(id []byte) bool {
+	c.Lock()
+	defer c.Unlock()
+
+	now := time.Now()
+	if expired, ok := c.entries[string(id)]; ok && now.Before(expired) {
+		return false
+	}
+	if len(c.entries) >= c.size {
+		for k, expired := range c.entries {
+			if now.After(expired) {
+				delete(c.entries, k)
+			}
+		}
+		// evict arbitrary entries if the cache is still full
+		for k := range c.entries {
+			if len(c.entries) < c.size {
+				break
+			}
+			delete(c.entries, k)
+		}
+	}
+	c.entries[string(id)] = now.Add(c.lifespan)
+	return true
+}
+
+// remove removes given ID from the cache.
+func (c *gossipCache) remove(id []byte) {
+	c.Lock()
+	defer c.Unlock()
+	delete(c.entries, string(id))
+}
+
+// gossipMessageFrom is a gossip message and the ID of the peer who sent it.
+type gossipMessageFrom struct {
+	msg *gossipMessage
+	pid PeerID
+}
+
+// Gossip is an epidemic protocol on top of OverlayConn. Every message is sent
+// to a random subset of peers (fanout), which forward it to their own random
+// subsets until its TTL reaches zero. Each peer forwards a message at most once.
+type Gossip struct {
+	overlay  *OverlayConn
+	seen     *gossipCache
+	stats    GossipStats
+	received chan gossipMessageFrom
+}
+
+// NewGossip creates a Gossip instance on top of given overlay, which handles
+// the messages of topic `topicGossip`.
+func NewGossip(overlay *OverlayConn) *Gossip {
+	g := &Gossip{
+		overlay: overlay,
+		seen: newGossipCache(overlay.Config.GossipCacheSize,
+			overlay.Config.GossipCacheLifespan*time.Second),
+		received: make(chan gossipMessageFrom, topicBufferSize),
+	}
+	if err := overlay.Subscribe(topicGossip, g.receive); err != nil {
+		log.Printf("gossip - failed subscribing topic '%s': %v", topicGossip, err)
+	}
+	return g
+}
+
+// Ready returns true if the underlying overlay is ready.
+func (g *Gossip) Ready() bool {
+	return g != nil && g.overlay.Ready()
+}
+
+// Write gossips given data to other peers.
+func (g *Gossip) Write(b []byte) (int, error) {
+	return g.WriteKind(gossipNotification, b)
+}
+
+// WriteKind is like Write, but the message is of given kind.
+func (g *Gossip) WriteKind(kind string, b []byte) (int, error) {
+	if g == nil {
+		return 0, errNotReady
+	}
+	m, data, err := newGossipMessage(kind, b, g.overlay.Config.GossipTTL)
+	if err != nil {
+		return 0, err
+	}
+	g.seen.add(m.ID)
+	pids := g.overlay.RandomPeers(g.overlay.Config.GossipFanout)
+	if _, err = g.overlay.WriteTopicTo(topicGossip, data, pids); err != nil {
+		return 0, err
+	}
+	atomic.AddUint64(&g.stats.Sent, 1)
+	return len(b), nil
+}
+
+// Deliver gossips given data like Write, but the peers of the fanout have to
+// acknowledge it. `done` is called once for each of them with the result.
+func (g *Gossip) Deliver(b []byte, done func(PeerID, error)) error {
+	return g.DeliverKind(gossipNotification, b, done)
+}
+
+// DeliverKind is like Deliver, but the message is of given kind.
+func (g *Gossip) DeliverKind(kind string, b []byte, done func(PeerID, error)) error {
+	if g == nil {
+		return errNotReady
+	}
+	m, data, err := newGossipMessage(kind, b, g.overlay.Config.GossipTTL)
+	if err != nil {
+		return err
+	}
+	g.seen.add(m.ID)
+	pids := g.overlay.RandomPeers(g.overlay.Config.GossipFanout)
+	if _, err = g.overlay.DeliverTopicTo(topicGossip, data, pids, done); err != nil {
+		return err
+	}
+	atomic.AddUint64(&g.stats.Sent, 1)
+	return nil
+}
+
+// WriteMsgTo sends a direct message of given kind to a peer.
+func (g *Gossip) WriteMsgTo(kind string, b []byte, pid PeerID) error {
+	if g == nil {
+		return errNotReady
+	}
+	m, data, err := newGossipMessage(kind, b, 0)
+	if err != nil {
+		return err
+	}
+	g.seen.add(m.ID)
+	if _, err = g.overlay.WriteTopicTo(topicGossip, data, []PeerID{pid}); err != nil {
+		return err
+	}
+	atomic.AddUint64(&g.stats.Sent, 1)
+	return nil
+}
+
+// ReadMsg returns the data of the next gossip message.
+func (g *Gossip) ReadMsg() ([]byte, error) {
+	m, _, err := g.ReadMsgFrom()
+	if err != nil {
+		return nil, err
+	}
+	return m.Data, nil
+}
+
+// ReadMsgFrom returns the next gossip message that has not been seen before,
+// and the ID of the peer who sent it.
+func (g *Gossip) ReadMsgFrom() (*gossipMessage, PeerID, error) {
+	if !g.Ready() {
+		return nil, PeerID{}, errNotReady
+	}
+	m := <-g.received
+	return m.msg, m.pid, nil
+}
+
+// receive handles a message of topic `topicGossip`. The message is not
+// forwarded until the reader has verified it (see Forward), and its TTL is
+// capped to ours. It blocks while the received messages have not been read,
+// so the overlay holds back the topic.
+func (g *Gossip) receive(sender PeerID, b []byte) {
+	atomic.AddUint64(&g.stats.Received, 1)
+
+	var m gossipMessage
+	if err := bencode.DecodeBytes(b, &m); err != nil || len(m.ID) == 0 {
+		atomic.AddUint64(&g.stats.Invalid, 1)
+		log.Printf("gossip - %s sent an invalid message: %v", sender, err)
+		return
+	}
+	if !g.seen.add(m.ID) {
+		atomic.AddUint64(&g.stats.Duplicates, 1)
+		return
+	}
+	if m.TTL > g.overlay.Config.GossipTTL {
+		m.TTL = g.overlay.Config.GossipTTL
+	}
+	g.received <- gossipMessageFrom{msg: &m, pid: sender}
+}
+
+// Forward forwards given message, which has been received from sender, to
+// other peers if its TTL has not expired. The reader calls it once the data
+// has been verified, so that invalid messages are not spread. Digests are
+// never forwarded.
+func (g *Gossip) Forward(m *gossipMessage, sender PeerID) {
+	if g == nil || m.Kind == gossipDigest {
+		return
+	}
+	switch {
+	case m.TTL > 1:
+		fwd := *m
+		fwd.TTL--
+		g.forward(&fwd, sender)
+	case m.TTL == 1:
+		atomic.AddUint64(&g.stats.Expired, 1)
+	}
+}
+
+func (g *Gossip) forward(m *gossipMessage, sender PeerID) {
+	b, err := bencode.EncodeBytes(m)
+	if err != nil {
+		log.Printf("gossip - failed encoding message: %v", err)
+		return
+	}
+	pids := g.overlay.RandomPeers(g.overlay.Config.GossipFanout, sender)
+	if _, err = g.overlay.WriteTopicTo(topicGossip, b, pids); err != nil {
+		log.Printf("gossip - failed forwarding message: %v", err)
+		return
+	}
+	atomic.AddUint64(&g.stats.Forwarded, 1)
+}
+
+// Stats returns the counters of gossip messages.
+func (g *Gossip) Stats() GossipStats {
+	return GossipStats{
+		Sent:       atomic.LoadUint64(&g.stats.Sent),
+		Received:   atomic.LoadUint64(&g.stats.Received),
+		Forwarded:  atomic.LoadUint64(&g.stats.Forwarded),
+		Duplicates: atomic.LoadUint64(&g.stats.Duplicates),
+		Expired:    atomic.LoadUint64(&g.stats.Expired),
+		Invalid:    atomic.LoadUint64(&g.stats.Invalid),
+	}
+}
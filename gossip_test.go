@@ -0,0 +1,72 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/zeebo/bencode"
+)
+
+func TestGossipCache(t *testing.T) {
+	c := newGossipCache(2, time.Minute)
+	if !c.add([]byte("a")) {
+		t.Errorf("a should not have been seen")
+	}
+	if c.add([]byte("a")) {
+		t.Errorf("a should have been seen")
+	}
+	c.add([]byte("b"))
+	c.add([]byte("c"))
+	if len(c.entries) > 2 {
+		t.Errorf("cache size: got %d, expected at most 2", len(c.entries))
+	}
+
+	c = newGossipCache(2, 0)
+	c.add([]byte("a"))
+	if !c.add([]byte("a")) {
+		t.Errorf("a should have expired")
+	}
+}
+
+func TestGossipMessage(t *testing.T) {
+	m, b, err := newGossipMessage(gossipDigest, []byte("hello"), 3)
+	if err != nil {
+		t.Fatalf("failed creating gossip message: %v", err)
+	}
+
+	var mm gossipMessage
+	if err = bencode.DecodeBytes(b, &mm); err != nil {
+		t.Fatalf("failed decoding gossip message: %v", err)
+	}
+	if string(mm.ID) != string(m.ID) || mm.Kind != gossipDigest || mm.TTL != 3 || string(mm.Data) != "hello" {
+		t.Errorf("got %+v, expected %+v", mm, *m)
+	}
+}
+
+func TestGossipReceive(t *testing.T) {
+	overlay := newTestOverlay(OverlayConfig{GossipTTL: 4})
+	g := &Gossip{
+		overlay:  overlay,
+		seen:     newGossipCache(8, time.Minute),
+		received: make(chan gossipMessageFrom, 1),
+	}
+
+	_, b, err := newGossipMessage(gossipNotification, []byte("hello"), 100)
+	if err != nil {
+		t.Fatalf("failed creating gossip message: %v", err)
+	}
+	g.receive(PeerID{2}, b)
+	m := <-g.received
+	if m.msg.TTL != 4 {
+		t.Errorf("TTL: got %d, expected 4", m.msg.TTL)
+	}
+	if stats := g.Stats(); stats.Forwarded != 0 {
+		t.Errorf("a message should not be forwarded before being verified")
+	}
+
+	g.Forward(&gossipMessage{ID: []byte("digest"), Kind: gossipDigest, TTL: 4}, PeerID{2})
+	g.Forward(&gossipMessage{ID: []byte("expired"), TTL: 1}, PeerID{2})
+	if stats := g.Stats(); stats.Forwarded != 0 || stats.Expired != 1 {
+		t.Errorf("stats: got %+v, expected 0 forwarded and 1 expired", stats)
+	}
+}
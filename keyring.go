@@ -0,0 +1,276 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const (
+	// signatureKeySeparator separates the name of a signature and the ID of
+	// its key in the Signatures map, e.g. "org.fruit-testbed/0123456789abcdef".
+	// A signature without a key ID can be verified by any trusted key.
+	signatureKeySeparator = "/"
+
+	// keyringFileExt is the extension of public key files in a keyring
+	// directory
+	keyringFileExt = ".pub"
+)
+
+// KeyringConfig holds the trusted public keys of a cluster or a server, in
+// addition to its `PublicKey`.
+type KeyringConfig struct {
+	Keys []Key `json:"keys,omitempty"`
+
+	// Directory has public key files with extension `.pub`
+	Directory string `json:"directory,omitempty"`
+
+	// Threshold is the minimum number of distinct trusted keys that must
+	// sign a notification (default: 1)
+	Threshold int `json:"threshold,omitempty"`
+
+	// RejectLegacy rejects the signatures over JSON payloads, which
+	// notifications of older versions have
+	RejectLegacy bool `json:"reject-legacy,omitempty"`
+
+	// CertificateAuthorities are the PEM files or inline PEM of CA roots,
+	// which trust the keys whose certificate chains are in the signatures
+	CertificateAuthorities []Key `json:"certificate-authorities,omitempty"`
+
+	// RootKeys sign the keyring notifications, which add and revoke keys.
+	// At least `RootThreshold` distinct root keys must sign them (default: 1).
+	RootKeys      []Key `json:"root-keys,omitempty"`
+	RootThreshold int   `json:"root-threshold,omitempty"`
+}
+
+// Keyring is a set of trusted public keys and CA roots. A notification is
+// accepted only if at least `Threshold` distinct keys of the keyring, or keys
+// that are certified by the roots, have signed it.
+type Keyring struct {
+	sync.RWMutex
+	Keys         map[string]crypto.PublicKey
+	Roots        *x509.CertPool
+	Threshold    int
+	RejectLegacy bool
+
+	// Root verifies the keyring notifications, or it is nil if they are
+	// not accepted
+	Root *Keyring
+	// Version is the version of the applied keyring notification
+	Version uint64
+
+	// configured keys and threshold, which keyring notifications change
+	configured map[string]crypto.PublicKey
+	threshold  int
+	// revoked has the IDs of the keys that are revoked
+	revoked map[string]struct{}
+}
+
+// keyID returns the ID of given public key, which is the hex of the first
+// 8 bytes of the SHA-256 hash of its PKIX form.
+func keyID(pub crypto.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.Sum256(der)
+	return hex.EncodeToString(h[:8]), nil
+}
+
+// load returns the public key of the inline value if it is not empty,
+// otherwise the public key in the file.
+func (k Key) load() (crypto.PublicKey, error) {
+	if len(k.Value) > 0 {
+		pub, err := parsePublicKey([]byte(k.Value))
+		if err != nil {
+			return nil, fmt.Errorf("failed parsing inline public key: %v", err)
+		}
+		return pub, nil
+	}
+	return LoadPublicKey(k.Filename)
+}
+
+func (k Key) isEmpty() bool {
+	return len(k.Filename) == 0 && len(k.Value) == 0
+}
+
+// NewKeyring returns a keyring of given public keys and CA roots, where
+// the same key is counted once. `roots` can be nil.
+func NewKeyring(keys []crypto.PublicKey, roots *x509.CertPool, threshold int) (*Keyring, error) {
+	kr := Keyring{
+		Keys:      make(map[string]crypto.PublicKey),
+		Roots:     roots,
+		Threshold: threshold,
+	}
+	for _, pub := range keys {
+		if _, err := keyAlgorithm(pub); err != nil {
+			return nil, err
+		}
+		id, err := keyID(pub)
+		if err != nil {
+			return nil, err
+		}
+		kr.Keys[id] = pub
+	}
+	if kr.Threshold <= 0 {
+		kr.Threshold = 1
+	}
+	if err := kr.check(kr.Keys, kr.Threshold); err != nil {
+		return nil, err
+	}
+	kr.configured, kr.threshold = kr.Keys, kr.Threshold
+	return &kr, nil
+}
+
+// check returns an error if given keys cannot reach given threshold.
+func (kr *Keyring) check(keys map[string]crypto.PublicKey, threshold int) error {
+	if len(keys) == 0 && kr.Roots == nil {
+		return fmt.Errorf("keyring has no keys")
+	} else if threshold > len(keys) && kr.Roots == nil {
+		return fmt.Errorf("keyring threshold %d is greater than the number of keys %d",
+			threshold, len(keys))
+	}
+	return nil
+}
+
+// loadKeys returns the public keys of given keys.
+func loadKeys(keys []Key) ([]crypto.PublicKey, error) {
+	pubs := make([]crypto.PublicKey, 0, len(keys))
+	for _, k := range keys {
+		pub, err := k.load()
+		if err != nil {
+			return nil, err
+		}
+		pubs = append(pubs, pub)
+	}
+	return pubs, nil
+}
+
+// loadKeyring returns the keyring of given primary key, which is ignored if
+// it is empty, and the keys of given keyring configuration.
+func loadKeyring(primary Key, cfg KeyringConfig) (*Keyring, error) {
+	var keys []crypto.PublicKey
+	if !primary.isEmpty() {
+		pub, err := primary.load()
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, pub)
+	}
+	pubs, err := loadKeys(cfg.Keys)
+	if err != nil {
+		return nil, err
+	}
+	keys = append(keys, pubs...)
+	if len(cfg.Directory) > 0 {
+		files, err := ioutil.ReadDir(cfg.Directory)
+		if err != nil {
+			return nil, fmt.Errorf("failed reading keyring directory: %v", err)
+		}
+		for _, fi := range files {
+			if fi.IsDir() || !strings.HasSuffix(fi.Name(), keyringFileExt) {
+				continue
+			}
+			pub, err := LoadPublicKey(filepath.Join(cfg.Directory, fi.Name()))
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, pub)
+		}
+	}
+	roots, err := loadCertPool(cfg.CertificateAuthorities)
+	if err != nil {
+		return nil, err
+	}
+	kr, err := NewKeyring(keys, roots, cfg.Threshold)
+	if err != nil {
+		return nil, err
+	}
+	kr.RejectLegacy = cfg.RejectLegacy
+	if len(cfg.RootKeys) > 0 {
+		if pubs, err = loadKeys(cfg.RootKeys); err != nil {
+			return nil, err
+		}
+		if kr.Root, err = NewKeyring(pubs, nil, cfg.RootThreshold); err != nil {
+			return nil, fmt.Errorf("invalid root keys: %v", err)
+		}
+		kr.Root.RejectLegacy = true
+	}
+	return kr, nil
+}
+
+// hasSignature returns true if given signatures have a signature of given
+// name, with or without a key ID.
+func hasSignature(sigs map[string]Signature, name string) bool {
+	for n := range sigs {
+		if n == name || strings.HasPrefix(n, name+signatureKeySeparator) {
+			return true
+		}
+	}
+	return false
+}
+
+// verify verifies the signatures of given name, where `hashed` returns
+// the SHA-256 hash of the signed payload in a signature format. It returns
+// an error if less than `Threshold` distinct trusted keys have signed it.
+func (kr *Keyring) verify(sigs map[string]Signature, name string, hashed func(int) ([]byte, error)) error {
+	kr.RLock()
+	defer kr.RUnlock()
+	signed := make(map[string]struct{})
+	hashes := make(map[int][]byte)
+	for n, s := range sigs {
+		var id string
+		if n != name {
+			if !strings.HasPrefix(n, name+signatureKeySeparator) {
+				continue
+			}
+			id = n[len(name)+len(signatureKeySeparator):]
+		}
+		if s.Format == signatureFormatJSON && kr.RejectLegacy {
+			continue
+		}
+		h, ok := hashes[s.Format]
+		if !ok {
+			var err error
+			if h, err = hashed(s.Format); err != nil {
+				continue
+			}
+			hashes[s.Format] = h
+		}
+		if len(s.Certificate) > 0 && kr.Roots != nil {
+			// the key of a certified signature is counted once, whether it
+			// is in the keyring or not
+			if pub, err := kr.verifyChain(s.Certificate); err == nil {
+				kid, err := keyID(pub)
+				_, revoked := kr.revoked[kid]
+				if err == nil && !revoked && (len(id) == 0 || id == kid) && verifyHashed(pub, h, s) == nil {
+					signed[kid] = struct{}{}
+					continue
+				}
+			}
+		}
+		for kid, pub := range kr.Keys {
+			if _, ok := signed[kid]; ok || (len(id) > 0 && id != kid) {
+				continue
+			}
+			if verifyHashed(pub, h, s) == nil {
+				signed[kid] = struct{}{}
+				break
+			}
+		}
+	}
+	if len(signed) < kr.Threshold {
+		return fmt.Errorf("signed by %d trusted keys, %d required", len(signed), kr.Threshold)
+	}
+	return nil
+}
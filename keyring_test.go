@@ -0,0 +1,104 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newTestKeyring(t *testing.T, threshold int, keys ...crypto.PublicKey) *Keyring {
+	kr, err := NewKeyring(keys, nil, threshold)
+	if err != nil {
+		t.Fatalf("failed creating keyring: %v", err)
+	}
+	return kr
+}
+
+func TestKeyringThreshold(t *testing.T) {
+	var (
+		pubs []crypto.PublicKey
+		keys []ed25519.PrivateKey
+	)
+	for i := 0; i < 3; i++ {
+		pub, key, _ := ed25519.GenerateKey(rand.Reader)
+		pubs, keys = append(pubs, pub), append(keys, key)
+	}
+	_, untrusted, _ := ed25519.GenerateKey(rand.Reader)
+	kr := newTestKeyring(t, 2, pubs...)
+
+	n := newTestNotification(t, keys[0])
+	if err := n.Verify(kr); err == nil {
+		t.Errorf("a notification with 1 of 2 signatures should not be verified")
+	}
+	// the same key and an untrusted key do not count
+	n.CoSign(keys[0])
+	n.CoSign(untrusted)
+	if err := n.Verify(kr); err == nil {
+		t.Errorf("a notification with 1 distinct trusted signature should not be verified")
+	}
+	if err := n.CoSign(keys[2]); err != nil {
+		t.Fatal(err)
+	}
+	if err := n.Verify(kr); err != nil {
+		t.Errorf("failed verifying a notification with 2 of 2 signatures: %v", err)
+	}
+	cn, err := n.compact()
+	if err != nil {
+		t.Fatal(err)
+	} else if err = cn.Verify(kr); err != nil {
+		t.Errorf("failed verifying a compact notification with 2 of 2 signatures: %v", err)
+	}
+
+	// a signature that is named after another key is not verified
+	id0, _ := keyID(pubs[0])
+	id1, _ := keyID(pubs[1])
+	n.Signatures[signatureName+signatureKeySeparator+id1] = n.Signatures[signatureName]
+	delete(n.Signatures, signatureName)
+	delete(n.Signatures, signatureName+signatureKeySeparator+id0)
+	if err := n.Verify(kr); err == nil {
+		t.Errorf("a signature named after another key should not be verified")
+	}
+
+	if _, err := NewKeyring(append(pubs, pubs[0]), nil, 4); err == nil {
+		t.Errorf("a threshold greater than the number of distinct keys should be rejected")
+	}
+}
+
+func TestLoadKeyring(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keyring")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var values []string
+	for i := 0; i < 3; i++ {
+		pub, _, _ := ed25519.GenerateKey(rand.Reader)
+		der, _ := x509.MarshalPKIXPublicKey(pub)
+		values = append(values, string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})))
+	}
+	ioutil.WriteFile(filepath.Join(dir, "a.pub"), []byte(values[0]), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "b.pub"), []byte(values[1]), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "README"), []byte("not a key"), 0644)
+
+	kr, err := loadKeyring(Key{Value: values[2]}, KeyringConfig{
+		Keys:      []Key{{Filename: filepath.Join(dir, "a.pub")}},
+		Directory: dir,
+		Threshold: 3,
+	})
+	if err != nil {
+		t.Fatalf("failed loading keyring: %v", err)
+	}
+	if len(kr.Keys) != 3 || kr.Threshold != 3 {
+		t.Errorf("keyring: got %d keys with threshold %d", len(kr.Keys), kr.Threshold)
+	}
+	if _, err = loadKeyring(Key{}, KeyringConfig{}); err == nil {
+		t.Errorf("an empty keyring should be rejected")
+	}
+}
@@ -0,0 +1,205 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"time"
+
+	"github.com/zeebo/bencode"
+)
+
+// KeyringChange is the change of trusted keys of a keyring notification,
+// which is signed by the root keys. The change is relative to the configured
+// keyring, so a newer keyring notification replaces the change of an older
+// one.
+type KeyringChange struct {
+	// Add has the PEM or OpenSSH public keys that are trusted
+	Add []string `bencode:"add,omitempty"`
+	// Revoke has the IDs of the keys that are no longer trusted, including
+	// the keys that are certified by the CA roots
+	Revoke []string `bencode:"revoke,omitempty"`
+	// Threshold replaces the configured threshold if it is positive
+	Threshold int `bencode:"threshold,omitempty"`
+}
+
+// NewKeyringChange returns the change that adds the public keys in given
+// files and revokes the keys of given IDs.
+func NewKeyringChange(addFiles, revoke []string, threshold int) (*KeyringChange, error) {
+	kc := KeyringChange{
+		Revoke:    revoke,
+		Threshold: threshold,
+	}
+	for _, filename := range addFiles {
+		pub, err := LoadPublicKey(filename)
+		if err != nil {
+			return nil, err
+		}
+		der, err := x509.MarshalPKIXPublicKey(pub)
+		if err != nil {
+			return nil, err
+		}
+		kc.Add = append(kc.Add, string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})))
+	}
+	return &kc, nil
+}
+
+// writeFile writes the bencoded change to a new file in the temporary
+// directory, which is the payload of the keyring notification. It returns
+// the filename.
+func (kc *KeyringChange) writeFile() (string, error) {
+	b, err := bencode.EncodeBytes(kc)
+	if err != nil {
+		return "", err
+	}
+	f, err := ioutil.TempFile("", "keyring-")
+	if err != nil {
+		return "", err
+	}
+	if err = f.Chmod(0644); err == nil {
+		_, err = f.Write(b)
+	}
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// verifyKeyringChange verifies that the Notification is a keyring
+// notification signed by the root keys of given keyring. Only the full
+// signatures are accepted, because the compact ones do not cover the change.
+func (mi *Notification) verifyKeyringChange(kr *Keyring) error {
+	if mi.UUID != UUIDKeyring || mi.Keyring == nil {
+		return fmt.Errorf("notification uuid:%s is not a keyring notification", mi.UUID)
+	}
+	if kr.Root == nil {
+		return fmt.Errorf("keyring notifications are not accepted without root keys")
+	}
+	return kr.Root.verify(mi.Signatures, signatureName, mi.hashed)
+}
+
+// applyChange applies the change of given keyring notification to
+// the configured keys and threshold. It returns true if the keyring has
+// changed, or false if the notification has been applied before.
+func (kr *Keyring) applyChange(n *Notification) (bool, error) {
+	if err := n.verifyKeyringChange(kr); err != nil {
+		return false, err
+	}
+	keys := make(map[string]crypto.PublicKey)
+	for id, pub := range kr.configured {
+		keys[id] = pub
+	}
+	for _, s := range n.Keyring.Add {
+		pub, err := parsePublicKey([]byte(s))
+		if err != nil {
+			return false, fmt.Errorf("invalid key in keyring change: %v", err)
+		}
+		id, err := keyID(pub)
+		if err != nil {
+			return false, err
+		}
+		keys[id] = pub
+	}
+	revoked := make(map[string]struct{})
+	for _, id := range n.Keyring.Revoke {
+		revoked[id] = struct{}{}
+		delete(keys, id)
+	}
+	threshold := kr.threshold
+	if n.Keyring.Threshold > 0 {
+		threshold = n.Keyring.Threshold
+	}
+	if err := kr.check(keys, threshold); err != nil {
+		return false, err
+	}
+
+	kr.Lock()
+	defer kr.Unlock()
+	if n.Version < kr.Version {
+		return false, fmt.Errorf("keyring version %d is older than the applied version %d",
+			n.Version, kr.Version)
+	} else if n.Version == kr.Version {
+		return false, nil
+	}
+	kr.Keys, kr.Threshold, kr.revoked, kr.Version = keys, threshold, revoked, n.Version
+	return true, nil
+}
+
+// applyKeyring applies given keyring notification to the cluster's keyring,
+// then removes the updates that are no longer trusted.
+func (c *Cluster) applyKeyring(n *Notification) {
+	applied, err := c.Keyring.applyChange(n)
+	if err != nil {
+		log.Printf("applyKeyring[%s] - failed applying keyring version:%d - %v", c.Name, n.Version, err)
+		return
+	} else if !applied {
+		return
+	}
+	log.Printf("applyKeyring[%s] - applied keyring version:%d", c.Name, n.Version)
+	go c.reverifyUpdates()
+}
+
+// reverifyUpdates stops and deletes the updates whose signatures are not
+// trusted by the cluster's keyring anymore.
+func (c *Cluster) reverifyUpdates() {
+	a := c.agent
+	for _, uuid := range a.getUpdateUUIDs(c) {
+		u := a.getUpdate(c, uuid)
+		if u == nil || uuid == UUIDKeyring || u.Verify(a) == nil {
+			continue
+		}
+		log.Printf("WARNING: update uuid:%s version:%d is not trusted by the keyring anymore",
+			uuid, u.Notification.Version)
+		a.Lock()
+		if c.updates[uuid] != u {
+			// the update has been replaced by a newer version
+			a.Unlock()
+			continue
+		}
+		delete(c.updates, uuid)
+		a.Unlock()
+		u.Stop()
+		if err := u.Delete(); err != nil {
+			log.Printf("WARNING: failed to delete update uuid:%s version:%d - %v",
+				uuid, u.Notification.Version, err)
+		}
+	}
+}
+
+// applyKeyring applies given keyring notification to the server's keyring,
+// then drops the notifications that are no longer trusted. The caller must
+// hold the lock.
+func (s *Server) applyKeyring(n *Notification) error {
+	applied, err := s.keyring.applyChange(n)
+	if err == nil && applied {
+		log.Printf("applied keyring version:%d", n.Version)
+		s.dropUntrustedUpdates()
+	}
+	return err
+}
+
+// dropUntrustedUpdates removes the notifications whose signatures are not
+// trusted by the server's keyring. The caller must hold the lock.
+func (s *Server) dropUntrustedUpdates() {
+	for uuid, n := range s.updates {
+		if err := n.Verify(s.keyring); err != nil {
+			log.Printf("WARNING: dropped notification uuid:%s version:%d - %v", uuid, n.Version, err)
+			delete(s.updates, uuid)
+			delete(s.revisions, uuid)
+			s.indexInfoHash(uuid)
+			s.lastModified = time.Now()
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestKeyringNotification(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keyring")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rootPub, root, _ := ed25519.GenerateKey(rand.Reader)
+	oldPub, oldKey, _ := ed25519.GenerateKey(rand.Reader)
+	newPub, newKey, _ := ed25519.GenerateKey(rand.Reader)
+	oldID, _ := keyID(oldPub)
+	der, err := x509.MarshalPKIXPublicKey(newPub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.WriteFile(filepath.Join(dir, "new.pub"), pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0644)
+
+	kr := newTestKeyring(t, 1, oldPub)
+	kr.Root = newTestKeyring(t, 1, rootPub)
+
+	// newKeyringNotification returns a keyring notification that adds
+	// the new key and revokes the old key
+	newKeyringNotification := func(ver uint64, threshold int, key ed25519.PrivateKey) *Notification {
+		kc, err := NewKeyringChange([]string{filepath.Join(dir, "new.pub")}, []string{oldID}, threshold)
+		if err != nil {
+			t.Fatalf("failed creating keyring change: %v", err)
+		}
+		filename, err := kc.writeFile()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(filename)
+		n, err := NewNotification(filename, UUIDKeyring, ver, [][]string{{"http://localhost/announce"}},
+			nil, nil, minPieceLength, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n.Keyring = kc
+		if err = n.Sign(key); err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+
+	oldUpdate, newUpdate := newTestNotification(t, oldKey), newTestNotification(t, newKey)
+	if err = oldUpdate.Verify(kr); err != nil {
+		t.Fatalf("failed verifying update of the old key: %v", err)
+	}
+
+	// only the full signatures of the root keys are accepted
+	if _, err = kr.applyChange(newKeyringNotification(2, 0, oldKey)); err == nil {
+		t.Errorf("a keyring notification of a non-root key should not be applied")
+	}
+	n := newKeyringNotification(2, 0, root)
+	if kind, _, _ := n.gossipData(true); kind != gossipNotification {
+		t.Errorf("a keyring notification should not be gossiped in compact form")
+	}
+	compact := *n
+	compact.Signatures = map[string]Signature{compactSignatureName: n.Signatures[compactSignatureName]}
+	if err = compact.Verify(kr); err == nil {
+		t.Errorf("a keyring notification with compact signature should not be verified")
+	}
+	modified := *n
+	modified.Keyring = &KeyringChange{Add: n.Keyring.Add}
+	if err = modified.Verify(kr); err == nil {
+		t.Errorf("a modified keyring notification should not be verified")
+	}
+	if _, err = kr.applyChange(newKeyringNotification(2, 2, root)); err == nil {
+		t.Errorf("a keyring change with unreachable threshold should not be applied")
+	}
+
+	if err = n.Verify(kr); err != nil {
+		t.Fatalf("failed verifying keyring notification: %v", err)
+	}
+	if applied, err := kr.applyChange(n); err != nil || !applied {
+		t.Fatalf("failed applying keyring notification: %v", err)
+	}
+	if err = oldUpdate.Verify(kr); err == nil {
+		t.Errorf("update of a revoked key should not be verified")
+	}
+	if err = newUpdate.Verify(kr); err != nil {
+		t.Errorf("failed verifying update of an added key: %v", err)
+	}
+	if applied, err := kr.applyChange(n); err != nil || applied {
+		t.Errorf("applying the same version: got %v, %v", applied, err)
+	}
+	if _, err = kr.applyChange(newKeyringNotification(1, 0, root)); err == nil {
+		t.Errorf("an older keyring notification should not be applied")
+	}
+}
@@ -5,18 +5,22 @@
 package main
 
 import (
+	"crypto"
 	"encoding/json"
 	"fmt"
 	"log"
 	"net"
+	"net/url"
 	"os"
 	"os/user"
 	"path/filepath"
+	"strings"
 	"sync"
 	"time"
 
 	"gopkg.in/natefinch/lumberjack.v2"
 
+	"github.com/anacrolix/torrent/metainfo"
 	"github.com/pkg/errors"
 	"github.com/valyala/fasthttp"
 	"github.com/zeebo/bencode"
@@ -24,65 +28,249 @@ import (
 )
 
 func submitCmd(ctx *cli.Context) error {
-	filename, err := filepath.Abs(ctx.String("file"))
-	if _, err := os.Stat(filename); err != nil {
-		return fmt.Errorf("update file '%s' does not exist", filename)
+	var (
+		u   *Update
+		err error
+	)
+	if input := ctx.String("input"); len(input) > 0 {
+		u, err = readUpdateFile(input)
+	} else {
+		u, err = newSubmitUpdate(ctx)
+	}
+	if err != nil {
+		return err
 	}
 
-	uuid := ctx.String("uuid")
-	if len(uuid) == 0 {
-		return fmt.Errorf("UUID is empty")
+	if output := ctx.String("output"); output != "" {
+		w := os.Stdout
+		if output != "-" {
+			var err error
+			w, err = os.OpenFile(output, os.O_TRUNC|os.O_CREATE|os.O_WRONLY, 0644)
+			if err != nil {
+				return err
+			}
+			defer w.Close()
+		}
+		if ctx.Bool("torrent-file") {
+			return bencode.NewEncoder(w).Encode(&u.Notification)
+		}
+		return json.NewEncoder(w).Encode(u)
 	}
 
+	if err = submitToAgent(u, ctx.String("unix-socket")); err != nil {
+		return errors.Wrap(err, "failed submitting to agent")
+	}
+	if serverAddr := ctx.String("server"); len(serverAddr) > 0 {
+		if err = submitToServer(u, serverAddr); err != nil {
+			return errors.Wrap(err, "failed submitting to server")
+		}
+	}
+	return nil
+}
+
+// newSubmitUpdate returns the Update of the submitted file, whose
+// notification is signed by the private key and the co-signer keys.
+func newSubmitUpdate(ctx *cli.Context) (*Update, error) {
 	ver := ctx.Uint64("version")
 	if ver <= 0 {
 		ver = uint64(time.Now().UTC().Unix())
 	}
 
-	key, err := LoadPrivateKey(ctx.String("private-key"))
+	change, err := keyringChange(ctx)
 	if err != nil {
-		return errors.Wrap(err, "failed loading private key")
+		return nil, err
+	}
+	uuid := ctx.String("uuid")
+	filename, err := filepath.Abs(ctx.String("file"))
+	if change != nil {
+		// the payload of a keyring notification is its bencoded change
+		uuid = UUIDKeyring
+		if filename, err = change.writeFile(); err != nil {
+			return nil, errors.Wrap(err, "failed writing keyring change")
+		}
+	}
+	if _, err := os.Stat(filename); err != nil {
+		return nil, fmt.Errorf("update file '%s' does not exist", filename)
+	}
+	if len(uuid) == 0 {
+		return nil, fmt.Errorf("UUID is empty")
+	}
+
+	key, err := loadSigner(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var coSigners []crypto.Signer
+	for _, f := range ctx.StringSlice("co-signer-key") {
+		k, err := LoadPrivateKey(f)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed loading co-signer key")
+		}
+		coSigners = append(coSigners, k)
+	}
+
+	// the first tier is the server's tracker unless a tracker is given
+	tracker := ctx.String("tracker")
+	if len(tracker) == 0 {
+		tracker = serverTracker(ctx.String("server"))
+	}
+	trackers := [][]string{{tracker}}
+	for _, tier := range ctx.StringSlice("announce-list") {
+		trackers = append(trackers, strings.Split(tier, ","))
+	}
+
+	// the known cluster nodes let fresh agents find the seeders via DHT
+	// when the trackers are unreachable
+	var nodes []metainfo.Node
+	if !ctx.Bool("no-nodes") {
+		if nodes, err = clusterNodes(ctx.String("unix-socket"), ctx.String("cluster")); err != nil {
+			log.Printf("WARNING: notification has no DHT nodes - %v", err)
+		}
 	}
 
 	mi, err := NewNotification(
 		filename,
 		uuid,
 		ver,
-		ctx.String("tracker"),
+		trackers,
+		nodes,
+		ctx.StringSlice("web-seed"),
 		ctx.Int64("piece-length"),
 		key)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	u := Update{
+	// the agents that have the base version only download the patch
+	var patch string
+	if base := ctx.String("base"); len(base) > 0 {
+		if ctx.Uint64("base-version") == 0 {
+			return nil, fmt.Errorf("base version is required with base file")
+		}
+		if mi.Delta, patch, err = NewDelta(mi, filename, base, ctx.Uint64("base-version")); err != nil {
+			return nil, errors.Wrap(err, "failed creating delta")
+		}
+		if err = mi.Sign(key); err != nil {
+			return nil, err
+		}
+	}
+	if change != nil {
+		mi.Keyring = change
+		if err = mi.Sign(key); err != nil {
+			return nil, err
+		}
+	}
+	for _, k := range coSigners {
+		if err = mi.CoSign(k); err != nil {
+			return nil, errors.Wrap(err, "failed co-signing notification")
+		}
+	}
+
+	return &Update{
 		Source:       filename,
 		Notification: *mi,
+		Cluster:      ctx.String("cluster"),
+		DeltaSource:  patch,
+	}, nil
+}
+
+// keyringChange returns the keyring change of the submit command, or nil if
+// the update is not a keyring notification.
+func keyringChange(ctx *cli.Context) (*KeyringChange, error) {
+	add, revoke := ctx.StringSlice("keyring-add"), ctx.StringSlice("keyring-revoke")
+	if len(add) == 0 && len(revoke) == 0 && ctx.Int("keyring-threshold") <= 0 {
+		return nil, nil
 	}
+	kc, err := NewKeyringChange(add, revoke, ctx.Int("keyring-threshold"))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed loading keyring change")
+	}
+	return kc, nil
+}
 
-	if output := ctx.String("output"); output != "" {
-		w := os.Stdout
-		if output != "-" {
-			var err error
-			w, err = os.OpenFile(output, os.O_TRUNC|os.O_CREATE|os.O_WRONLY, 0644)
-			if err != nil {
-				return err
-			}
-			defer w.Close()
+// loadSigner returns the private key of the command, with its certificate
+// chain if it is given.
+func loadSigner(ctx *cli.Context) (crypto.Signer, error) {
+	key, err := LoadPrivateKey(ctx.String("private-key"))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed loading private key")
+	}
+	if f := ctx.String("certificate"); len(f) > 0 {
+		if key, err = LoadCertificateSigner(key, f); err != nil {
+			return nil, errors.Wrap(err, "failed loading certificate")
 		}
-		if ctx.Bool("torrent-file") {
-			return bencode.NewEncoder(w).Encode(&u.Notification)
+	}
+	return key, nil
+}
+
+// readUpdateFile reads an Update, which is generated by `submit -o`, from
+// given file or STDIN if it is "-".
+func readUpdateFile(filename string) (*Update, error) {
+	r := os.Stdin
+	if filename != "-" {
+		f, err := os.Open(filename)
+		if err != nil {
+			return nil, err
 		}
-		return json.NewEncoder(w).Encode(&u)
+		defer f.Close()
+		r = f
 	}
+	var u Update
+	if err := json.NewDecoder(r).Decode(&u); err != nil {
+		return nil, fmt.Errorf("failed decoding update file '%s': %v", filename, err)
+	}
+	return &u, nil
+}
 
-	if err = submitToAgent(&u, ctx.String("unix-socket")); err != nil {
-		return errors.Wrap(err, "failed submitting to agent")
+// signCmd adds the signature of a co-signer to the notification of an update
+// file, so that it can be submitted with `submit -i` once enough keys of
+// the keyring have signed it.
+func signCmd(ctx *cli.Context) error {
+	u, err := readUpdateFile(ctx.String("input"))
+	if err != nil {
+		return err
 	}
-	if serverAddr := ctx.String("server"); len(serverAddr) > 0 {
-		if err = submitToServer(&u, serverAddr); err != nil {
-			return errors.Wrap(err, "failed submitting to server")
+	key, err := loadSigner(ctx)
+	if err != nil {
+		return err
+	}
+	if err = u.Notification.CoSign(key); err != nil {
+		return errors.Wrap(err, "failed co-signing notification")
+	}
+
+	w := os.Stdout
+	if output := ctx.String("output"); output != "-" {
+		if w, err = os.OpenFile(output, os.O_TRUNC|os.O_CREATE|os.O_WRONLY, 0644); err != nil {
+			return err
+		}
+		defer w.Close()
+	}
+	return json.NewEncoder(w).Encode(u)
+}
+
+// keyFiles returns the keys of given files.
+func keyFiles(filenames []string) []Key {
+	var keys []Key
+	for _, f := range filenames {
+		keys = append(keys, Key{Filename: f})
+	}
+	return keys
+}
+
+func keyIDCmd(ctx *cli.Context) error {
+	if ctx.NArg() == 0 {
+		return fmt.Errorf("public key file is required")
+	}
+	for _, filename := range ctx.Args() {
+		pub, err := LoadPublicKey(filename)
+		if err != nil {
+			return err
 		}
+		id, err := keyID(pub)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s %s\n", id, filename)
 	}
 	return nil
 }
@@ -126,6 +314,30 @@ func submitToAgent(u *Update, addr string) error {
 	return nil
 }
 
+// clusterNodes returns the torrent clients of the agent's cluster peers.
+func clusterNodes(addr, cluster string) ([]metainfo.Node, error) {
+	client := fasthttp.Client{
+		Dial: func(_ string) (net.Conn, error) {
+			return net.Dial("unix", addr)
+		},
+	}
+	req := fasthttp.AcquireRequest()
+	req.SetRequestURI(fmt.Sprintf("http://v1%s?cluster=%s", pathOverlayNodes, url.QueryEscape(cluster)))
+	req.Header.SetMethod("GET")
+	res := fasthttp.AcquireResponse()
+	if err := client.DoDeadline(req, res, time.Now().Add(5*time.Second)); err != nil {
+		return nil, fmt.Errorf("clusterNodes - failed http request: %v", err)
+	}
+	if res.StatusCode() != 200 {
+		return nil, fmt.Errorf("clusterNodes - status code: %d", res.StatusCode())
+	}
+	var nodes []metainfo.Node
+	if err := json.Unmarshal(res.Body(), &nodes); err != nil {
+		return nil, fmt.Errorf("clusterNodes - failed decoding nodes: %v", err)
+	}
+	return nodes, nil
+}
+
 func serverCmd(ctx *cli.Context) error {
 	var (
 		wg  sync.WaitGroup
@@ -152,6 +364,49 @@ func serverCmd(ctx *cli.Context) error {
 	if pwd := ctx.String("stun-password"); len(pwd) > 0 {
 		cfg.StunPassword = pwd
 	}
+	if n := ctx.Int("gossip-fanout"); n > 0 {
+		cfg.GossipFanout = n
+	}
+	if n := ctx.Int("gossip-ttl"); n > 0 {
+		cfg.GossipTTL = n
+	}
+	if t := ctx.Int("peer-lifetime"); t > 0 {
+		cfg.PeerLifetime = t
+	}
+	if n := ctx.Int("relay-allocations"); n >= 0 {
+		cfg.RelayMaxAllocations = n
+	}
+	if n := ctx.Int("relay-bandwidth"); n >= 0 {
+		cfg.RelayBandwidth = n
+	}
+	if n := ctx.Int("relay-total-bandwidth"); n >= 0 {
+		cfg.RelayTotalBandwidth = n
+	}
+	if t := ctx.Int("relay-lifetime"); t > 0 {
+		cfg.RelayLifetime = t
+	}
+	if t := ctx.Int("push-timeout"); t > 0 {
+		cfg.PushTimeout = t
+	}
+	if addr := ctx.String("alternate-address"); len(addr) > 0 {
+		cfg.AlternateAddress = addr
+	}
+	if t := ctx.Int("tracker-interval"); t >= 0 {
+		cfg.TrackerInterval = t
+	}
+	cfg.TrackerUDP = ctx.Bool("tracker-udp")
+	if dir := ctx.String("data-dir"); len(dir) > 0 {
+		cfg.DataDir = dir
+	}
+	cfg.Keyring = KeyringConfig{
+		Keys:                   keyFiles(ctx.StringSlice("trusted-key")),
+		Directory:              ctx.String("keyring-dir"),
+		Threshold:              ctx.Int("threshold"),
+		RejectLegacy:           ctx.Bool("reject-legacy"),
+		CertificateAuthorities: keyFiles(ctx.StringSlice("ca")),
+		RootKeys:               keyFiles(ctx.StringSlice("root-key")),
+		RootThreshold:          ctx.Int("root-threshold"),
+	}
 
 	if f := ctx.String("log-file"); len(f) > 0 {
 		log.SetOutput(&lumberjack.Logger{
@@ -236,8 +491,11 @@ func main() {
 				},
 				cli.StringFlag{
 					Name:  "tracker, r",
-					Value: DefaultTracker,
-					Usage: "BitTorrent tracker address",
+					Usage: "BitTorrent tracker address (default: the server's tracker)",
+				},
+				cli.StringSliceFlag{
+					Name:  "announce-list, a",
+					Usage: "Backup tier of comma-separated tracker addresses (BEP 12), can be repeated",
 				},
 				cli.Int64Flag{
 					Name:  "piece-length, l",
@@ -258,8 +516,84 @@ func main() {
 					Name:  "torrent-file, t",
 					Usage: "Generate BitTorrent file (use with -o option)",
 				},
+				cli.StringFlag{
+					Name:  "cluster, c",
+					Usage: "Cluster name of the update at the agent",
+				},
+				cli.BoolFlag{
+					Name:  "no-nodes, n",
+					Usage: "Do not add the agent's cluster peers as DHT nodes",
+				},
+				cli.StringSliceFlag{
+					Name:  "web-seed, w",
+					Usage: "Web seed URL (BEP 19), can be repeated",
+				},
+				cli.StringFlag{
+					Name:  "base, b",
+					Usage: "Payload file of the base version, which adds a delta patch to the notification",
+				},
+				cli.Uint64Flag{
+					Name:  "base-version",
+					Usage: "Version of the base payload (use with -b option)",
+				},
+				cli.StringFlag{
+					Name:  "certificate, C",
+					Usage: "PEM file of the certificate chain of the private key",
+				},
+				cli.StringSliceFlag{
+					Name:  "co-signer-key, K",
+					Usage: "Private key of a co-signer, can be repeated",
+				},
+				cli.StringFlag{
+					Name:  "input, i",
+					Usage: "Update file generated by -o option and co-signed by 'sign', or - for STDIN (instead of -f)",
+				},
+				cli.StringSliceFlag{
+					Name:  "keyring-add",
+					Usage: "Public key file that the keyring notification adds, can be repeated (instead of -f, sign with a root key)",
+				},
+				cli.StringSliceFlag{
+					Name:  "keyring-revoke",
+					Usage: "ID of a key that the keyring notification revokes (see 'key-id'), can be repeated",
+				},
+				cli.IntFlag{
+					Name:  "keyring-threshold",
+					Usage: "Threshold of trusted keys that the keyring notification sets",
+				},
+			},
+		},
+		{
+			Name:   "sign",
+			Usage:  "co-sign the notification of an update file",
+			Action: signCmd,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "input, i",
+					Value: "-",
+					Usage: "Update file generated by 'submit -o', or - for STDIN",
+				},
+				cli.StringFlag{
+					Name:  "private-key, k",
+					Value: fmt.Sprintf("%s/.ssh/id_rsa", homeDir),
+					Usage: "Private key for signing",
+				},
+				cli.StringFlag{
+					Name:  "certificate, C",
+					Usage: "PEM file of the certificate chain of the private key",
+				},
+				cli.StringFlag{
+					Name:  "output, o",
+					Value: "-",
+					Usage: "output update file, or - for STDOUT",
+				},
 			},
 		},
+		{
+			Name:      "key-id",
+			Usage:     "print the IDs of public keys, which are used in keyring notifications",
+			ArgsUsage: "public-key-file...",
+			Action:    keyIDCmd,
+		},
 		{
 			Name:   "agent",
 			Usage:  "agent mode",
@@ -315,6 +649,93 @@ func main() {
 					Value: "/var/log/p2pupdate-server.log",
 					Usage: "Log file",
 				},
+				cli.IntFlag{
+					Name:  "gossip-fanout, f",
+					Value: 4,
+					Usage: "Number of peers that receive a new update notification",
+				},
+				cli.IntFlag{
+					Name:  "gossip-ttl, t",
+					Value: 6,
+					Usage: "Number of hops of a new update notification",
+				},
+				cli.IntFlag{
+					Name:  "peer-lifetime, l",
+					Value: 300,
+					Usage: "Lifetime of a peer session without binding request (in second)",
+				},
+				cli.IntFlag{
+					Name:  "relay-allocations, r",
+					Value: 64,
+					Usage: "Maximum number of relay allocations (0 = relay is disabled)",
+				},
+				cli.IntFlag{
+					Name:  "relay-bandwidth, w",
+					Value: 32 * 1024,
+					Usage: "Relay bandwidth of each allocation (in bytes per second, 0 = unlimited)",
+				},
+				cli.IntFlag{
+					Name:  "relay-total-bandwidth",
+					Value: 1024 * 1024,
+					Usage: "Relay bandwidth of all allocations (in bytes per second, 0 = unlimited)",
+				},
+				cli.IntFlag{
+					Name:  "relay-lifetime",
+					Value: 600,
+					Usage: "Lifetime of a relay allocation that is not refreshed (in second)",
+				},
+				cli.IntFlag{
+					Name:  "push-timeout",
+					Value: 60,
+					Usage: "Maximum time of a long-poll request of the push channel (in second)",
+				},
+				cli.StringFlag{
+					Name:  "alternate-address, b",
+					Usage: "Alternate address (IP and/or port) for NAT discovery, e.g. :3479",
+				},
+				cli.IntFlag{
+					Name:  "tracker-interval, i",
+					Value: 120,
+					Usage: "Announce interval of the embedded tracker (in second, 0 = tracker is disabled)",
+				},
+				cli.BoolFlag{
+					Name:  "tracker-udp, u",
+					Usage: "Serve UDP tracker protocol (BEP 15) on the STUN port",
+				},
+				cli.StringFlag{
+					Name:  "data-dir, e",
+					Usage: "Directory of update files that is served at /data/ for web seeding",
+				},
+				cli.StringSliceFlag{
+					Name:  "trusted-key",
+					Usage: "Public key file that is trusted in addition to -k, can be repeated",
+				},
+				cli.StringFlag{
+					Name:  "keyring-dir",
+					Usage: "Directory of trusted public key files with extension .pub",
+				},
+				cli.IntFlag{
+					Name:  "threshold",
+					Value: 1,
+					Usage: "Minimum number of distinct trusted keys that must sign a notification",
+				},
+				cli.BoolFlag{
+					Name:  "reject-legacy",
+					Usage: "Reject the signatures over JSON payloads of older versions",
+				},
+				cli.StringSliceFlag{
+					Name:  "ca",
+					Usage: "PEM file of CA roots that certify the signing keys, can be repeated",
+				},
+				cli.StringSliceFlag{
+					Name:  "root-key",
+					Usage: "Public key file of a root key that signs keyring notifications, can be repeated",
+				},
+				cli.IntFlag{
+					Name:  "root-threshold",
+					Value: 1,
+					Usage: "Minimum number of distinct root keys that must sign a keyring notification",
+				},
 			},
 		},
 	}
@@ -0,0 +1,392 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"github.com/gortc/stun"
+	"github.com/pkg/errors"
+)
+
+// Attributes of NAT behavior discovery (RFC 5780).
+const (
+	attrChangeRequest stun.AttrType = 0x0003 // CHANGE-REQUEST
+	attrOtherAddress  stun.AttrType = 0x802C // OTHER-ADDRESS
+)
+
+// NAT mapping and filtering behaviors (RFC 4787).
+const (
+	natUnknown                 = "unknown"
+	natNone                    = "none"
+	natEndpointIndependent     = "endpoint-independent"
+	natAddressDependent        = "address-dependent"
+	natAddressAndPortDependent = "address-and-port-dependent"
+)
+
+// Modes of a cluster's overlay that are selected from the NAT behavior.
+const (
+	overlayModeDirect = "direct"
+	overlayModeRelay  = "relay"
+	overlayModeTCP    = "tcp"
+)
+
+const (
+	natDiscoveryWait    = 2 * time.Second
+	natDiscoveryRetries = 3
+
+	// natDiscoveryInterval is the interval of repeating NAT discovery when
+	// the server does not respond
+	natDiscoveryInterval = time.Minute
+)
+
+var (
+	errNoResponse                 = errors.New("no response from server")
+	errNATDiscoveryNotSupported   = errors.New("server does not support NAT discovery")
+	errCannotChangeAddressOrPort  = errors.New("server cannot change address or port")
+	errNATDiscoveryRequestInvalid = errors.New("invalid NAT discovery request")
+)
+
+// changeRequest holds the flags of CHANGE-REQUEST attribute.
+type changeRequest uint32
+
+const (
+	changePort changeRequest = 0x02
+	changeIP   changeRequest = 0x04
+)
+
+// AddTo writes the CHANGE-REQUEST attribute on given STUN message.
+func (c changeRequest) AddTo(m *stun.Message) error {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, uint32(c))
+	m.Add(attrChangeRequest, b)
+	return nil
+}
+
+// GetFrom reads the CHANGE-REQUEST attribute from given STUN message.
+func (c *changeRequest) GetFrom(m *stun.Message) error {
+	b, err := m.Get(attrChangeRequest)
+	if err != nil {
+		return err
+	} else if len(b) != 4 {
+		return fmt.Errorf("length of change request (%d bytes) is not 4 bytes", len(b))
+	}
+	*c = changeRequest(binary.BigEndian.Uint32(b))
+	return nil
+}
+
+// otherAddress is the OTHER-ADDRESS attribute. It is XOR-encoded like
+// XOR-MAPPED-ADDRESS.
+type otherAddress stun.XORMappedAddress
+
+// AddTo writes the OTHER-ADDRESS attribute on given STUN message.
+func (a *otherAddress) AddTo(m *stun.Message) error {
+	return (*stun.XORMappedAddress)(a).AddToAs(m, attrOtherAddress)
+}
+
+// GetFrom reads the OTHER-ADDRESS attribute from given STUN message.
+func (a *otherAddress) GetFrom(m *stun.Message) error {
+	return (*stun.XORMappedAddress)(a).GetFromAs(m, attrOtherAddress)
+}
+
+// NATBehavior describes the behavior of NAT between a node and a server.
+type NATBehavior struct {
+	Mapping   string `json:"mapping"`
+	Filtering string `json:"filtering"`
+}
+
+func (nb *NATBehavior) String() string {
+	return fmt.Sprintf("mapping:%s filtering:%s", nb.Mapping, nb.Filtering)
+}
+
+// OverlayMode returns the overlay mode that suits the NAT behavior. Peers
+// behind NATs whose mapping depends on the destination cannot be reached
+// directly, hence they need a relay.
+func (nb *NATBehavior) OverlayMode() string {
+	switch nb.Mapping {
+	case natAddressDependent, natAddressAndPortDependent:
+		return overlayModeRelay
+	}
+	return overlayModeDirect
+}
+
+type natDiscovery struct {
+	conn     *net.UDPConn
+	id       PeerID
+	password string
+}
+
+// DiscoverNAT discovers the mapping and filtering behaviors of the NAT between
+// given local address and the server using the tests of RFC 5780. It returns
+// errNoResponse if the server does not respond, which means that either
+// the server is down or UDP is blocked.
+func DiscoverNAT(server, password, local string) (*NATBehavior, error) {
+	var (
+		serverAddr, localAddr *net.UDPAddr
+		pid                   *PeerID
+		err                   error
+	)
+
+	if serverAddr, err = net.ResolveUDPAddr("udp", server); err != nil {
+		return nil, errors.Wrapf(err, "cannot resolve server address %s", server)
+	}
+	if localAddr, err = net.ResolveUDPAddr("udp", local); err != nil {
+		return nil, errors.Wrapf(err, "cannot resolve local address %s", local)
+	}
+	if pid, err = LocalPeerID(); err != nil {
+		return nil, errors.Wrap(err, "failed to get local ID")
+	}
+	d := natDiscovery{
+		id:       *pid,
+		password: password,
+	}
+	if d.conn, err = net.ListenUDP("udp", localAddr); err != nil {
+		return nil, errors.Wrap(err, "failed creating UDP connection")
+	}
+	defer d.conn.Close()
+
+	// Test I: does the server respond?
+	x1, other, err := d.test(serverAddr, 0)
+	if err != nil {
+		return nil, err
+	} else if other == nil {
+		return nil, errNATDiscoveryNotSupported
+	}
+	if other.IP.IsUnspecified() {
+		other.IP = serverAddr.IP
+	}
+	altIP := !other.IP.Equal(serverAddr.IP)
+
+	nb := NATBehavior{
+		Mapping:   natUnknown,
+		Filtering: natUnknown,
+	}
+	if laddr := d.conn.LocalAddr().(*net.UDPAddr); x1.IP.Equal(laddr.IP) && x1.Port == laddr.Port {
+		nb.Mapping = natNone
+	} else if altIP {
+		// Test II and III of mapping behavior
+		if x2, _, err := d.test(&net.UDPAddr{IP: other.IP, Port: serverAddr.Port}, 0); err == nil {
+			if equalUDPAddr(x1, x2) {
+				nb.Mapping = natEndpointIndependent
+			} else if x3, _, err := d.test(other, 0); err == nil {
+				if equalUDPAddr(x2, x3) {
+					nb.Mapping = natAddressDependent
+				} else {
+					nb.Mapping = natAddressAndPortDependent
+				}
+			}
+		}
+	} else {
+		// the server has one IP, so only port dependency can be tested
+		if x2, _, err := d.test(&net.UDPAddr{IP: serverAddr.IP, Port: other.Port}, 0); err == nil {
+			if equalUDPAddr(x1, x2) {
+				nb.Mapping = natEndpointIndependent
+			} else {
+				nb.Mapping = natAddressAndPortDependent
+			}
+		}
+	}
+
+	// Test II and III of filtering behavior
+	if altIP {
+		if _, _, err = d.test(serverAddr, changeIP|changePort); err == nil {
+			nb.Filtering = natEndpointIndependent
+		}
+	}
+	if nb.Filtering == natUnknown {
+		if _, _, err = d.test(serverAddr, changePort); err == nil {
+			nb.Filtering = natAddressDependent
+		} else if err == errNoResponse {
+			nb.Filtering = natAddressAndPortDependent
+		}
+	}
+	return &nb, nil
+}
+
+func equalUDPAddr(a, b *net.UDPAddr) bool {
+	return a.IP.Equal(b.IP) && a.Port == b.Port
+}
+
+// test sends a binding request to given address, then returns the mapped
+// address and other address of the server's response.
+func (d *natDiscovery) test(addr *net.UDPAddr, change changeRequest) (*net.UDPAddr, *net.UDPAddr, error) {
+	req, err := stun.Build(
+		stun.TransactionID,
+		stun.BindingRequest,
+		change,
+		&d.id,
+		stun.NewShortTermIntegrity(d.password),
+		stun.Fingerprint,
+	)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed building NAT discovery request")
+	}
+
+	buf := make([]byte, 2048)
+	for i := 0; i < natDiscoveryRetries; i++ {
+		if _, err = d.conn.WriteToUDP(req.Raw, addr); err != nil {
+			return nil, nil, err
+		}
+		if err = d.conn.SetReadDeadline(time.Now().Add(natDiscoveryWait)); err != nil {
+			return nil, nil, err
+		}
+		for {
+			n, _, err := d.conn.ReadFromUDP(buf)
+			if err != nil {
+				break
+			}
+			res := new(stun.Message)
+			if _, err = res.Write(buf[:n]); err != nil || res.TransactionID != req.TransactionID {
+				continue
+			}
+			if err = validateMessage(res, &stun.BindingSuccess, d.password); err != nil {
+				continue
+			}
+
+			var (
+				mapped stun.XORMappedAddress
+				other  otherAddress
+			)
+			if err = mapped.GetFrom(res); err != nil {
+				return nil, nil, errors.Wrap(err, "failed getting mapped address")
+			}
+			x := &net.UDPAddr{IP: mapped.IP, Port: mapped.Port}
+			if err = other.GetFrom(res); err != nil {
+				return x, nil, nil
+			}
+			return x, &net.UDPAddr{IP: other.IP, Port: other.Port}, nil
+		}
+	}
+	return nil, nil, errNoResponse
+}
+
+// isNATDiscoveryRequest returns true if given message is a binding request
+// for NAT behavior discovery.
+func isNATDiscoveryRequest(m *stun.Message) bool {
+	return m.Type == stun.BindingRequest && m.Contains(attrChangeRequest)
+}
+
+// listenAlternate opens the alternate addresses for NAT behavior discovery.
+// natConns[i][j] is the connection whose IP is alternate when i = 1, and whose
+// port is alternate when j = 1. natConns[0][0] is the primary connection.
+func (s *Server) listenAlternate() error {
+	if len(s.cfg.AlternateAddress) == 0 {
+		return nil
+	}
+	alt, err := net.ResolveUDPAddr("udp", s.cfg.AlternateAddress)
+	if err != nil {
+		return errors.Wrapf(err, "failed resolving alternate address %s", s.cfg.AlternateAddress)
+	} else if alt.Port == s.Addr.Port {
+		return fmt.Errorf("alternate port must be different from %d", s.Addr.Port)
+	}
+
+	ips := []net.IP{s.Addr.IP}
+	if len(alt.IP) > 0 && !alt.IP.Equal(s.Addr.IP) {
+		ips = append(ips, alt.IP)
+	}
+	for i, ip := range ips {
+		for j, port := range []int{s.Addr.Port, alt.Port} {
+			if i == 0 && j == 0 {
+				continue
+			}
+			addr := &net.UDPAddr{IP: ip, Port: port}
+			conn, err := net.ListenUDP("udp", addr)
+			if err != nil {
+				return errors.Wrapf(err, "failed listening UDP at %s", addr)
+			}
+			s.natConns[i][j] = conn
+			log.Printf("Serving UDP (STUN NAT discovery) at %s", addr)
+			go s.serveNATDiscovery(i, j)
+		}
+	}
+	return nil
+}
+
+func (s *Server) serveNATDiscovery(i, j int) {
+	var (
+		conn = s.natConns[i][j]
+		buf  = make([]byte, 2048)
+		req  = new(stun.Message)
+		res  = new(stun.Message)
+	)
+
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if nerr, ok := err.(net.Error); ok && !nerr.Temporary() {
+			log.Printf("stopped serving NAT discovery at %s - %v", conn.LocalAddr(), err)
+			return
+		} else if err != nil {
+			log.Printf("ERROR: ReadFrom %v - %v", addr, err)
+			continue
+		}
+		req.Reset()
+		if !stun.IsMessage(buf[:n]) {
+			continue
+		} else if _, err = req.Write(buf[:n]); err != nil {
+			continue
+		} else if err = validateMessage(req, nil, s.cfg.StunPassword); err != nil {
+			continue
+		}
+		if err = s.respondNATDiscovery(i, j, addr, req, res); err != nil {
+			log.Printf("ERROR: NAT discovery from %s: %v", addr, err)
+		}
+	}
+}
+
+// respondNATDiscovery replies a NAT discovery request that is received by
+// connection natConns[i][j]. The reply is sent from the connection whose
+// address or port is changed as requested.
+func (s *Server) respondNATDiscovery(i, j int, addr net.Addr, req, res *stun.Message) error {
+	var change changeRequest
+
+	peer, ok := addr.(*net.UDPAddr)
+	if !ok || !isNATDiscoveryRequest(req) {
+		return errNATDiscoveryRequestInvalid
+	} else if err := change.GetFrom(req); err != nil {
+		return errors.Wrap(err, "failed getting change request")
+	}
+	if change&changeIP != 0 {
+		i = 1 - i
+	}
+	if change&changePort != 0 {
+		j = 1 - j
+	}
+	conn := s.natConns[i][j]
+	if conn == nil {
+		return errCannotChangeAddressOrPort
+	}
+
+	setters := []stun.Setter{
+		stun.NewTransactionIDSetter(req.TransactionID),
+		stun.BindingSuccess,
+		&stun.XORMappedAddress{
+			IP:   peer.IP,
+			Port: peer.Port,
+		},
+	}
+	other := s.natConns[1][1]
+	if other == nil {
+		other = s.natConns[0][1]
+	}
+	if other != nil {
+		oaddr := other.LocalAddr().(*net.UDPAddr)
+		setters = append(setters, &otherAddress{IP: oaddr.IP, Port: oaddr.Port})
+	}
+	setters = append(setters,
+		&s.ID,
+		stun.NewShortTermIntegrity(s.cfg.StunPassword),
+		stun.Fingerprint,
+	)
+	res.Reset()
+	if err := res.Build(setters...); err != nil {
+		return errors.Wrap(err, "failed building NAT discovery response")
+	}
+	_, err := conn.WriteTo(res.Raw, peer)
+	return err
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/gortc/stun"
+)
+
+func TestChangeRequest(t *testing.T) {
+	m, err := stun.Build(stun.TransactionID, stun.BindingRequest, changeIP|changePort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var c changeRequest
+	if err = c.GetFrom(m); err != nil {
+		t.Fatal(err)
+	}
+	if c != changeIP|changePort {
+		t.Errorf("change request %x != %x", c, changeIP|changePort)
+	}
+	if !isNATDiscoveryRequest(m) {
+		t.Error("message is not a NAT discovery request")
+	}
+}
+
+func TestDiscoverNATWithoutNAT(t *testing.T) {
+	addr, _ := net.ResolveUDPAddr("udp", "127.0.0.1:0")
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	s := &Server{
+		Addr: conn.LocalAddr().(*net.UDPAddr),
+		cfg: &ServerConfig{
+			StunPassword:     defaultStunPassword,
+			AlternateAddress: "127.0.0.1:0",
+		},
+	}
+	s.natConns[0][0] = conn
+	go s.serveNATDiscovery(0, 0)
+	if err = s.listenAlternate(); err != nil {
+		t.Fatal(err)
+	}
+
+	nb, err := DiscoverNAT(s.Addr.String(), defaultStunPassword, "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nb.Mapping != natNone || nb.Filtering != natAddressDependent {
+		t.Errorf("unexpected NAT behavior: %s", nb)
+	}
+	if nb.OverlayMode() != overlayModeDirect {
+		t.Errorf("overlay mode %s != %s", nb.OverlayMode(), overlayModeDirect)
+	}
+}
@@ -2,8 +2,6 @@ package main
 
 import (
 	"crypto"
-	"crypto/rand"
-	"crypto/rsa"
 	"crypto/sha256"
 	"encoding/json"
 	"fmt"
@@ -22,7 +20,9 @@ type Notification struct {
 	// Fields from standard BitTorrent protocol
 	Info         metainfo.Info   `bencode:"info,omitempty"`
 	Announce     string          `bencode:"announce,omitempty"`
+	AnnounceList [][]string      `bencode:"announce-list,omitempty" json:",omitempty"`
 	Nodes        []metainfo.Node `bencode:"nodes,omitempty"`
+	URLList      []string        `bencode:"url-list,omitempty" json:",omitempty"`
 	CreationDate int64           `bencode:"creation date,omitempty,ignore_unmarshal_type_error"`
 	CreatedBy    string          `bencode:"created by,omitempty"`
 	Encoding     string          `bencode:"encoding,omitempty"`
@@ -34,6 +34,12 @@ type Notification struct {
 	// Fields proposed by Herry et.al. (see DOMINO workshop paper)
 	UUID    string `bencode:"uuid,omitempty"`
 	Version uint64 `bencode:"version,omitempty"`
+
+	// Delta is the patch from the payload of a base version
+	Delta *Delta `bencode:"delta,omitempty" json:",omitempty"`
+
+	// Keyring is the change of trusted keys of a keyring notification
+	Keyring *KeyringChange `bencode:"keyring,omitempty" json:",omitempty"`
 }
 
 // Signature holds data signature
@@ -42,22 +48,38 @@ type Signature struct {
 	Certificate []byte `bencode:"certificate,omitempty"`
 	Info        string `bencode:"info,omitempty"`
 	Signature   []byte `bencode:"signature,omitempty"`
+
+	// Algorithm is the signature algorithm, which is RSA if it is empty
+	Algorithm string `bencode:"algorithm,omitempty" json:",omitempty"`
+
+	// Format is the format of the signed payload
+	Format int `bencode:"format,omitempty" json:",omitempty"`
 }
 
 // NewNotification creates a new Notification instance of given update's filename.
-func NewNotification(filename, uuid string, ver uint64, tracker string,
-	pieceLength int64, privkey *rsa.PrivateKey) (*Notification, error) {
+// `trackers` is the tiers of tracker URLs (BEP 12), whose first URL is
+// the announce URL. `nodes` are the DHT nodes and `webSeeds` are the web seed
+// URLs (BEP 19) of the notification.
+func NewNotification(filename, uuid string, ver uint64, trackers [][]string,
+	nodes []metainfo.Node, webSeeds []string, pieceLength int64, privkey crypto.Signer) (*Notification, error) {
 	mi := Notification{
 		UUID:         uuid,
 		Version:      ver,
-		Announce:     tracker,
 		CreatedBy:    softwareName,
 		Encoding:     "UTF-8",
 		CreationDate: time.Now().Unix(),
+		Nodes:        nodes,
+		URLList:      webSeeds,
 		Info: metainfo.Info{
 			PieceLength: pieceLength,
 		},
 	}
+	if len(trackers) > 0 && len(trackers[0]) > 0 {
+		mi.Announce = trackers[0][0]
+		if len(trackers) > 1 || len(trackers[0]) > 1 {
+			mi.AnnounceList = trackers
+		}
+	}
 	if err := mi.Info.BuildFromFilePath(filename); err != nil {
 		return nil, err
 	}
@@ -103,47 +125,100 @@ func (mi *Notification) Write(w io.Writer) error {
 	return err
 }
 
-// Sign signs the Notification using given private key file.
+// Sign signs the Notification using given RSA, ECDSA P-256 or Ed25519
+// private key.
 // Reference: https://stackoverflow.com/questions/10782826/digital-signature-for-a-file-using-openssl
-func (mi *Notification) Sign(key *rsa.PrivateKey) error {
-	var (
-		data, sig []byte
-		err       error
-	)
-
+func (mi *Notification) Sign(key crypto.Signer) error {
 	mi.Signatures = nil
-	if data, err = json.Marshal(mi); err != nil {
+	return mi.addSignatures(key, "")
+}
+
+// CoSign adds the signatures of given private key to the Notification,
+// which are named after the ID of the key. The other signatures are kept, so
+// the Notification can be signed by several keys of a Keyring.
+func (mi *Notification) CoSign(key crypto.Signer) error {
+	id, err := keyID(key.Public())
+	if err != nil {
 		return err
 	}
-	hashed := sha256.Sum256(data)
-	sig, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hashed[:])
+	return mi.addSignatures(key, signatureKeySeparator+id)
+}
+
+// addSignatures adds the signature and the compact signature of given
+// private key, whose names have given suffix.
+func (mi *Notification) addSignatures(key crypto.Signer, suffix string) error {
+	hashed, err := mi.hashed(signatureFormatBencode)
+	if err != nil {
+		return err
+	}
+	sig, err := signHashed(key, hashed)
+	if err != nil {
+		return err
+	}
+	sig.Format = signatureFormatBencode
+	// the compact signature lets the peers verify the compact form
+	cn, err := mi.compact()
 	if err != nil {
 		return err
 	}
-	mi.Signatures = make(map[string]Signature)
-	mi.Signatures[signatureName] = Signature{
-		Signature: sig,
+	csig, err := cn.sign(key)
+	if err != nil {
+		return err
 	}
+	if mi.Signatures == nil {
+		mi.Signatures = make(map[string]Signature)
+	}
+	mi.Signatures[signatureName+suffix] = sig
+	mi.Signatures[compactSignatureName+suffix] = csig
 	return nil
 }
 
-// Verify verifies the Notification's signature using given public key file
-// Reference: https://stackoverflow.com/questions/10782826/digital-signature-for-a-file-using-openssl
-func (mi *Notification) Verify(pub *rsa.PublicKey) error {
+// hashed returns the SHA-256 hash of the signed payload of the Notification
+// in given signature format.
+func (mi *Notification) hashed(format int) ([]byte, error) {
 	var (
 		data []byte
 		err  error
 	)
+	unsigned := *mi
+	unsigned.Signatures = nil
+	switch format {
+	case signatureFormatJSON:
+		data, err = json.Marshal(&unsigned)
+	case signatureFormatBencode:
+		data, err = bencode.EncodeBytes(unsigned)
+	default:
+		return nil, fmt.Errorf("unsupported signature format %d", format)
+	}
+	if err != nil {
+		return nil, err
+	}
+	hashed := sha256.Sum256(data)
+	return hashed[:], nil
+}
 
-	if s, ok := mi.Signatures[signatureName]; ok {
-		sigs := mi.Signatures
-		mi.Signatures = nil
-		if data, err = json.Marshal(mi); err == nil {
-			hashed := sha256.Sum256(data)
-			err = rsa.VerifyPKCS1v15(pub, crypto.SHA256, hashed[:], s.Signature)
+// Verify verifies the Notification's signatures using given keyring, or
+// the keyring's root keys if it is a keyring notification.
+// Reference: https://stackoverflow.com/questions/10782826/digital-signature-for-a-file-using-openssl
+func (mi *Notification) Verify(kr *Keyring) error {
+	if mi.UUID == UUIDKeyring {
+		return mi.verifyKeyringChange(kr)
+	}
+	if hasSignature(mi.Signatures, signatureName) {
+		return kr.verify(mi.Signatures, signatureName, mi.hashed)
+	}
+	// a Notification of a compact notification only has the compact
+	// signatures, which cover the info-hash of its info dictionary but not
+	// the other fields, so these must be empty
+	if hasSignature(mi.Signatures, compactSignatureName) {
+		if !mi.coveredByCompact() {
+			return fmt.Errorf("notification has fields that are not covered by the compact signature")
 		}
-		mi.Signatures = sigs
-		return err
+		cn, err := mi.compact()
+		if err != nil {
+			return err
+		}
+		return cn.Verify(kr)
 	}
 	return fmt.Errorf("signature is not available")
 }
@@ -152,7 +227,9 @@ func (mi *Notification) Verify(pub *rsa.PublicKey) error {
 func (mi *Notification) torrentMetainfo() (*metainfo.MetaInfo, error) {
 	mm := metainfo.MetaInfo{
 		Announce:     mi.Announce,
+		AnnounceList: mi.AnnounceList,
 		Nodes:        mi.Nodes,
+		UrlList:      mi.URLList,
 		CreationDate: mi.CreationDate,
 		CreatedBy:    mi.CreatedBy,
 		Encoding:     mi.Encoding,
@@ -164,6 +241,15 @@ func (mi *Notification) torrentMetainfo() (*metainfo.MetaInfo, error) {
 	return &mm, nil
 }
 
+// infoHash returns the BitTorrent info-hash of the Notification.
+func (mi *Notification) infoHash() (metainfo.Hash, error) {
+	mm, err := mi.torrentMetainfo()
+	if err != nil {
+		return metainfo.Hash{}, err
+	}
+	return mm.HashInfoBytes(), nil
+}
+
 const minPieceLength = 32768
 
 // PieceLength calculates the length of each file-piece where the size of file
@@ -8,6 +8,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"math/rand"
 	"net"
 	"sync"
 	"time"
@@ -22,6 +23,12 @@ var (
 	errBufferFull    = errors.New("data buffer is full")
 )
 
+// peerData is a message sent by a peer.
+type peerData struct {
+	pid  PeerID
+	data []byte
+}
+
 type overlayUDPConn struct {
 	conn           *net.UDPConn
 	rendezvousAddr *net.UDPAddr
@@ -76,8 +83,32 @@ type OverlayConfig struct {
 	ListeningBufferSize int           `json:"listening-buffer-size"`
 	ErrorBackoff        time.Duration `json:"error-backoff"`
 	ChannelLifespan     time.Duration `json:"channel-lifespan"`
+	TransferWait        time.Duration `json:"transfer-wait"`
+	TransferMaxErrors   int           `json:"transfer-max-errors"`
+	GossipFanout        int           `json:"gossip-fanout"`
+	GossipTTL           int           `json:"gossip-ttl"`
+	GossipCacheSize     int           `json:"gossip-cache-size"`
+	GossipCacheLifespan time.Duration `json:"gossip-cache-lifespan"`
+	PeerLifetime        time.Duration `json:"peer-lifetime"`
+	Relay               bool          `json:"relay"`
+	RelayTimeout        time.Duration `json:"relay-timeout"`
+	PunchTimeout        time.Duration `json:"punch-timeout"`
+	PunchRetry          time.Duration `json:"punch-retry"`
+	Acknowledged        bool          `json:"acknowledged"`
+	AckWait             time.Duration `json:"ack-wait"`
+	AckMaxRetries       int           `json:"ack-max-retries"`
+	PEXInterval         time.Duration `json:"pex-interval"`
+
+	// CompactNotifications=true means notifications are gossiped in
+	// the compact form, whose info dictionaries are fetched from the peers
+	CompactNotifications bool `json:"compact-notifications"`
 
 	torrentPorts TorrentPorts
+	peersFile    string
+
+	// peersAdded is called with the peers that have been added to
+	// the session table
+	peersAdded func([]PeerID)
 }
 
 // OverlayConn is an implementation of net.Conn interface for a overlay network
@@ -104,7 +135,14 @@ type OverlayConn struct {
 	msg            []byte
 	senderAddr     *net.UDPAddr
 	peers          SessionTable
-	peerDataChan   chan []byte
+	peersSeen      LastSeenTable
+	peersDirect    LastSeenTable
+	connectivity   map[PeerID]peerConnectivity
+	punched        LastSeenTable
+	relayExpired   time.Time
+	topics         *overlayTopics
+	transfers      *overlayTransfers
+	acked          *gossipCache
 
 	readDeadline  *time.Time
 	writeDeadline *time.Time
@@ -141,7 +179,19 @@ func NewOverlayConn(cfg OverlayConfig) (*OverlayConn, error) {
 		rendezvousAddr: serverAddr,
 		localAddr:      localAddr,
 		peers:          make(SessionTable),
-		peerDataChan:   make(chan []byte, 16),
+		peersSeen:      make(LastSeenTable),
+		peersDirect:    make(LastSeenTable),
+		connectivity:   make(map[PeerID]peerConnectivity),
+		punched:        make(LastSeenTable),
+		topics:         newOverlayTopics(),
+		transfers:      newOverlayTransfers(),
+		acked:          newGossipCache(1024, 2*cfg.AckWait*time.Second<<uint(cfg.AckMaxRetries)),
+	}
+	if err = overlay.loadPeers(); err != nil {
+		log.Printf("WARNING: %v", err)
+	}
+	if err = overlay.Subscribe(topicPEX, overlay.receivePeers); err != nil {
+		return nil, err
 	}
 	overlay.createAutomata()
 	overlay.automata.Event(eventOpen)
@@ -163,6 +213,9 @@ func NewOverlayConn(cfg OverlayConfig) (*OverlayConn, error) {
 	overlay.stopSendingKeepAlive = ExecEvery(
 		time.Duration(cfg.ChannelLifespan)*time.Second,
 		overlay.sendKeepAlive(msg))
+	if cfg.PEXInterval > 0 {
+		ExecEvery(cfg.PEXInterval*time.Second, overlay.exchangePeers)
+	}
 
 	return overlay, nil
 }
@@ -180,6 +233,7 @@ func (overlay *OverlayConn) createAutomata() {
 			Transition{Src: stateBinding, Event: eventError, Dest: stateBindError},
 			Transition{Src: stateBindError, Event: eventUnderLimit, Dest: stateOpened},
 			Transition{Src: stateBindError, Event: eventOverLimit, Dest: stateClosed},
+			Transition{Src: stateBindError, Event: eventDetached, Dest: stateListening},
 			Transition{Src: stateListening, Event: eventClose, Dest: stateClosed},
 			Transition{Src: stateListening, Event: eventSuccess, Dest: stateProcessingMessage},
 			Transition{Src: stateListening, Event: eventError, Dest: stateMessageError},
@@ -332,6 +386,17 @@ func (overlay *OverlayConn) bindError([]interface{}) {
 	overlay.errCount++
 	if overlay.errCount >= overlay.Config.BindingMaxErrors {
 		overlay.errCount = 0
+		overlay.RLock()
+		detached := overlay.conn != nil && overlay.knowsPeers()
+		overlay.RUnlock()
+		if detached {
+			// keep listening to the known peers until the channel expires,
+			// then try binding to the server again
+			log.Println("server is unreachable, listening to known peers")
+			overlay.channelExpired = time.Now().Add(overlay.Config.ChannelLifespan * time.Second)
+			overlay.automata.Event(eventDetached)
+			return
+		}
 		time.Sleep(overlay.Config.ErrorBackoff * time.Second)
 		overlay.automata.Event(eventOverLimit)
 	} else {
@@ -393,6 +458,8 @@ func (overlay *OverlayConn) processingMessage([]interface{}) {
 		overlay.automata.Event(eventError)
 		return
 	}
+	overlay.touchPeer(*pid, !overlay.senderAddr.IP.Equal(overlay.rendezvousAddr.IP) ||
+		overlay.senderAddr.Port != overlay.rendezvousAddr.Port)
 
 	err = fmt.Errorf("!! %s[%s] sent a bad message - type:%v", pid, overlay.senderAddr, req.Type)
 	switch req.Type.Method {
@@ -405,6 +472,26 @@ func (overlay *OverlayConn) processingMessage([]interface{}) {
 		switch req.Type.Class {
 		case stun.ClassIndication:
 			err = overlay.peerDataIndication(pid, overlay.senderAddr, &req)
+		case stun.ClassSuccessResponse:
+			overlay.transfers.deliver(transactionID(req.TransactionID), &req)
+			err = nil
+		}
+	case stun.MethodSend:
+		switch req.Type.Class {
+		case stun.ClassIndication:
+			err = overlay.peerSendIndication(pid, overlay.senderAddr, &req)
+		}
+	case stun.MethodAllocate:
+		switch req.Type.Class {
+		case stun.ClassSuccessResponse, stun.ClassErrorResponse:
+			err = overlay.relayAllocated(&req)
+		}
+	case methodConnect:
+		switch req.Type.Class {
+		case stun.ClassIndication:
+			err = overlay.punch(&req)
+		case stun.ClassErrorResponse:
+			err = overlay.connectFailed(&req)
 		}
 	case stun.MethodChannelBind:
 		switch req.Type.Class {
@@ -423,7 +510,6 @@ func (overlay *OverlayConn) processingMessage([]interface{}) {
 }
 
 func (overlay *OverlayConn) peerDataIndication(pid *PeerID, addr *net.UDPAddr, req *stun.Message) error {
-	// TODO: handle multi-packets payload
 	var (
 		data []byte
 		err  error
@@ -432,12 +518,25 @@ func (overlay *OverlayConn) peerDataIndication(pid *PeerID, addr *net.UDPAddr, r
 	if data, err = req.Get(stun.AttrData); err != nil {
 		return fmt.Errorf("%s[%s] sent an invalid data request", pid, addr)
 	}
-	select {
-	case overlay.peerDataChan <- data:
-		return nil
-	default:
-		return errBufferFull
+	ack := req.Contains(attrAckRequest)
+	key := ackKey(*pid, req)
+	if ack && !overlay.acked.add(key) {
+		// our acknowledgement was lost
+		return overlay.ackDataIndication(*pid, req)
 	}
+	if err = overlay.dispatch(*pid, data); err == errBufferFull {
+		// let the sender retry once the buffer has been consumed
+		if ack {
+			overlay.acked.remove(key)
+		}
+		return err
+	} else if err != nil {
+		log.Println(err)
+	}
+	if ack {
+		return overlay.ackDataIndication(*pid, req)
+	}
+	return nil
 }
 
 func (overlay *OverlayConn) updateSessionTable(req *stun.Message) error {
@@ -445,17 +544,75 @@ func (overlay *OverlayConn) updateSessionTable(req *stun.Message) error {
 	if err != nil {
 		return errors.Wrap(err, "updateSessionTable - failed getting session table from message")
 	}
+	var added []PeerID
 	overlay.Lock()
+	// deferred calls run in reverse order, so the handler is called
+	// after the lock is released
+	defer func() { overlay.peersAdded(added) }()
 	defer overlay.Unlock()
+	now := time.Now()
 	for id, sess := range *st {
-		overlay.peers[id] = sess
+		if len(sess) == 0 {
+			log.Printf("peer %s has been removed", id)
+			delete(overlay.peers, id)
+			delete(overlay.peersSeen, id)
+			delete(overlay.peersDirect, id)
+			delete(overlay.connectivity, id)
+			delete(overlay.punched, id)
+		} else {
+			if _, ok := overlay.peers[id]; !ok {
+				// give the new peer RelayTimeout to be reached directly
+				overlay.peersDirect[id] = now
+				if id != overlay.ID {
+					added = append(added, id)
+				}
+			}
+			overlay.peers[id] = sess
+			overlay.peersSeen[id] = now
+		}
 	}
 	return nil
 }
 
+// touchPeer updates the last seen time of given peer if it is in
+// the session table. `direct` is false if the message was relayed.
+func (overlay *OverlayConn) touchPeer(pid PeerID, direct bool) {
+	overlay.Lock()
+	defer overlay.Unlock()
+	if _, ok := overlay.peers[pid]; ok {
+		overlay.peersSeen[pid] = time.Now()
+		if direct {
+			overlay.peersDirect[pid] = time.Now()
+			if overlay.connectivity[pid] != connectivityDirect {
+				log.Printf("peer %s is reached directly", pid)
+				overlay.connectivity[pid] = connectivityDirect
+			}
+		}
+	}
+}
+
+// expirePeers removes peers that have not been seen within PeerLifetime.
+func (overlay *OverlayConn) expirePeers() {
+	overlay.Lock()
+	defer overlay.Unlock()
+	for _, id := range overlay.peersSeen.Expired(overlay.Config.PeerLifetime * time.Second) {
+		log.Printf("peer %s has expired", id)
+		delete(overlay.peers, id)
+		delete(overlay.peersSeen, id)
+		delete(overlay.peersDirect, id)
+		delete(overlay.connectivity, id)
+		delete(overlay.punched, id)
+	}
+}
+
 func (overlay *OverlayConn) sendKeepAlive(msg *stun.Message) func() {
 	return func() {
 		log.Println("sending keep alive packet")
+		overlay.expirePeers()
+		if err := overlay.savePeers(); err != nil {
+			log.Printf("WARNING: %v", err)
+		}
+		overlay.coordinatePunching()
 		overlay.RLock()
 		defer overlay.RUnlock()
 		if overlay.conn == nil {
@@ -470,15 +627,17 @@ func (overlay *OverlayConn) sendKeepAlive(msg *stun.Message) func() {
 		state := overlay.automata.Current()
 		switch state {
 		case stateListening, stateProcessingMessage, stateMessageError:
+			if overlay.relayNeeded() {
+				if err := overlay.requestRelay(); err != nil {
+					log.Printf("WARNING: failed requesting relay - %v", err)
+				}
+			}
+			// keep punching holes even if the peers are relayed
 			for id, addrs := range overlay.peers {
 				if id == overlay.ID {
 					continue
 				}
-				addr := addrs[0]
-				if addr.IP.Equal(overlay.externalAddr.IP) {
-					addr = addrs[1]
-				}
-				_, err := overlay.conn.conn.WriteToUDP(msg.Raw, addr)
+				_, err := overlay.conn.conn.WriteToUDP(msg.Raw, overlay.peerAddr(addrs))
 				if err != nil {
 					log.Printf("WARNING: failed binding channel to %s[%s][%s] - %v",
 						id, addrs[0].String(), addrs[1].String(), err)
@@ -513,19 +672,28 @@ func (overlay *OverlayConn) Ready() bool {
 
 // ReadMsg returns a multicast message sent by other peer.
 func (overlay *OverlayConn) ReadMsg() ([]byte, error) {
+	data, _, err := overlay.ReadMsgFrom()
+	return data, err
+}
+
+// ReadMsgFrom returns a multicast message of the default topic and the ID of
+// the peer who sent it. Messages of other topics are passed to their handlers.
+func (overlay *OverlayConn) ReadMsgFrom() ([]byte, PeerID, error) {
 	if !overlay.Ready() {
-		return nil, errNotReady
+		return nil, PeerID{}, errNotReady
 	}
+	c, _ := overlay.topics.channel(topicDefault)
 	deadline := overlay.readDeadline
 	if deadline == nil {
-		return <-overlay.peerDataChan, nil
+		pd := <-c
+		return pd.data, pd.pid, nil
 	}
 	select {
-	case data := <-overlay.peerDataChan:
-		return data, nil
+	case pd := <-c:
+		return pd.data, pd.pid, nil
 	case <-time.After(deadline.Sub(time.Now())):
 	}
-	return nil, errNotReady
+	return nil, PeerID{}, errNotReady
 }
 
 // Read reads a multicast message sent by other
@@ -538,18 +706,20 @@ func (overlay *OverlayConn) Read(b []byte) (int, error) {
 	}
 
 	var (
-		data     []byte
+		pd       peerData
 		deadline = overlay.readDeadline
+		c, _     = overlay.topics.channel(topicDefault)
 	)
 
 	if deadline == nil {
-		data = <-overlay.peerDataChan
+		pd = <-c
 	} else {
 		select {
-		case data = <-overlay.peerDataChan:
+		case pd = <-c:
 		case <-time.After(deadline.Sub(time.Now())):
 		}
 	}
+	data := pd.data
 	if len(data) > len(b) {
 		return copy(b, data),
 			fmt.Errorf("data (%d bytes) is not fit on given buffer 'b'", len(data))
@@ -557,19 +727,34 @@ func (overlay *OverlayConn) Read(b []byte) (int, error) {
 	return copy(b, data), nil
 }
 
-// Write sends a multicast message to other nodes
-// TODO: handle multi-packets payload
+// Write sends a multicast message to other nodes.
 func (overlay *OverlayConn) Write(b []byte) (int, error) {
-	if len(b) > stunMaxPacketDataSize {
-		return 0, fmt.Errorf("data is too large, maximum %d bytes",
-			stunMaxPacketDataSize)
-	}
+	return overlay.WriteMsgTo(b, nil)
+}
+
+// WriteMsgTo sends a message of the default topic to given peers, or to all
+// peers when `pids` is nil.
+func (overlay *OverlayConn) WriteMsgTo(b []byte, pids []PeerID) (int, error) {
+	return overlay.WriteTopicTo(topicDefault, b, pids)
+}
 
+// writeFrameTo sends a framed message to given peers, or to all peers when
+// `pids` is nil. A message larger than stunMaxPacketDataSize is sent as
+// a multi-packets message.
+func (overlay *OverlayConn) writeFrameTo(b []byte, pids []PeerID) (int, error) {
 	// TODO: apply writeDeadline
 	current := overlay.automata.Current()
 	switch current {
 	case stateListening, stateProcessingMessage:
-		if _, err := overlay.multicastMessage(b); err != nil {
+		var err error
+		if overlay.Config.Acknowledged {
+			return overlay.deliverFrameTo(b, pids, nil)
+		} else if len(b) > stunMaxPacketDataSize {
+			_, err = overlay.multicastMultiPackets(b, pids)
+		} else {
+			_, err = overlay.multicastMessage(b, pids)
+		}
+		if err != nil {
 			return 0, err
 		}
 		return len(b), nil
@@ -578,11 +763,10 @@ func (overlay *OverlayConn) Write(b []byte) (int, error) {
 	}
 }
 
-func (overlay *OverlayConn) multicastMessage(data PeerMessage) (int, error) {
+func (overlay *OverlayConn) multicastMessage(data PeerMessage, pids []PeerID) (int, error) {
 	var (
-		msg  *stun.Message
-		addr *net.UDPAddr
-		err  error
+		msg *stun.Message
+		err error
 	)
 
 	msg, err = stun.Build(
@@ -599,15 +783,9 @@ func (overlay *OverlayConn) multicastMessage(data PeerMessage) (int, error) {
 
 	overlay.RLock()
 	defer overlay.RUnlock()
-	for id, addrs := range overlay.peers {
-		if id == overlay.ID {
-			continue
-		}
-		if addr = addrs[0]; addr.IP.Equal(overlay.externalAddr.IP) {
-			addr = addrs[1]
-		}
+	for id, addrs := range overlay.sessions(pids) {
 		if err == nil {
-			_, err = overlay.conn.conn.WriteTo(msg.Raw, addr)
+			err = overlay.writeToPeer(msg.Raw, id, addrs)
 		}
 		if err != nil {
 			log.Printf("WARNING: failed sending data request to %s[%s][%s] - %v",
@@ -620,6 +798,63 @@ func (overlay *OverlayConn) multicastMessage(data PeerMessage) (int, error) {
 	return len(data), nil
 }
 
+// sessions returns the sessions of given peers, or all peers when `pids` is nil,
+// excluding this overlay. The caller must hold the lock.
+func (overlay *OverlayConn) sessions(pids []PeerID) SessionTable {
+	st := make(SessionTable)
+	if pids == nil {
+		for id, addrs := range overlay.peers {
+			st[id] = addrs
+		}
+	} else {
+		for _, id := range pids {
+			if addrs, ok := overlay.peers[id]; ok {
+				st[id] = addrs
+			}
+		}
+	}
+	delete(st, overlay.ID)
+	return st
+}
+
+// RandomPeers returns at most `n` IDs of peers that are randomly selected from
+// the session table, excluding this overlay and given `exclude` peers.
+func (overlay *OverlayConn) RandomPeers(n int, exclude ...PeerID) []PeerID {
+	overlay.RLock()
+	defer overlay.RUnlock()
+
+	pids := make([]PeerID, 0, len(overlay.peers))
+	for id := range overlay.sessions(nil) {
+		pids = append(pids, id)
+	}
+	for _, x := range exclude {
+		for i, id := range pids {
+			if id == x {
+				pids = append(pids[:i], pids[i+1:]...)
+				break
+			}
+		}
+	}
+	if n > len(pids) {
+		n = len(pids)
+	}
+	selected := make([]PeerID, n)
+	for i, j := range rand.Perm(len(pids))[:n] {
+		selected[i] = pids[j]
+	}
+	return selected
+}
+
+// peerAddr returns the address that should be used to reach a peer, which is
+// the internal address when the peer is behind the same NAT, otherwise
+// the external address.
+func (overlay *OverlayConn) peerAddr(addrs Session) *net.UDPAddr {
+	if overlay.externalAddr != nil && addrs[0].IP.Equal(overlay.externalAddr.IP) {
+		return addrs[1]
+	}
+	return addrs[0]
+}
+
 // Close closes the overlay.
 func (overlay *OverlayConn) Close() error {
 	return overlay.automata.Event(eventClose)
@@ -0,0 +1,558 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gortc/stun"
+	"github.com/pkg/errors"
+)
+
+// Attributes of multi-packets messages, taken from comprehension-optional range.
+const (
+	attrTransferStage    stun.AttrType = 0x8030
+	attrSequence         stun.AttrType = 0x8031
+	attrTotalSequences   stun.AttrType = 0x8032
+	attrMissingSequences stun.AttrType = 0x8033
+)
+
+const (
+	// stunSequenceDataSize is the payload size of each sequence of
+	// a multi-packets message.
+	stunSequenceDataSize = 8 * 1024
+
+	// maxTransferSequences is the maximum number of sequences of
+	// a multi-packets message.
+	maxTransferSequences = 4096
+
+	// maxInboundTransfers is the maximum number of multi-packets messages
+	// that are being received at the same time.
+	maxInboundTransfers = 32
+
+	// maxPeerInboundTransfers is the maximum number of multi-packets
+	// messages that are being received from a peer at the same time.
+	maxPeerInboundTransfers = 4
+)
+
+var (
+	errTransferTimeout  = errors.New("transfer timeout")
+	errTransferTooLarge = errors.New("data is too large for a multi-packets message")
+)
+
+// transferStage is a set of flags that marks the stage of a multi-packets
+// message transfer (see 'Multi UDP-Packets Message' in diagrams.md).
+type transferStage byte
+
+const (
+	stageSendReq transferStage = 1 << iota
+	stageSendAck
+	stageSendReady
+	stageDataPost
+	stageDataError
+	stageDataSuccess
+)
+
+func (s transferStage) String() string {
+	switch s {
+	case stageSendReq:
+		return "SendReq"
+	case stageSendReq | stageSendAck:
+		return "SendReq,SendAck"
+	case stageSendAck:
+		return "SendAck"
+	case stageSendReady:
+		return "SendReady"
+	case stageDataPost:
+		return "DataPost"
+	case stageDataError:
+		return "DataError"
+	case stageDataSuccess:
+		return "DataSuccess"
+	}
+	return "undefined"
+}
+
+// AddTo writes the transfer stage on given STUN message.
+func (s transferStage) AddTo(m *stun.Message) error {
+	m.Add(attrTransferStage, []byte{byte(s)})
+	return nil
+}
+
+// GetFrom reads the transfer stage from given STUN message.
+func (s *transferStage) GetFrom(m *stun.Message) error {
+	b, err := m.Get(attrTransferStage)
+	if err != nil {
+		return err
+	} else if len(b) != 1 {
+		return fmt.Errorf("length of transfer stage (%d bytes) is not 1 byte", len(b))
+	}
+	*s = transferStage(b[0])
+	return nil
+}
+
+// transferSequence is the sequence number of a DataPost packet.
+type transferSequence uint32
+
+// AddTo writes the sequence number on given STUN message.
+func (seq transferSequence) AddTo(m *stun.Message) error {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, uint32(seq))
+	m.Add(attrSequence, b)
+	return nil
+}
+
+// GetFrom reads the sequence number from given STUN message.
+func (seq *transferSequence) GetFrom(m *stun.Message) error {
+	b, err := m.Get(attrSequence)
+	if err != nil {
+		return err
+	} else if len(b) != 4 {
+		return fmt.Errorf("length of sequence (%d bytes) is not 4 bytes", len(b))
+	}
+	*seq = transferSequence(binary.BigEndian.Uint32(b))
+	return nil
+}
+
+// totalSequences is the number of sequences of a multi-packets message.
+type totalSequences uint32
+
+// AddTo writes the total sequences on given STUN message.
+func (total totalSequences) AddTo(m *stun.Message) error {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, uint32(total))
+	m.Add(attrTotalSequences, b)
+	return nil
+}
+
+// GetFrom reads the total sequences from given STUN message.
+func (total *totalSequences) GetFrom(m *stun.Message) error {
+	b, err := m.Get(attrTotalSequences)
+	if err != nil {
+		return err
+	} else if len(b) != 4 {
+		return fmt.Errorf("length of total sequences (%d bytes) is not 4 bytes", len(b))
+	}
+	*total = totalSequences(binary.BigEndian.Uint32(b))
+	return nil
+}
+
+// missingSequences holds the sequence numbers that have not been received.
+type missingSequences []uint32
+
+// AddTo writes the missing sequences on given STUN message.
+func (ms missingSequences) AddTo(m *stun.Message) error {
+	b := make([]byte, 4*len(ms))
+	for i, seq := range ms {
+		binary.BigEndian.PutUint32(b[4*i:], seq)
+	}
+	m.Add(attrMissingSequences, b)
+	return nil
+}
+
+// GetFrom reads the missing sequences from given STUN message.
+func (ms *missingSequences) GetFrom(m *stun.Message) error {
+	b, err := m.Get(attrMissingSequences)
+	if err != nil {
+		return err
+	} else if len(b)%4 != 0 {
+		return fmt.Errorf("length of missing sequences (%d bytes) is not multiple of 4", len(b))
+	}
+	*ms = make(missingSequences, len(b)/4)
+	for i := range *ms {
+		(*ms)[i] = binary.BigEndian.Uint32(b[4*i:])
+	}
+	return nil
+}
+
+type transactionID [stun.TransactionIDSize]byte
+
+type transferKey struct {
+	pid PeerID
+	tid transactionID
+}
+
+// inboundTransfer holds the sequences of a multi-packets message that is
+// being received from a peer.
+type inboundTransfer struct {
+	seqs     [][]byte
+	received int
+	done     bool
+	updated  time.Time
+}
+
+func (t *inboundTransfer) missing() missingSequences {
+	ms := make(missingSequences, 0, len(t.seqs)-t.received)
+	for i, seq := range t.seqs {
+		if seq == nil {
+			ms = append(ms, uint32(i))
+		}
+	}
+	return ms
+}
+
+func (t *inboundTransfer) payload() []byte {
+	size := 0
+	for _, seq := range t.seqs {
+		size += len(seq)
+	}
+	data := make([]byte, 0, size)
+	for _, seq := range t.seqs {
+		data = append(data, seq...)
+	}
+	return data
+}
+
+// overlayTransfers holds the states of multi-packets messages that are
+// being sent or received by an OverlayConn.
+type overlayTransfers struct {
+	sync.Mutex
+
+	// inbound is only accessed by the automata's goroutine
+	inbound  map[transferKey]*inboundTransfer
+	outbound map[transactionID]chan *stun.Message
+}
+
+func newOverlayTransfers() *overlayTransfers {
+	return &overlayTransfers{
+		inbound:  make(map[transferKey]*inboundTransfer),
+		outbound: make(map[transactionID]chan *stun.Message),
+	}
+}
+
+func (ts *overlayTransfers) open(tid transactionID) chan *stun.Message {
+	ts.Lock()
+	defer ts.Unlock()
+	c := make(chan *stun.Message, 4)
+	ts.outbound[tid] = c
+	return c
+}
+
+func (ts *overlayTransfers) close(tid transactionID) {
+	ts.Lock()
+	defer ts.Unlock()
+	delete(ts.outbound, tid)
+}
+
+func (ts *overlayTransfers) deliver(tid transactionID, m *stun.Message) bool {
+	ts.Lock()
+	defer ts.Unlock()
+	c, ok := ts.outbound[tid]
+	if !ok {
+		return false
+	}
+	select {
+	case c <- m:
+	default:
+	}
+	return true
+}
+
+func (ts *overlayTransfers) prune(lifetime time.Duration) {
+	expired := time.Now().Add(-lifetime)
+	for key, t := range ts.inbound {
+		if t.updated.Before(expired) {
+			delete(ts.inbound, key)
+		}
+	}
+}
+
+// full returns true if no more inbound transfers can be opened for given
+// peer, because the peer or all peers have reached the maximum number of
+// incomplete transfers.
+func (ts *overlayTransfers) full(pid PeerID) bool {
+	total, peer := 0, 0
+	for key, t := range ts.inbound {
+		if t.done {
+			continue
+		}
+		total++
+		if key.pid == pid {
+			peer++
+		}
+	}
+	return total >= maxInboundTransfers || peer >= maxPeerInboundTransfers
+}
+
+func (overlay *OverlayConn) transferWait() time.Duration {
+	return overlay.Config.TransferWait * time.Second
+}
+
+func (overlay *OverlayConn) transferLifetime() time.Duration {
+	return 2 * time.Duration(overlay.Config.TransferMaxErrors) * overlay.transferWait()
+}
+
+// writeTransferMessage sends a multi-packets message's packet to given peer,
+// or to given address if the peer is not in the session table.
+func (overlay *OverlayConn) writeTransferMessage(pid PeerID, addr *net.UDPAddr, tid transactionID, setters ...stun.Setter) error {
+	setters = append([]stun.Setter{
+		stun.NewTransactionIDSetter(tid),
+		stunSendIndication,
+		&overlay.ID,
+	}, setters...)
+	setters = append(setters,
+		stun.NewShortTermIntegrity(overlay.Config.StunPassword),
+		stun.Fingerprint,
+	)
+	msg, err := stun.Build(setters...)
+	if err != nil {
+		return errors.Wrap(err, "failed building multi-packets message")
+	}
+
+	overlay.RLock()
+	defer overlay.RUnlock()
+	if overlay.conn == nil {
+		return errConnNotOpened
+	}
+	if addrs, ok := overlay.peers[pid]; ok {
+		return overlay.writeToPeer(msg.Raw, pid, addrs)
+	}
+	_, err = overlay.conn.conn.WriteToUDP(msg.Raw, addr)
+	return err
+}
+
+// peerSendIndication handles a packet of multi-packets message. The packets of
+// the receiver are processed here, while the replies of the sender are passed
+// to the goroutine that is sending the message.
+func (overlay *OverlayConn) peerSendIndication(pid *PeerID, addr *net.UDPAddr, req *stun.Message) error {
+	var (
+		stage transferStage
+		tid   = transactionID(req.TransactionID)
+	)
+
+	if err := stage.GetFrom(req); err != nil {
+		return fmt.Errorf("%s[%s] sent an invalid send indication: %v", pid, addr, err)
+	}
+	switch stage {
+	case stageSendReq:
+		overlay.transfers.prune(overlay.transferLifetime())
+		if _, ok := overlay.transfers.inbound[transferKey{*pid, tid}]; !ok && overlay.transfers.full(*pid) {
+			return fmt.Errorf("%s[%s] sent SendReq over the limit of open transfers", pid, addr)
+		}
+		return overlay.writeTransferMessage(*pid, addr, tid, stageSendReq|stageSendAck)
+	case stageSendAck:
+		return overlay.receiveTransferStart(transferKey{*pid, tid}, addr, req)
+	case stageDataPost:
+		return overlay.receiveTransferData(transferKey{*pid, tid}, addr, req)
+	case stageSendReq | stageSendAck, stageSendReady, stageDataError, stageDataSuccess:
+		if !overlay.transfers.deliver(tid, req) {
+			log.Printf("<- %s[%s] sent %s of unknown transfer", pid, addr, stage)
+		}
+		return nil
+	}
+	return fmt.Errorf("%s[%s] sent an unknown transfer stage: %d", pid, addr, stage)
+}
+
+func (overlay *OverlayConn) receiveTransferStart(key transferKey, addr *net.UDPAddr, req *stun.Message) error {
+	var total totalSequences
+
+	if err := total.GetFrom(req); err != nil {
+		return fmt.Errorf("%s[%s] sent SendAck without total sequences: %v", key.pid, addr, err)
+	} else if total == 0 || total > maxTransferSequences {
+		return fmt.Errorf("%s[%s] sent SendAck with invalid total sequences: %d", key.pid, addr, total)
+	}
+
+	overlay.transfers.prune(overlay.transferLifetime())
+	if _, ok := overlay.transfers.inbound[key]; !ok {
+		if overlay.transfers.full(key.pid) {
+			return fmt.Errorf("%s[%s] sent SendAck over the limit of open transfers", key.pid, addr)
+		}
+		overlay.transfers.inbound[key] = &inboundTransfer{
+			seqs:    make([][]byte, total),
+			updated: time.Now(),
+		}
+	}
+	return overlay.writeTransferMessage(key.pid, addr, key.tid, stageSendReady, total)
+}
+
+func (overlay *OverlayConn) receiveTransferData(key transferKey, addr *net.UDPAddr, req *stun.Message) error {
+	var (
+		seq  transferSequence
+		data []byte
+		err  error
+	)
+
+	t, ok := overlay.transfers.inbound[key]
+	if !ok {
+		log.Printf("<- %s[%s] sent DataPost of unknown transfer", key.pid, addr)
+		return nil
+	} else if t.done {
+		// our DataSuccess was lost
+		return overlay.writeTransferMessage(key.pid, addr, key.tid, stageDataSuccess)
+	}
+
+	if err = seq.GetFrom(req); err != nil {
+		return fmt.Errorf("%s[%s] sent DataPost without sequence: %v", key.pid, addr, err)
+	} else if int(seq) >= len(t.seqs) {
+		return fmt.Errorf("%s[%s] sent DataPost with invalid sequence: %d", key.pid, addr, seq)
+	} else if data, err = req.Get(stun.AttrData); err != nil {
+		return fmt.Errorf("%s[%s] sent DataPost without data: %v", key.pid, addr, err)
+	}
+	if t.seqs[seq] == nil {
+		t.seqs[seq] = data
+		t.received++
+	}
+	t.updated = time.Now()
+
+	if t.received == len(t.seqs) {
+		if err = overlay.dispatch(key.pid, t.payload()); err == errBufferFull {
+			// let the sender retry once the buffer has been consumed
+			return err
+		} else if err != nil {
+			log.Println(err)
+		}
+		t.seqs, t.done = nil, true
+		return overlay.writeTransferMessage(key.pid, addr, key.tid, stageDataSuccess)
+	}
+
+	// the last DataPost of every round carries the total sequences
+	if req.Contains(attrTotalSequences) {
+		return overlay.writeTransferMessage(key.pid, addr, key.tid, stageDataError, t.missing())
+	}
+	return nil
+}
+
+// awaitTransfer waits until the receiver replies with one of given stages.
+func (overlay *OverlayConn) awaitTransfer(c chan *stun.Message, stages ...transferStage) (*stun.Message, transferStage, error) {
+	timeout := time.After(overlay.transferWait())
+	for {
+		select {
+		case res := <-c:
+			var stage transferStage
+			if err := stage.GetFrom(res); err != nil {
+				continue
+			}
+			for _, s := range stages {
+				if s == stage {
+					return res, stage, nil
+				}
+			}
+		case <-timeout:
+			return nil, 0, errTransferTimeout
+		}
+	}
+}
+
+// requestTransfer sends a handshake packet and waits for the expected reply,
+// retrying at most TransferMaxErrors times.
+func (overlay *OverlayConn) requestTransfer(pid PeerID, addr *net.UDPAddr, tid transactionID,
+	c chan *stun.Message, expected transferStage, setters ...stun.Setter) error {
+	var err error
+	for i := 0; i < overlay.Config.TransferMaxErrors; i++ {
+		if err = overlay.writeTransferMessage(pid, addr, tid, setters...); err != nil {
+			return err
+		}
+		if _, _, err = overlay.awaitTransfer(c, expected); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// sendMultiPackets sends data to a peer as a multi-packets message.
+func (overlay *OverlayConn) sendMultiPackets(pid PeerID, addr *net.UDPAddr, data []byte) error {
+	var (
+		seqs  [][]byte
+		tid   = transactionID(stun.NewTransactionID())
+		round []uint32
+		res   *stun.Message
+		stage transferStage
+		err   error
+	)
+
+	for len(data) > 0 {
+		n := stunSequenceDataSize
+		if n > len(data) {
+			n = len(data)
+		}
+		seqs, data = append(seqs, data[:n]), data[n:]
+	}
+	if len(seqs) > maxTransferSequences {
+		return errTransferTooLarge
+	}
+	total := totalSequences(len(seqs))
+
+	c := overlay.transfers.open(tid)
+	defer overlay.transfers.close(tid)
+
+	if err = overlay.requestTransfer(pid, addr, tid, c, stageSendReq|stageSendAck, stageSendReq); err != nil {
+		return errors.Wrap(err, "SendReq failed")
+	}
+	if err = overlay.requestTransfer(pid, addr, tid, c, stageSendReady, stageSendAck, total); err != nil {
+		return errors.Wrap(err, "SendAck failed")
+	}
+
+	for i := range seqs {
+		round = append(round, uint32(i))
+	}
+	for errCount := 0; errCount < overlay.Config.TransferMaxErrors; {
+		for i, seq := range round {
+			setters := []stun.Setter{stageDataPost, transferSequence(seq), PeerMessage(seqs[seq])}
+			if i == len(round)-1 {
+				setters = append(setters, total)
+			}
+			if err = overlay.writeTransferMessage(pid, addr, tid, setters...); err != nil {
+				return errors.Wrapf(err, "DataPost of sequence %d failed", seq)
+			}
+		}
+
+		if res, stage, err = overlay.awaitTransfer(c, stageDataSuccess, stageDataError); err != nil {
+			// resend the last sequence to trigger DataError or DataSuccess
+			errCount++
+			round = round[len(round)-1:]
+			continue
+		} else if stage == stageDataSuccess {
+			return nil
+		}
+
+		var missing missingSequences
+		if err = missing.GetFrom(res); err != nil || len(missing) == 0 {
+			errCount++
+			continue
+		}
+		if len(missing) >= len(round) {
+			errCount++
+		}
+		round = round[:0]
+		for _, seq := range missing {
+			if int(seq) < len(seqs) {
+				round = append(round, seq)
+			}
+		}
+		if len(round) == 0 {
+			// the receiver only reported invalid sequences, so resend
+			// the last sequence to get a valid DataError or DataSuccess
+			errCount++
+			round = append(round, uint32(len(seqs)-1))
+		}
+	}
+	return errTransferTimeout
+}
+
+func (overlay *OverlayConn) multicastMultiPackets(data []byte, pids []PeerID) (int, error) {
+	if (len(data)+stunSequenceDataSize-1)/stunSequenceDataSize > maxTransferSequences {
+		return 0, errTransferTooLarge
+	}
+
+	overlay.RLock()
+	defer overlay.RUnlock()
+	for id, addrs := range overlay.sessions(pids) {
+		go func(id PeerID, addrs Session) {
+			if err := overlay.sendMultiPackets(id, overlay.peerAddr(addrs), data); err != nil {
+				log.Printf("WARNING: failed sending multi-packets message to %s[%s][%s] - %v",
+					id, addrs[0].String(), addrs[1].String(), err)
+			} else {
+				log.Printf("-> sent multi-packets message to %s[%s][%s]",
+					id, addrs[0].String(), addrs[1].String())
+			}
+		}(id, addrs)
+	}
+	return len(data), nil
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/gortc/stun"
+)
+
+func TestTransferAttributes(t *testing.T) {
+	m, err := stun.Build(
+		stun.TransactionID,
+		stunSendIndication,
+		stageDataError,
+		transferSequence(7),
+		totalSequences(12),
+		missingSequences{3, 5, 11},
+	)
+	if err != nil {
+		t.Fatalf("failed building message: %v", err)
+	}
+
+	var (
+		stage   transferStage
+		seq     transferSequence
+		total   totalSequences
+		missing missingSequences
+	)
+	if err = stage.GetFrom(m); err != nil || stage != stageDataError {
+		t.Errorf("stage: got %v (%v), expected %v", stage, err, stageDataError)
+	}
+	if err = seq.GetFrom(m); err != nil || seq != 7 {
+		t.Errorf("sequence: got %d (%v), expected 7", seq, err)
+	}
+	if err = total.GetFrom(m); err != nil || total != 12 {
+		t.Errorf("total sequences: got %d (%v), expected 12", total, err)
+	}
+	if err = missing.GetFrom(m); err != nil || len(missing) != 3 || missing[2] != 11 {
+		t.Errorf("missing sequences: got %v (%v), expected [3 5 11]", missing, err)
+	}
+}
+
+func TestInboundTransfer(t *testing.T) {
+	tr := inboundTransfer{seqs: make([][]byte, 3)}
+	tr.seqs[0], tr.seqs[2] = []byte("foo"), []byte("baz")
+	tr.received = 2
+
+	if ms := tr.missing(); len(ms) != 1 || ms[0] != 1 {
+		t.Errorf("missing: got %v, expected [1]", ms)
+	}
+	tr.seqs[1] = []byte("bar")
+	if p := tr.payload(); !bytes.Equal(p, []byte("foobarbaz")) {
+		t.Errorf("payload: got %s, expected foobarbaz", p)
+	}
+}
+
+func TestSendMultiPacketsInvalidMissing(t *testing.T) {
+	sender, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sender.Close()
+	receiver, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer receiver.Close()
+
+	overlay := newTestOverlay(OverlayConfig{TransferWait: 1, TransferMaxErrors: 3})
+	overlay.conn = &overlayUDPConn{conn: sender}
+	overlay.transfers = newOverlayTransfers()
+
+	// the receiver replies to the first round with a DataError whose
+	// missing sequences are all out of range
+	go func() {
+		buf := make([]byte, 64*1024)
+		rounds := 0
+		for {
+			n, err := receiver.Read(buf)
+			if err != nil {
+				return
+			}
+			req := &stun.Message{Raw: append([]byte{}, buf[:n]...)}
+			var stage transferStage
+			if req.Decode() != nil || stage.GetFrom(req) != nil {
+				continue
+			}
+			var reply []stun.Setter
+			switch {
+			case stage == stageSendReq:
+				reply = []stun.Setter{stageSendReq | stageSendAck}
+			case stage == stageSendAck:
+				reply = []stun.Setter{stageSendReady}
+			case stage == stageDataPost && rounds == 0:
+				rounds++
+				reply = []stun.Setter{stageDataError, missingSequences{5, 9}}
+			case stage == stageDataPost:
+				reply = []stun.Setter{stageDataSuccess}
+			}
+			reply = append([]stun.Setter{stun.NewTransactionIDSetter(req.TransactionID), stunSendIndication}, reply...)
+			if res, err := stun.Build(reply...); err == nil {
+				overlay.transfers.deliver(transactionID(req.TransactionID), res)
+			}
+		}
+	}()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- overlay.sendMultiPackets(PeerID{2}, receiver.LocalAddr().(*net.UDPAddr), []byte("foo"))
+	}()
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Errorf("failed sending multi-packets message: %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Errorf("multi-packets message was not sent")
+	}
+}
+
+func TestInboundTransferLimits(t *testing.T) {
+	ts := newOverlayTransfers()
+	open := func(pid PeerID, tid byte) {
+		ts.inbound[transferKey{pid, transactionID{tid}}] = &inboundTransfer{updated: time.Now()}
+	}
+
+	for i := 0; i < maxPeerInboundTransfers; i++ {
+		open(PeerID{1}, byte(i))
+	}
+	if !ts.full(PeerID{1}) {
+		t.Errorf("a peer over its limit should be rejected")
+	}
+	if ts.full(PeerID{2}) {
+		t.Errorf("another peer should be accepted")
+	}
+	ts.inbound[transferKey{PeerID{1}, transactionID{0}}].done = true
+	if ts.full(PeerID{1}) {
+		t.Errorf("completed transfers should not be counted")
+	}
+
+	for i := 0; i < maxInboundTransfers; i++ {
+		open(PeerID{byte(i + 2)}, 0)
+	}
+	if !ts.full(PeerID{0xff}) {
+		t.Errorf("a new peer should be rejected over the global limit")
+	}
+}
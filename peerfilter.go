@@ -0,0 +1,113 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/anacrolix/torrent/iplist"
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+// clusterFilter is the IP blocklist of the torrent client and the DHT. It
+// blocks the addresses that are neither in the session tables of
+// the clusters, nor in the allowlist, nor in the nodes of the started
+// notifications.
+type clusterFilter struct {
+	sync.RWMutex
+	clusters  []*Cluster
+	allowlist []*net.IPNet
+	nodes     map[string]struct{}
+}
+
+func newClusterFilter(allowlist []*net.IPNet) *clusterFilter {
+	return &clusterFilter{
+		allowlist: allowlist,
+		nodes:     make(map[string]struct{}),
+	}
+}
+
+// parseAllowlist returns the networks of given IP addresses or CIDR networks.
+func parseAllowlist(list []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(list))
+	for _, s := range list {
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address '%s' in peer allowlist", s)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network '%s' in peer allowlist: %v", s, err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// setClusters sets the clusters whose peers are allowed. The filter only
+// allows the allowlist until the agent has joined its clusters.
+func (f *clusterFilter) setClusters(clusters map[string]*Cluster) {
+	f.Lock()
+	defer f.Unlock()
+	f.clusters = f.clusters[:0]
+	for _, c := range clusters {
+		f.clusters = append(f.clusters, c)
+	}
+}
+
+// allow adds the IP addresses of given nodes to the filter.
+func (f *clusterFilter) allow(nodes []metainfo.Node) {
+	f.Lock()
+	defer f.Unlock()
+	for _, n := range nodes {
+		if host, _, err := net.SplitHostPort(string(n)); err == nil {
+			if ip := net.ParseIP(host); ip != nil {
+				f.nodes[ip.String()] = struct{}{}
+			}
+		}
+	}
+}
+
+// Lookup returns true if given IP address does not belong to the clusters.
+func (f *clusterFilter) Lookup(ip net.IP) (iplist.Range, bool) {
+	f.RLock()
+	defer f.RUnlock()
+	if _, ok := f.nodes[ip.String()]; ok {
+		return iplist.Range{}, false
+	}
+	for _, n := range f.allowlist {
+		if n.Contains(ip) {
+			return iplist.Range{}, false
+		}
+	}
+	for _, c := range f.clusters {
+		if c.Overlay != nil && c.Overlay.hasIP(ip) {
+			return iplist.Range{}, false
+		}
+	}
+	return iplist.Range{
+		First:       ip,
+		Last:        ip,
+		Description: "not a cluster peer",
+	}, true
+}
+
+// NumRanges returns the number of allowed networks and node addresses.
+func (f *clusterFilter) NumRanges() int {
+	f.RLock()
+	defer f.RUnlock()
+	return len(f.allowlist) + len(f.nodes)
+}
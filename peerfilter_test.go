@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+func TestClusterFilter(t *testing.T) {
+	overlay := newTestOverlay(OverlayConfig{PeerLifetime: 300})
+	overlay.peers[PeerID{2}] = Session{
+		&net.UDPAddr{IP: net.IPv4(2, 2, 2, 2), Port: 1000},
+		&net.UDPAddr{IP: net.IPv4(192, 168, 0, 2), Port: 1000},
+		&net.UDPAddr{IP: net.IPv4(2, 2, 2, 2), Port: 6881},
+		&net.UDPAddr{IP: net.IPv4(192, 168, 0, 2), Port: 6881},
+	}
+
+	allowlist, err := parseAllowlist([]string{"10.0.0.0/8", "5.5.5.5"})
+	if err != nil {
+		t.Fatalf("failed parsing allowlist: %v", err)
+	}
+	f := newClusterFilter(allowlist)
+	if _, blocked := f.Lookup(net.IPv4(2, 2, 2, 2)); !blocked {
+		t.Errorf("nodes should be blocked before the agent joins the clusters")
+	}
+	if _, blocked := f.Lookup(net.IPv4(10, 1, 2, 3)); blocked {
+		t.Errorf("a node in the allowlist should not be blocked")
+	}
+	f.setClusters(map[string]*Cluster{"": {Overlay: overlay}})
+	f.allow([]metainfo.Node{"3.3.3.3:6881", "invalid"})
+	for _, ip := range []net.IP{net.IPv4(2, 2, 2, 2), net.IPv4(192, 168, 0, 2), net.IPv4(3, 3, 3, 3), net.IPv4(5, 5, 5, 5)} {
+		if _, blocked := f.Lookup(ip); blocked {
+			t.Errorf("%s should not be blocked", ip)
+		}
+	}
+	if _, blocked := f.Lookup(net.IPv4(4, 4, 4, 4)); !blocked {
+		t.Errorf("a node outside the cluster should be blocked")
+	}
+	if addrs, _ := f.startingNodes(); len(addrs) != 1 || addrs[0].String() != "2.2.2.2:6881" {
+		t.Errorf("starting nodes: got %v", addrs)
+	}
+}
+
+func TestParseAllowlist(t *testing.T) {
+	nets, err := parseAllowlist([]string{"192.168.0.0/16", "1.2.3.4", "::1"})
+	if err != nil {
+		t.Fatalf("failed parsing allowlist: %v", err)
+	} else if len(nets) != 3 || nets[1].String() != "1.2.3.4/32" || nets[2].String() != "::1/128" {
+		t.Errorf("allowlist: got %v", nets)
+	}
+	for _, s := range []string{"1.2.3", "1.2.3.4/40"} {
+		if _, err = parseAllowlist([]string{s}); err == nil {
+			t.Errorf("'%s' should be invalid", s)
+		}
+	}
+}
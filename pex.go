@@ -0,0 +1,205 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/vmihailenco/msgpack"
+)
+
+// topicPEX is the overlay topic of peer exchange messages.
+const topicPEX = "pex"
+
+// pexEntry is a session in a peer exchange message. Age is the number of
+// seconds since the sender saw the peer, so that the freshness does not
+// depend on the clocks of the peers.
+type pexEntry struct {
+	Session Session `msgpack:"session"`
+	Age     int64   `msgpack:"age"`
+}
+
+// peerExchange is a message of topic `topicPEX`, which holds the sessions
+// known by the sender.
+type peerExchange map[PeerID]pexEntry
+
+// peerRecord is a peer in the file of the peer table.
+type peerRecord struct {
+	Session Session   `json:"session"`
+	Seen    time.Time `json:"seen"`
+}
+
+// parsePeerID returns the PeerID of given hex string.
+func parsePeerID(s string) (PeerID, error) {
+	var pid PeerID
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return pid, err
+	} else if len(b) != len(pid) {
+		return pid, fmt.Errorf("length of peer ID '%s' is not %d bytes", s, len(pid))
+	}
+	copy(pid[:], b)
+	return pid, nil
+}
+
+// peerExchange returns the sessions of the peers, including this overlay,
+// with their ages.
+func (overlay *OverlayConn) peerExchange() peerExchange {
+	overlay.RLock()
+	defer overlay.RUnlock()
+	now := time.Now()
+	px := make(peerExchange, len(overlay.peers))
+	for id, sess := range overlay.peers {
+		if seen, ok := overlay.peersSeen[id]; ok {
+			px[id] = pexEntry{
+				Session: sess,
+				Age:     int64(now.Sub(seen) / time.Second),
+			}
+		}
+	}
+	return px
+}
+
+// exchangePeers sends the session table to a random peer, so that the peers
+// learn from each other when the server is unreachable.
+func (overlay *OverlayConn) exchangePeers() {
+	if !overlay.Ready() {
+		return
+	}
+	pids := overlay.RandomPeers(1)
+	if len(pids) == 0 {
+		return
+	}
+	b, err := msgpack.Marshal(overlay.peerExchange())
+	if err != nil {
+		log.Printf("exchangePeers - failed encoding session table: %v", err)
+	} else if _, err = overlay.WriteTopicTo(topicPEX, b, pids); err != nil {
+		log.Printf("exchangePeers - failed sending session table to %s: %v", pids[0], err)
+	}
+}
+
+// receivePeers handles a message of topic `topicPEX`.
+func (overlay *OverlayConn) receivePeers(sender PeerID, b []byte) {
+	var px peerExchange
+	if err := msgpack.Unmarshal(b, &px); err != nil {
+		log.Printf("receivePeers - %s sent an invalid session table: %v", sender, err)
+		return
+	}
+	if n := overlay.mergePeers(px); n > 0 {
+		log.Printf("receivePeers - updated %d peers from %s", n, sender)
+	}
+}
+
+// mergePeers updates the session table with the sessions of given peer
+// exchange that are fresher than ours and have not expired. It returns
+// the number of updated peers.
+func (overlay *OverlayConn) mergePeers(px peerExchange) int {
+	var (
+		lifetime = overlay.Config.PeerLifetime * time.Second
+		now      = time.Now()
+		n        int
+		added    []PeerID
+	)
+
+	overlay.Lock()
+	defer func() { overlay.peersAdded(added) }()
+	defer overlay.Unlock()
+	for id, e := range px {
+		if id == overlay.ID || !e.Session.valid() || e.Age < 0 {
+			continue
+		}
+		seen := now.Add(-time.Duration(e.Age) * time.Second)
+		if now.Sub(seen) > lifetime {
+			continue
+		} else if last, ok := overlay.peersSeen[id]; ok && !seen.After(last) {
+			continue
+		}
+		if _, ok := overlay.peers[id]; !ok {
+			log.Printf("peer %s has been exchanged", id)
+			// give the new peer RelayTimeout to be reached directly
+			overlay.peersDirect[id] = now
+			added = append(added, id)
+		}
+		overlay.peers[id] = e.Session
+		overlay.peersSeen[id] = seen
+		n++
+	}
+	return n
+}
+
+// knowsPeers returns true if the session table has other peers. The caller
+// must hold the lock.
+func (overlay *OverlayConn) knowsPeers() bool {
+	return len(overlay.sessions(nil)) > 0
+}
+
+// savePeers writes the session table to file `peersFile`.
+func (overlay *OverlayConn) savePeers() error {
+	if len(overlay.Config.peersFile) == 0 {
+		return nil
+	}
+	overlay.RLock()
+	records := make(map[string]peerRecord, len(overlay.peers))
+	for id, sess := range overlay.sessions(nil) {
+		records[id.String()] = peerRecord{
+			Session: sess,
+			Seen:    overlay.peersSeen[id],
+		}
+	}
+	overlay.RUnlock()
+
+	b, err := json.Marshal(records)
+	if err != nil {
+		return errors.Wrap(err, "failed encoding peer table")
+	}
+	tmp := overlay.Config.peersFile + ".tmp"
+	if err = ioutil.WriteFile(tmp, b, 0640); err != nil {
+		return errors.Wrapf(err, "failed writing peer table to %s", tmp)
+	}
+	return os.Rename(tmp, overlay.Config.peersFile)
+}
+
+// loadPeers reads the session table from file `peersFile`. The loaded peers
+// are given PeerLifetime to be reached again, so that a restarted overlay can
+// rejoin them without the server.
+func (overlay *OverlayConn) loadPeers() error {
+	if len(overlay.Config.peersFile) == 0 {
+		return nil
+	}
+	b, err := ioutil.ReadFile(overlay.Config.peersFile)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return errors.Wrapf(err, "failed reading peer table from %s", overlay.Config.peersFile)
+	}
+	var records map[string]peerRecord
+	if err = json.Unmarshal(b, &records); err != nil {
+		return errors.Wrapf(err, "failed decoding peer table from %s", overlay.Config.peersFile)
+	}
+
+	overlay.Lock()
+	defer overlay.Unlock()
+	now := time.Now()
+	for s, r := range records {
+		id, err := parsePeerID(s)
+		if err != nil || id == overlay.ID || !r.Session.valid() {
+			continue
+		}
+		if _, ok := overlay.peers[id]; !ok {
+			overlay.peers[id] = r.Session
+			overlay.peersSeen[id] = now
+			overlay.peersDirect[id] = now
+		}
+	}
+	log.Printf("loaded %d peers from %s", len(records), overlay.Config.peersFile)
+	return nil
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/vmihailenco/msgpack"
+)
+
+func newTestOverlay(cfg OverlayConfig) *OverlayConn {
+	return &OverlayConn{
+		ID:          PeerID{1},
+		Config:      &cfg,
+		peers:       make(SessionTable),
+		peersSeen:   make(LastSeenTable),
+		peersDirect: make(LastSeenTable),
+	}
+}
+
+func testSession(port int) Session {
+	return Session{
+		&net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: port},
+		&net.UDPAddr{IP: net.IPv4(192, 168, 0, 1), Port: port},
+	}
+}
+
+func TestParsePeerID(t *testing.T) {
+	pid := PeerID{1, 2, 3, 4, 5, 6}
+	if p, err := parsePeerID(pid.String()); err != nil || p != pid {
+		t.Errorf("parsing %s: got (%s, %v)", pid, p, err)
+	}
+	if _, err := parsePeerID("0102"); err == nil {
+		t.Errorf("a short peer ID should be rejected")
+	}
+}
+
+func TestMergePeers(t *testing.T) {
+	overlay := newTestOverlay(OverlayConfig{PeerLifetime: 300})
+	known, fresh, expired := PeerID{2}, PeerID{3}, PeerID{4}
+	overlay.peers[known] = testSession(1000)
+	overlay.peersSeen[known] = time.Now().Add(-10 * time.Second)
+
+	px := peerExchange{
+		overlay.ID: {Session: testSession(1), Age: 0},
+		known:      {Session: testSession(2000), Age: 60},
+		fresh:      {Session: testSession(3000), Age: 5},
+		expired:    {Session: testSession(4000), Age: 600},
+	}
+	b, err := msgpack.Marshal(px)
+	if err != nil {
+		t.Fatalf("failed encoding peer exchange: %v", err)
+	}
+	px = nil
+	if err = msgpack.Unmarshal(b, &px); err != nil {
+		t.Fatalf("failed decoding peer exchange: %v", err)
+	}
+
+	if n := overlay.mergePeers(px); n != 1 {
+		t.Errorf("merged peers: got %d, expected 1", n)
+	}
+	if overlay.peers[known][0].Port != 1000 {
+		t.Errorf("the session of %s should not be replaced by an older one", known)
+	}
+	if sess, ok := overlay.peers[fresh]; !ok || sess[0].Port != 3000 {
+		t.Errorf("%s should have been added", fresh)
+	} else if age := time.Since(overlay.peersSeen[fresh]); age < 5*time.Second {
+		t.Errorf("last seen of %s: got %v ago, expected at least 5s ago", fresh, age)
+	}
+	if _, ok := overlay.peers[expired]; ok {
+		t.Errorf("%s should have expired", expired)
+	}
+	if _, ok := overlay.peers[overlay.ID]; ok {
+		t.Errorf("the overlay should not add itself")
+	}
+}
+
+func TestMergeInvalidSessions(t *testing.T) {
+	overlay := newTestOverlay(OverlayConfig{PeerLifetime: 300})
+	noTorrent := append(testSession(3000), nil, nil)
+	px := peerExchange{
+		PeerID{2}: {Session: Session{nil, nil}},
+		PeerID{3}: {Session: noTorrent},
+	}
+	b, err := msgpack.Marshal(px)
+	if err != nil {
+		t.Fatalf("failed encoding peer exchange: %v", err)
+	}
+	px = nil
+	if err = msgpack.Unmarshal(b, &px); err != nil {
+		t.Fatalf("failed decoding peer exchange: %v", err)
+	}
+	if n := overlay.mergePeers(px); n != 0 {
+		t.Errorf("merged peers: got %d, expected 0", n)
+	}
+
+	dir, err := ioutil.TempDir("", "pex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	overlay.Config.peersFile = filepath.Join(dir, "peers.json")
+	records := `{"` + PeerID{2}.String() + `": {"session": [null, null]}}`
+	if err = ioutil.WriteFile(overlay.Config.peersFile, []byte(records), 0640); err != nil {
+		t.Fatal(err)
+	}
+	if err = overlay.loadPeers(); err != nil {
+		t.Fatalf("failed loading peers: %v", err)
+	}
+	if len(overlay.peers) != 0 {
+		t.Errorf("loaded peers: got %d, expected 0", len(overlay.peers))
+	}
+}
+
+func TestPeersFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := OverlayConfig{peersFile: filepath.Join(dir, "peers.json")}
+	overlay := newTestOverlay(cfg)
+	overlay.peers[overlay.ID] = testSession(1)
+	overlay.peers[PeerID{2}] = testSession(2000)
+	overlay.peersSeen[PeerID{2}] = time.Now()
+	if err = overlay.savePeers(); err != nil {
+		t.Fatalf("failed saving peers: %v", err)
+	}
+
+	restarted := newTestOverlay(cfg)
+	if err = restarted.loadPeers(); err != nil {
+		t.Fatalf("failed loading peers: %v", err)
+	}
+	if len(restarted.peers) != 1 {
+		t.Errorf("loaded peers: got %d, expected 1", len(restarted.peers))
+	} else if sess := restarted.peers[PeerID{2}]; len(sess) != 2 || sess[0].Port != 2000 {
+		t.Errorf("loaded session: got %v", sess)
+	}
+
+	empty := newTestOverlay(OverlayConfig{peersFile: filepath.Join(dir, "none.json")})
+	if err = empty.loadPeers(); err != nil {
+		t.Errorf("loading a missing file: got %v, expected nil", err)
+	}
+}
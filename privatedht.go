@@ -0,0 +1,96 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"log"
+	"net"
+
+	"github.com/anacrolix/dht"
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+// maxNotificationNodes is the maximum number of DHT nodes in a notification
+const maxNotificationNodes = 32
+
+// hasIP returns true if given IP address is an address of a peer in
+// the session table, including this overlay.
+func (overlay *OverlayConn) hasIP(ip net.IP) bool {
+	overlay.RLock()
+	defer overlay.RUnlock()
+	for _, sess := range overlay.peers {
+		for _, addr := range sess {
+			if addr != nil && addr.IP.Equal(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// TorrentNodes returns the external and internal addresses of the torrent
+// clients of the peers, including this overlay, which are at most
+// maxNotificationNodes nodes that notifications give to the DHT.
+func (overlay *OverlayConn) TorrentNodes() []metainfo.Node {
+	overlay.RLock()
+	defer overlay.RUnlock()
+	var (
+		nodes []metainfo.Node
+		seen  = make(map[string]struct{})
+	)
+	add := func(sess Session) {
+		if len(sess) < 4 {
+			return
+		}
+		for _, addr := range sess[2:4] {
+			if len(nodes) >= maxNotificationNodes || addr == nil || addr.Port <= 0 {
+				continue
+			}
+			if _, ok := seen[addr.String()]; !ok {
+				seen[addr.String()] = struct{}{}
+				nodes = append(nodes, metainfo.Node(addr.String()))
+			}
+		}
+	}
+	// this overlay is the first seeder of the notifications it submits
+	add(overlay.peers[overlay.ID])
+	for _, sess := range overlay.sessions(nil) {
+		add(sess)
+	}
+	return nodes
+}
+
+// startingNodes returns the torrent clients of the clusters' peers, which
+// are the starting nodes of the DHT in private mode.
+func (f *clusterFilter) startingNodes() ([]dht.Addr, error) {
+	f.RLock()
+	defer f.RUnlock()
+	var addrs []dht.Addr
+	for _, c := range f.clusters {
+		if c.Overlay == nil {
+			continue
+		}
+		for _, addr := range c.Overlay.TorrentAddrs(nil) {
+			addrs = append(addrs, dht.NewAddr(addr))
+		}
+	}
+	return addrs, nil
+}
+
+// addDHTNodes pings the torrent clients of given overlay peers, so that they
+// are added to the DHT routing table when they respond.
+func (c *Cluster) addDHTNodes(pids []PeerID) {
+	if c.Overlay == nil || c.agent.torrentClient == nil {
+		return
+	}
+	addrs := c.Overlay.TorrentAddrs(pids)
+	for _, s := range c.agent.torrentClient.DhtServers() {
+		for _, addr := range addrs {
+			if err := s.Ping(addr, nil); err != nil {
+				log.Printf("addDHTNodes[%s] - failed pinging %s: %v", c.Name, addr, err)
+			}
+		}
+	}
+}
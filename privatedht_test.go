@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+func TestTorrentNodes(t *testing.T) {
+	overlay := newTestOverlay(OverlayConfig{PeerLifetime: 300})
+	overlay.peers[overlay.ID] = Session{
+		&net.UDPAddr{IP: net.IPv4(1, 1, 1, 1), Port: 1000},
+		&net.UDPAddr{IP: net.IPv4(192, 168, 0, 1), Port: 1000},
+		&net.UDPAddr{IP: net.IPv4(1, 1, 1, 1), Port: 6881},
+		&net.UDPAddr{IP: net.IPv4(192, 168, 0, 1), Port: 6881},
+	}
+	overlay.peers[PeerID{2}] = testSession(2000)
+	for i := 3; i < 3+maxNotificationNodes; i++ {
+		overlay.peers[PeerID{byte(i)}] = Session{
+			&net.UDPAddr{IP: net.IPv4(1, 1, 1, byte(i)), Port: 1000},
+			&net.UDPAddr{IP: net.IPv4(1, 1, 1, byte(i)), Port: 1000},
+			&net.UDPAddr{IP: net.IPv4(1, 1, 1, byte(i)), Port: 6881},
+			&net.UDPAddr{IP: net.IPv4(1, 1, 1, byte(i)), Port: 6881},
+		}
+	}
+
+	nodes := overlay.TorrentNodes()
+	if len(nodes) != maxNotificationNodes {
+		t.Fatalf("got %d nodes, expected %d", len(nodes), maxNotificationNodes)
+	}
+	if nodes[0] != "1.1.1.1:6881" || nodes[1] != "192.168.0.1:6881" {
+		t.Errorf("the first nodes should be this overlay, got %v", nodes[:2])
+	}
+	seen := make(map[metainfo.Node]bool)
+	for _, n := range nodes {
+		if seen[n] {
+			t.Errorf("duplicate node %s", n)
+		}
+		seen[n] = true
+	}
+}
@@ -0,0 +1,306 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"github.com/gortc/stun"
+	"github.com/pkg/errors"
+)
+
+const (
+	// methodConnect is the CONNECT method (RFC 6062), which is used by a peer
+	// to ask the server to introduce it to another peer.
+	methodConnect stun.Method = 0x00A
+
+	// attrConnectPeer holds the ID of the peer to connect to.
+	attrConnectPeer stun.AttrType = 0x8041
+
+	// codeConnectionFailure is the error code when the server cannot
+	// introduce the peers.
+	codeConnectionFailure stun.ErrorCode = 447
+
+	// punchPackets is the number of packets sent to a peer when punching
+	// a hole, and punchInterval is the interval between them.
+	punchPackets  = 5
+	punchInterval = 200 * time.Millisecond
+)
+
+var (
+	stunConnectRequest    = stun.NewType(methodConnect, stun.ClassRequest)
+	stunConnectIndication = stun.NewType(methodConnect, stun.ClassIndication)
+	stunConnectError      = stun.NewType(methodConnect, stun.ClassErrorResponse)
+)
+
+// peerConnectivity is the state of direct connectivity to a peer.
+type peerConnectivity string
+
+const (
+	connectivityUnknown  peerConnectivity = "unknown"
+	connectivityPunching peerConnectivity = "punching"
+	connectivityDirect   peerConnectivity = "direct"
+	connectivityFailed   peerConnectivity = "failed"
+)
+
+// connectPeer is the peer to connect to.
+type connectPeer PeerID
+
+// AddTo writes the peer to connect to on given STUN message.
+func (cp connectPeer) AddTo(m *stun.Message) error {
+	m.Add(attrConnectPeer, cp[:])
+	return nil
+}
+
+// GetFrom reads the peer to connect to from given STUN message.
+func (cp *connectPeer) GetFrom(m *stun.Message) error {
+	b, err := m.Get(attrConnectPeer)
+	if err != nil {
+		return err
+	} else if len(b) != len(cp) {
+		return fmt.Errorf("length of connect peer (%d bytes) is not %d bytes", len(b), len(cp))
+	}
+	copy(cp[:], b)
+	return nil
+}
+
+// PeerState is the state of a peer in the overlay.
+type PeerState struct {
+	Addresses    []string         `json:"addresses"`
+	Connectivity peerConnectivity `json:"connectivity"`
+	Relayed      bool             `json:"relayed"`
+}
+
+// introducePeers handles a connect request by sending connect indications to
+// both the requesting peer and the target peer at the same time, so that they
+// send packets to each other simultaneously to punch holes in their NATs.
+func (s *Server) introducePeers(conn net.PacketConn, addr net.Addr, req, res *stun.Message) error {
+	var (
+		pid    PeerID
+		target connectPeer
+	)
+
+	if err := pid.GetFrom(req); err != nil {
+		return errors.Wrap(err, "failed getting peer ID")
+	} else if err = target.GetFrom(req); err != nil {
+		return errors.Wrapf(err, "%s sent a connect request without peer", pid)
+	}
+
+	s.RLock()
+	src, srcOk := s.peers[pid]
+	dst, dstOk := s.peers[PeerID(target)]
+	s.RUnlock()
+	if !srcOk || !dstOk {
+		res.Reset()
+		err := res.Build(
+			stun.NewTransactionIDSetter(req.TransactionID),
+			stunConnectError,
+			codeConnectionFailure,
+			target,
+			&s.ID,
+			stun.NewShortTermIntegrity(s.cfg.StunPassword),
+			stun.Fingerprint,
+		)
+		if err == nil {
+			_, err = conn.WriteTo(res.Raw, addr)
+		}
+		if err != nil {
+			log.Printf("ERROR: failed replying connect error to %s - %v", pid, err)
+		}
+		return fmt.Errorf("cannot introduce %s to unknown peer %s", pid, PeerID(target))
+	}
+
+	var msgs [2]*stun.Message
+	for i, p := range []struct {
+		other   PeerID
+		session Session
+	}{{PeerID(target), dst}, {pid, src}} {
+		m, err := stun.Build(
+			stun.TransactionID,
+			stunConnectIndication,
+			&s.ID,
+			connectPeer(p.other),
+			&SessionTable{p.other: p.session},
+			stun.NewShortTermIntegrity(s.cfg.StunPassword),
+			stun.Fingerprint,
+		)
+		if err != nil {
+			return errors.Wrap(err, "failed building connect indication")
+		}
+		msgs[i] = m
+	}
+	if _, err := conn.WriteTo(msgs[0].Raw, src[0]); err != nil {
+		return errors.Wrapf(err, "failed sending connect indication to %s", pid)
+	}
+	if _, err := conn.WriteTo(msgs[1].Raw, dst[0]); err != nil {
+		return errors.Wrapf(err, "failed sending connect indication to %s", PeerID(target))
+	}
+	log.Printf("introduced %s[%s] and %s[%s]", pid, src[0], PeerID(target), dst[0])
+	return nil
+}
+
+// Connect asks the server to introduce this overlay to given peer, so that
+// both of them punch holes at the same time.
+func (overlay *OverlayConn) Connect(pid PeerID) error {
+	overlay.Lock()
+	defer overlay.Unlock()
+	return overlay.connect(pid)
+}
+
+// connect sends a connect request to the server. The caller must hold the lock.
+func (overlay *OverlayConn) connect(pid PeerID) error {
+	if overlay.conn == nil {
+		return errConnNotOpened
+	}
+	msg, err := stun.Build(
+		stun.TransactionID,
+		stunConnectRequest,
+		&overlay.ID,
+		connectPeer(pid),
+		stun.NewShortTermIntegrity(overlay.Config.StunPassword),
+		stun.Fingerprint,
+	)
+	if err != nil {
+		return errors.Wrap(err, "failed building connect request")
+	}
+	overlay.punched[pid] = time.Now()
+	_, err = overlay.conn.conn.WriteToUDP(msg.Raw, overlay.rendezvousAddr)
+	return err
+}
+
+// coordinatePunching requests the server's introduction to peers whose
+// connectivity is unknown, or has failed for PunchRetry. A direct peer that
+// has not been reached within RelayTimeout becomes unknown.
+func (overlay *OverlayConn) coordinatePunching() {
+	overlay.Lock()
+	defer overlay.Unlock()
+	if !overlay.Ready() {
+		return
+	}
+	var (
+		timeout = overlay.Config.PunchTimeout * time.Second
+		retry   = overlay.Config.PunchRetry * time.Second
+	)
+	for id := range overlay.sessions(nil) {
+		state := overlay.connectivityOf(id)
+		if state == connectivityDirect &&
+			time.Since(overlay.peersDirect[id]) > overlay.Config.RelayTimeout*time.Second {
+			state = connectivityUnknown
+			overlay.connectivity[id] = state
+		}
+		if (state == connectivityUnknown && time.Since(overlay.punched[id]) > timeout) ||
+			(state == connectivityFailed && time.Since(overlay.punched[id]) > retry) {
+			if err := overlay.connect(id); err != nil {
+				log.Printf("WARNING: failed requesting connection to %s - %v", id, err)
+			}
+		}
+	}
+}
+
+// connectivityOf returns the connectivity state of given peer. The caller must
+// hold the lock.
+func (overlay *OverlayConn) connectivityOf(pid PeerID) peerConnectivity {
+	if state, ok := overlay.connectivity[pid]; ok {
+		return state
+	}
+	return connectivityUnknown
+}
+
+// punch handles a connect indication of the server by sending packets to
+// the introduced peer. The connectivity becomes direct once a packet of
+// the peer arrives, otherwise it fails after PunchTimeout.
+func (overlay *OverlayConn) punch(req *stun.Message) error {
+	var target connectPeer
+	if err := target.GetFrom(req); err != nil {
+		return errors.Wrap(err, "server sent a connect indication without peer")
+	} else if err = overlay.updateSessionTable(req); err != nil {
+		return err
+	}
+	pid := PeerID(target)
+
+	msg, err := stun.Build(
+		stun.TransactionID,
+		stunChannelBindIndication,
+		&overlay.ID,
+		stun.NewShortTermIntegrity(overlay.Config.StunPassword),
+		stun.Fingerprint,
+	)
+	if err != nil {
+		return errors.Wrap(err, "failed building punching message")
+	}
+
+	overlay.Lock()
+	addrs, ok := overlay.peers[pid]
+	if ok && overlay.connectivityOf(pid) != connectivityDirect {
+		overlay.connectivity[pid] = connectivityPunching
+	}
+	overlay.punched[pid] = time.Now()
+	overlay.Unlock()
+	if !ok {
+		return fmt.Errorf("server introduced unknown peer %s", pid)
+	}
+
+	log.Printf("punching a hole to %s[%s][%s]", pid, addrs[0], addrs[1])
+	go func() {
+		for i := 0; i < punchPackets; i++ {
+			overlay.RLock()
+			if overlay.conn != nil {
+				overlay.conn.conn.WriteToUDP(msg.Raw, overlay.peerAddr(addrs))
+			}
+			overlay.RUnlock()
+			time.Sleep(punchInterval)
+		}
+	}()
+	time.AfterFunc(overlay.Config.PunchTimeout*time.Second, func() {
+		overlay.Lock()
+		defer overlay.Unlock()
+		if overlay.connectivity[pid] == connectivityPunching {
+			log.Printf("failed punching a hole to %s", pid)
+			overlay.connectivity[pid] = connectivityFailed
+		}
+	})
+	return nil
+}
+
+// connectFailed handles a connect error of the server.
+func (overlay *OverlayConn) connectFailed(res *stun.Message) error {
+	var (
+		target connectPeer
+		code   stun.ErrorCodeAttribute
+	)
+	code.GetFrom(res)
+	if err := target.GetFrom(res); err != nil {
+		return errors.Wrapf(err, "server refused connect request: %s", code)
+	}
+	overlay.Lock()
+	defer overlay.Unlock()
+	if _, ok := overlay.peers[PeerID(target)]; ok {
+		overlay.connectivity[PeerID(target)] = connectivityFailed
+	}
+	log.Printf("server refused connect request to %s: %s", PeerID(target), code)
+	return nil
+}
+
+// PeerStates returns the addresses and connectivity states of the peers.
+func (overlay *OverlayConn) PeerStates() map[string]PeerState {
+	overlay.RLock()
+	defer overlay.RUnlock()
+	states := make(map[string]PeerState)
+	for id, addrs := range overlay.sessions(nil) {
+		state := PeerState{
+			Addresses:    make([]string, len(addrs)),
+			Connectivity: overlay.connectivityOf(id),
+			Relayed:      overlay.relayed(id, addrs),
+		}
+		for i, addr := range addrs {
+			state.Addresses[i] = addr.String()
+		}
+		states[id.String()] = state
+	}
+	return states
+}
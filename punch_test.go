@@ -0,0 +1,24 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/gortc/stun"
+)
+
+func TestConnectPeer(t *testing.T) {
+	pid := PeerID{1, 2, 3, 4, 5, 6}
+	m, err := stun.Build(stun.TransactionID, stunConnectRequest, connectPeer(pid))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cp connectPeer
+	if err = cp.GetFrom(m); err != nil {
+		t.Fatal(err)
+	} else if PeerID(cp) != pid {
+		t.Errorf("connect peer %s != %s", PeerID(cp), pid)
+	}
+	if m.Type != stunConnectRequest {
+		t.Errorf("message type %v != %v", m.Type, stunConnectRequest)
+	}
+}
@@ -0,0 +1,171 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/valyala/fasthttp"
+)
+
+var (
+	pathUpdates = []byte("/updates")
+
+	errPushNotSupported = errors.New("server does not support push")
+)
+
+// pushResponse is the body of the server's push channel. It holds
+// the notifications that have been modified after the requested revision.
+type pushResponse struct {
+	Revision      uint64                   `json:"revision"`
+	Notifications map[string]*Notification `json:"notifications"`
+}
+
+// pushETag returns the ETag of given revision. It includes the server's epoch,
+// so that ETags issued before the server restarted do not match.
+func (s *Server) pushETag(revision uint64) string {
+	return fmt.Sprintf("\"%d-%d\"", s.epoch, revision)
+}
+
+// parsePushETag returns the revision of given ETag if it is issued by this
+// server instance.
+func (s *Server) parsePushETag(etag []byte) (uint64, bool) {
+	var epoch int64
+	var revision uint64
+	if _, err := fmt.Sscanf(string(etag), "\"%d-%d\"", &epoch, &revision); err != nil || epoch != s.epoch {
+		return 0, false
+	}
+	return revision, true
+}
+
+// modified records that the notification of given UUID has been modified,
+// then wakes up the push requests that are waiting. The caller must hold
+// the lock.
+func (s *Server) modified(uuid string) {
+	s.revision++
+	s.revisions[uuid] = s.revision
+	s.indexInfoHash(uuid)
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// servePushRequest serves a long-poll request of the notifications that have
+// been modified after revision `since`, which is given by query argument or
+// by If-None-Match header. The request is held until a notification is
+// modified or `wait` seconds (at most PushTimeout) have elapsed, then
+// the server replies 304 if nothing has been modified.
+func (s *Server) servePushRequest(ctx *fasthttp.RequestCtx) {
+	var since uint64
+	if n, err := ctx.QueryArgs().GetUint("since"); err == nil {
+		since = uint64(n)
+	}
+	if etag := ctx.Request.Header.Peek("If-None-Match"); len(etag) > 0 {
+		if rev, ok := s.parsePushETag(etag); !ok {
+			// the server has restarted, so the revisions have changed
+			since = 0
+		} else if rev > since {
+			since = rev
+		}
+	}
+	wait := s.cfg.PushTimeout
+	if n, err := ctx.QueryArgs().GetUint("wait"); err == nil && n < wait {
+		wait = n
+	}
+	deadline := time.Now().Add(time.Duration(wait) * time.Second)
+
+	for {
+		s.RLock()
+		if since > s.revision {
+			since = 0
+		}
+		if s.revision > since {
+			res := pushResponse{
+				Revision:      s.revision,
+				Notifications: make(map[string]*Notification),
+			}
+			for uuid, rev := range s.revisions {
+				if rev > since {
+					res.Notifications[uuid] = s.updates[uuid]
+				}
+			}
+			s.RUnlock()
+			ctx.Response.Header.Set("ETag", s.pushETag(res.Revision))
+			doJSONWrite(ctx, 200, res)
+			return
+		}
+		changed, revision := s.changed, s.revision
+		s.RUnlock()
+
+		select {
+		case <-changed:
+		case <-time.After(deadline.Sub(time.Now())):
+			ctx.Response.Header.Set("ETag", s.pushETag(revision))
+			ctx.NotModified()
+			return
+		}
+	}
+}
+
+// pushEnabled returns true if the cluster reads notifications from
+// the server's push channel when the overlay is not ready.
+func (c *Cluster) pushEnabled() bool {
+	return c.agent.Config.PushWait > 0 && !c.pushUnsupported
+}
+
+// readPush waits for new notifications on the server's push channel.
+func (c *Cluster) readPush() error {
+	req := fasthttp.AcquireRequest()
+	res := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseRequest(req)
+	defer fasthttp.ReleaseResponse(res)
+
+	wait := time.Duration(c.agent.Config.PushWait) * time.Second
+	url := fmt.Sprintf("http://%s%s?since=%d&wait=%d", c.Config.Server, pathUpdates,
+		c.pushRevision, c.agent.Config.PushWait)
+	req.SetRequestURI(url)
+	if len(c.pushETag) > 0 {
+		req.Header.Set("If-None-Match", c.pushETag)
+	}
+	if err := fasthttp.DoTimeout(req, res, wait+10*time.Second); err != nil {
+		err = errors.Errorf("readPush[%s] - failed requesting %s: %v", c.Name, url, err)
+		log.Println(err)
+		return err
+	}
+
+	// older servers reply the whole database to any GET request without ETag
+	code := res.StatusCode()
+	if code == fasthttp.StatusOK && len(res.Header.Peek("ETag")) == 0 {
+		code = fasthttp.StatusNotFound
+	}
+	switch code {
+	case fasthttp.StatusNotModified:
+		return nil
+	case fasthttp.StatusOK:
+	case fasthttp.StatusBadRequest, fasthttp.StatusNotFound:
+		log.Printf("readPush[%s] - server %s does not support push, fall back to polling", c.Name, c.Config.Server)
+		c.pushUnsupported = true
+		return errPushNotSupported
+	default:
+		err := errors.Errorf("readPush[%s] - failed getting updates from %s, status code: %d", c.Name, url, code)
+		log.Println(err)
+		return err
+	}
+
+	var pr pushResponse
+	if err := json.Unmarshal(res.Body(), &pr); err != nil {
+		err = errors.Errorf("readPush[%s] - failed decoding notifications from %s: %v", c.Name, url, err)
+		log.Println(err)
+		return err
+	}
+	log.Printf("readPush[%s] - received %d notifications of revision %d", c.Name, len(pr.Notifications), pr.Revision)
+	c.startNotifications("readPush", pr.Notifications)
+	c.pushRevision = pr.Revision
+	c.pushETag = string(res.Header.Peek("ETag"))
+	return nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/valyala/fasthttp"
+)
+
+func TestPushETag(t *testing.T) {
+	s := &Server{epoch: 1234}
+	if rev, ok := s.parsePushETag([]byte(s.pushETag(42))); !ok || rev != 42 {
+		t.Errorf("parsed revision %d (%v) != 42", rev, ok)
+	}
+	other := &Server{epoch: 5678}
+	if _, ok := other.parsePushETag([]byte(s.pushETag(42))); ok {
+		t.Error("ETag of other server instance must not match")
+	}
+	if _, ok := s.parsePushETag([]byte("\"abc\"")); ok {
+		t.Error("invalid ETag must not match")
+	}
+}
+
+func TestServerModified(t *testing.T) {
+	s := &Server{
+		revisions: make(map[string]uint64),
+		changed:   make(chan struct{}),
+	}
+	changed := s.changed
+	s.modified("a")
+	s.modified("b")
+	s.modified("a")
+	select {
+	case <-changed:
+	default:
+		t.Error("waiting requests must be woken up")
+	}
+	if s.revision != 3 || s.revisions["a"] != 3 || s.revisions["b"] != 2 {
+		t.Errorf("unexpected revisions %d %v", s.revision, s.revisions)
+	}
+}
+
+func TestServePushRequest(t *testing.T) {
+	s := &Server{
+		cfg:        &ServerConfig{PushTimeout: 1},
+		updates:    map[string]*Notification{"a": &Notification{UUID: "a", Version: 1}},
+		revisions:  make(map[string]uint64),
+		changed:    make(chan struct{}),
+		infoHashes: make(map[metainfo.Hash]string),
+	}
+	s.modified("a")
+
+	var ctx fasthttp.RequestCtx
+	ctx.Request.SetRequestURI("/updates?since=0")
+	s.servePushRequest(&ctx)
+	if code := ctx.Response.StatusCode(); code != 200 {
+		t.Fatalf("status code %d != 200", code)
+	}
+	etag := string(ctx.Response.Header.Peek("ETag"))
+
+	var ctx2 fasthttp.RequestCtx
+	ctx2.Request.SetRequestURI("/updates?wait=0")
+	ctx2.Request.Header.Set("If-None-Match", etag)
+	s.servePushRequest(&ctx2)
+	if code := ctx2.Response.StatusCode(); code != 304 {
+		t.Fatalf("status code %d != 304", code)
+	}
+}
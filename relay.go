@@ -0,0 +1,417 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gortc/stun"
+	"github.com/pkg/errors"
+)
+
+// attrRelayPeer holds the ID of the peer that a relayed message is sent to.
+const attrRelayPeer stun.AttrType = 0x8040
+
+// relayMinBurst is the minimum burst of relay rate limiters, which must fit
+// the largest data indication.
+const relayMinBurst = 64 * 1024
+
+var (
+	stunAllocateRequest = stun.NewType(stun.MethodAllocate, stun.ClassRequest)
+	stunAllocateSuccess = stun.NewType(stun.MethodAllocate, stun.ClassSuccessResponse)
+	stunAllocateError   = stun.NewType(stun.MethodAllocate, stun.ClassErrorResponse)
+
+	errRelayNotAllocated = errors.New("relay is not allocated")
+	errRelayRateLimited  = errors.New("relay bandwidth limit is exceeded")
+)
+
+// relayPeer is the destination of a relayed message.
+type relayPeer PeerID
+
+// AddTo writes the destination of a relayed message on given STUN message.
+func (rp relayPeer) AddTo(m *stun.Message) error {
+	m.Add(attrRelayPeer, rp[:])
+	return nil
+}
+
+// GetFrom reads the destination of a relayed message from given STUN message.
+func (rp *relayPeer) GetFrom(m *stun.Message) error {
+	b, err := m.Get(attrRelayPeer)
+	if err != nil {
+		return err
+	} else if len(b) != len(rp) {
+		return fmt.Errorf("length of relay peer (%d bytes) is not %d bytes", len(b), len(rp))
+	}
+	copy(rp[:], b)
+	return nil
+}
+
+// relayLifetime is the lifetime of a relay allocation in seconds.
+type relayLifetime uint32
+
+// AddTo writes the lifetime on given STUN message.
+func (l relayLifetime) AddTo(m *stun.Message) error {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, uint32(l))
+	m.Add(stun.AttrLifetime, b)
+	return nil
+}
+
+// GetFrom reads the lifetime from given STUN message.
+func (l *relayLifetime) GetFrom(m *stun.Message) error {
+	b, err := m.Get(stun.AttrLifetime)
+	if err != nil {
+		return err
+	} else if len(b) != 4 {
+		return fmt.Errorf("length of lifetime (%d bytes) is not 4 bytes", len(b))
+	}
+	*l = relayLifetime(binary.BigEndian.Uint32(b))
+	return nil
+}
+
+// rateLimiter is a token bucket that allows `rate` bytes per second.
+// A nil rateLimiter allows everything.
+type rateLimiter struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// newRateLimiter returns a rate limiter of given bytes per second, or nil if
+// the rate is not positive.
+func newRateLimiter(rate int) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	burst := float64(rate)
+	if burst < relayMinBurst {
+		burst = relayMinBurst
+	}
+	return &rateLimiter{
+		rate:   float64(rate),
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+	}
+}
+
+// allow takes `n` bytes from the bucket. It returns false if the bucket does
+// not have enough bytes.
+func (l *rateLimiter) allow(n int) bool {
+	if l == nil {
+		return true
+	}
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+	if float64(n) > l.tokens {
+		return false
+	}
+	l.tokens -= float64(n)
+	return true
+}
+
+// relayAllocation is a relay that is allocated by the server for a peer.
+// Messages addressed to the peer can be forwarded through the server.
+type relayAllocation struct {
+	expired time.Time
+	limiter *rateLimiter
+	bytes   uint64
+	dropped uint64
+}
+
+// relayTable holds the relay allocations of a server.
+type relayTable struct {
+	sync.Mutex
+	allocations map[PeerID]*relayAllocation
+	limiter     *rateLimiter
+}
+
+func newRelayTable(totalBandwidth int) *relayTable {
+	return &relayTable{
+		allocations: make(map[PeerID]*relayAllocation),
+		limiter:     newRateLimiter(totalBandwidth),
+	}
+}
+
+// active returns true if given peer has an allocation that has not expired.
+func (rt *relayTable) active(pid PeerID) bool {
+	rt.Lock()
+	defer rt.Unlock()
+	ra, ok := rt.allocations[pid]
+	return ok && time.Now().Before(ra.expired)
+}
+
+// forward checks whether `n` bytes can be relayed to given peer.
+func (rt *relayTable) forward(pid PeerID, n int) error {
+	rt.Lock()
+	defer rt.Unlock()
+	ra, ok := rt.allocations[pid]
+	if !ok || time.Now().After(ra.expired) {
+		return errRelayNotAllocated
+	}
+	if !ra.limiter.allow(n) || !rt.limiter.allow(n) {
+		ra.dropped++
+		return errRelayRateLimited
+	}
+	ra.bytes += uint64(n)
+	return nil
+}
+
+// expire removes expired allocations, then returns the IDs of their peers.
+func (rt *relayTable) expire() []PeerID {
+	rt.Lock()
+	defer rt.Unlock()
+	var pids []PeerID
+	now := time.Now()
+	for pid, ra := range rt.allocations {
+		if now.After(ra.expired) {
+			log.Printf("relay of %s has expired (relayed:%d bytes dropped:%d packets)",
+				pid, ra.bytes, ra.dropped)
+			delete(rt.allocations, pid)
+			pids = append(pids, pid)
+		}
+	}
+	return pids
+}
+
+// relayAddr returns the relayed address that is advertised as the fifth
+// address of sessions of peers that have relay allocations. Peers send
+// relayed messages to their rendezvous address.
+func (s *Server) relayAddr() *net.UDPAddr {
+	return s.Addr
+}
+
+// allocateRelay allocates or refreshes the relay of the requesting peer, then
+// advertises its relayed address to other peers.
+func (s *Server) allocateRelay(conn net.PacketConn, addr net.Addr, req, res *stun.Message) error {
+	var (
+		pid      PeerID
+		code     stun.ErrorCode
+		created  bool
+		lifetime = time.Duration(s.cfg.RelayLifetime) * time.Second
+	)
+
+	if err := pid.GetFrom(req); err != nil {
+		return errors.Wrap(err, "failed getting peer ID")
+	}
+
+	s.RLock()
+	_, registered := s.peers[pid]
+	s.RUnlock()
+
+	s.relays.Lock()
+	ra, ok := s.relays.allocations[pid]
+	switch {
+	case s.cfg.RelayMaxAllocations <= 0 || !registered:
+		code = stun.CodeForbidden
+	case ok:
+		ra.expired = time.Now().Add(lifetime)
+	case len(s.relays.allocations) >= s.cfg.RelayMaxAllocations:
+		code = stun.CodeAllocQuotaReached
+	default:
+		s.relays.allocations[pid] = &relayAllocation{
+			expired: time.Now().Add(lifetime),
+			limiter: newRateLimiter(s.cfg.RelayBandwidth),
+		}
+		created = true
+	}
+	s.relays.Unlock()
+
+	res.Reset()
+	var err error
+	if code != 0 {
+		err = res.Build(
+			stun.NewTransactionIDSetter(req.TransactionID),
+			stunAllocateError,
+			code,
+			&s.ID,
+			stun.NewShortTermIntegrity(s.cfg.StunPassword),
+			stun.Fingerprint,
+		)
+	} else {
+		err = res.Build(
+			stun.NewTransactionIDSetter(req.TransactionID),
+			stunAllocateSuccess,
+			relayLifetime(s.cfg.RelayLifetime),
+			&s.ID,
+			stun.NewShortTermIntegrity(s.cfg.StunPassword),
+			stun.Fingerprint,
+		)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "failed building allocate response for %s", pid)
+	}
+	if _, err = conn.WriteTo(res.Raw, addr); err != nil {
+		return errors.Wrapf(err, "ERROR: WriteTo %s", addr)
+	}
+	if code != 0 {
+		return fmt.Errorf("refused relay allocation of %s: %d", pid, code)
+	}
+
+	if created {
+		log.Printf("allocated relay of %s", pid)
+		s.Lock()
+		if session, ok := s.peers[pid]; ok && len(session) == 4 {
+			s.peers[pid] = append(session, s.relayAddr())
+		}
+		s.Unlock()
+		s.advertiseNewPeer(pid, conn, res)
+	}
+	return nil
+}
+
+// relayMessage forwards the message carried by a send indication to the peer
+// that has a relay allocation.
+func (s *Server) relayMessage(conn net.PacketConn, addr net.Addr, req *stun.Message) error {
+	var (
+		sender PeerID
+		dest   relayPeer
+		data   []byte
+		err    error
+	)
+
+	if err = sender.GetFrom(req); err != nil {
+		return errors.Wrap(err, "failed getting peer ID")
+	} else if err = dest.GetFrom(req); err != nil {
+		return errors.Wrapf(err, "%s sent a send indication without relay peer", sender)
+	} else if data, err = req.Get(stun.AttrData); err != nil {
+		return errors.Wrapf(err, "%s sent a send indication without data", sender)
+	}
+
+	s.RLock()
+	session, ok := s.peers[PeerID(dest)]
+	s.RUnlock()
+	if !ok {
+		return fmt.Errorf("%s relayed a message to unknown peer %s", sender, PeerID(dest))
+	}
+	if err = s.relays.forward(PeerID(dest), len(data)); err != nil {
+		return errors.Wrapf(err, "failed relaying a message from %s to %s", sender, PeerID(dest))
+	}
+	_, err = conn.WriteTo(data, session[0])
+	return err
+}
+
+// expireRelays removes expired relay allocations, then advertises the sessions
+// without relayed address.
+func (s *Server) expireRelays() {
+	msg := stunMessagePool.Get().(*stun.Message)
+	defer stunMessagePool.Put(msg)
+	for _, pid := range s.relays.expire() {
+		s.Lock()
+		session, ok := s.peers[pid]
+		if ok && len(session) > 4 {
+			s.peers[pid] = session[:4]
+		}
+		s.Unlock()
+		if ok {
+			s.advertiseNewPeer(pid, s.udpConn, msg)
+		}
+	}
+}
+
+// relayed returns true if messages to given peer should be sent through the
+// relay, which is when the peer has a relayed address and it has not been
+// reached directly within RelayTimeout. The caller must hold the lock.
+func (overlay *OverlayConn) relayed(pid PeerID, addrs Session) bool {
+	return len(addrs) > 4 &&
+		time.Since(overlay.peersDirect[pid]) > overlay.Config.RelayTimeout*time.Second
+}
+
+// relayNeeded returns true if this overlay should have a relay allocation,
+// which is when relay is forced or a peer has not been reached directly within
+// RelayTimeout. The caller must hold the lock.
+func (overlay *OverlayConn) relayNeeded() bool {
+	if overlay.Config.Relay {
+		return true
+	}
+	for id := range overlay.sessions(nil) {
+		if time.Since(overlay.peersDirect[id]) > overlay.Config.RelayTimeout*time.Second {
+			return true
+		}
+	}
+	return false
+}
+
+// RelayAllocated returns true if this overlay has a relay allocation.
+func (overlay *OverlayConn) RelayAllocated() bool {
+	overlay.RLock()
+	defer overlay.RUnlock()
+	return time.Now().Before(overlay.relayExpired)
+}
+
+// requestRelay sends an allocate request to the server. The caller must hold
+// the lock.
+func (overlay *OverlayConn) requestRelay() error {
+	msg, err := stun.Build(
+		stun.TransactionID,
+		stunAllocateRequest,
+		&overlay.ID,
+		stun.NewShortTermIntegrity(overlay.Config.StunPassword),
+		stun.Fingerprint,
+	)
+	if err != nil {
+		return errors.Wrap(err, "failed building allocate request")
+	}
+	_, err = overlay.conn.conn.WriteToUDP(msg.Raw, overlay.rendezvousAddr)
+	return err
+}
+
+// relayAllocated handles the allocate response of the server.
+func (overlay *OverlayConn) relayAllocated(res *stun.Message) error {
+	if res.Type.Class == stun.ClassErrorResponse {
+		var code stun.ErrorCodeAttribute
+		code.GetFrom(res)
+		log.Printf("server refused relay allocation: %s", code)
+		return nil
+	}
+	var lifetime relayLifetime
+	if err := lifetime.GetFrom(res); err != nil {
+		return errors.Wrap(err, "server sent allocate response without lifetime")
+	}
+	overlay.Lock()
+	defer overlay.Unlock()
+	if time.Now().After(overlay.relayExpired) {
+		log.Printf("relay is allocated for %d seconds", lifetime)
+	}
+	overlay.relayExpired = time.Now().Add(time.Duration(lifetime) * time.Second)
+	return nil
+}
+
+// writeToPeer sends a raw message to a peer, either directly or wrapped in
+// a send indication through the relay of the server. The caller must hold
+// the lock.
+func (overlay *OverlayConn) writeToPeer(raw []byte, pid PeerID, addrs Session) error {
+	if overlay.conn == nil {
+		return errConnNotOpened
+	}
+	if !overlay.relayed(pid, addrs) {
+		_, err := overlay.conn.conn.WriteToUDP(raw, overlay.peerAddr(addrs))
+		return err
+	}
+	msg, err := stun.Build(
+		stun.TransactionID,
+		stunSendIndication,
+		&overlay.ID,
+		relayPeer(pid),
+		PeerMessage(raw),
+		stun.NewShortTermIntegrity(overlay.Config.StunPassword),
+		stun.Fingerprint,
+	)
+	if err != nil {
+		return errors.Wrap(err, "failed building relayed message")
+	}
+	_, err = overlay.conn.conn.WriteToUDP(msg.Raw, overlay.rendezvousAddr)
+	return err
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gortc/stun"
+)
+
+func TestRateLimiter(t *testing.T) {
+	var unlimited *rateLimiter
+	if !unlimited.allow(1 << 30) {
+		t.Error("nil rate limiter must allow everything")
+	}
+
+	l := newRateLimiter(1024)
+	if !l.allow(relayMinBurst) {
+		t.Error("rate limiter must allow its burst")
+	}
+	if l.allow(1024) {
+		t.Error("rate limiter must not allow more than its burst")
+	}
+	l.last = l.last.Add(-time.Second)
+	if !l.allow(1024) {
+		t.Error("rate limiter must allow its rate after a second")
+	}
+}
+
+func TestRelayAttributes(t *testing.T) {
+	pid := PeerID{1, 2, 3, 4, 5, 6}
+	m, err := stun.Build(stun.TransactionID, stunSendIndication, relayPeer(pid), relayLifetime(600))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		rp relayPeer
+		lt relayLifetime
+	)
+	if err = rp.GetFrom(m); err != nil {
+		t.Fatal(err)
+	} else if PeerID(rp) != pid {
+		t.Errorf("relay peer %s != %s", PeerID(rp), pid)
+	}
+	if err = lt.GetFrom(m); err != nil {
+		t.Fatal(err)
+	} else if lt != 600 {
+		t.Errorf("lifetime %d != 600", lt)
+	}
+}
+
+func TestRelayTable(t *testing.T) {
+	pid := PeerID{1, 2, 3, 4, 5, 6}
+	rt := newRelayTable(0)
+	if err := rt.forward(pid, 1); err != errRelayNotAllocated {
+		t.Errorf("forward without allocation: %v", err)
+	}
+	rt.allocations[pid] = &relayAllocation{
+		expired: time.Now().Add(time.Minute),
+		limiter: newRateLimiter(1024),
+	}
+	if !rt.active(pid) {
+		t.Error("allocation must be active")
+	}
+	if err := rt.forward(pid, relayMinBurst); err != nil {
+		t.Errorf("forward within bandwidth: %v", err)
+	}
+	if err := rt.forward(pid, relayMinBurst); err != errRelayRateLimited {
+		t.Errorf("forward over bandwidth: %v", err)
+	}
+	rt.allocations[pid].expired = time.Now().Add(-time.Second)
+	if pids := rt.expire(); len(pids) != 1 || pids[0] != pid {
+		t.Errorf("expired allocations: %v", pids)
+	}
+}
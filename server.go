@@ -6,10 +6,10 @@ package main
 
 import (
 	"bytes"
-	"crypto/rsa"
 	"encoding/json"
 	"fmt"
 	"log"
+	"math/rand"
 	"net"
 	"os"
 	"sync"
@@ -17,18 +17,48 @@ import (
 
 	"github.com/valyala/fasthttp"
 
+	"github.com/anacrolix/torrent/metainfo"
 	"github.com/gortc/stun"
 	"github.com/pkg/errors"
 )
 
 // ServerConfig contains the server configuration parameters.
 type ServerConfig struct {
-	Address              string `json:"address"`
-	SessionAdvertiseTime int    `json:"session-advertise-time"` // in seconds
-	Database             string `json:"database"`
-	SnapshotTime         int    `json:"snapshot-time"` // in seconds
-	PublicKey            Key    `json:"public-key"`
-	StunPassword         string `json:"stun-password"`
+	Address              string        `json:"address"`
+	SessionAdvertiseTime int           `json:"session-advertise-time"` // in seconds
+	Database             string        `json:"database"`
+	SnapshotTime         int           `json:"snapshot-time"` // in seconds
+	PublicKey            Key           `json:"public-key"`
+	Keyring              KeyringConfig `json:"keyring,omitempty"`
+	StunPassword         string        `json:"stun-password"`
+	GossipFanout         int           `json:"gossip-fanout"`
+	GossipTTL            int           `json:"gossip-ttl"`
+	PeerLifetime         int           `json:"peer-lifetime"` // in seconds
+
+	// Relay of messages to peers behind symmetric NATs, bandwidths are in
+	// bytes per second (0 = unlimited), RelayMaxAllocations = 0 disables relay
+	RelayMaxAllocations int `json:"relay-max-allocations"`
+	RelayBandwidth      int `json:"relay-bandwidth"`
+	RelayTotalBandwidth int `json:"relay-total-bandwidth"`
+	RelayLifetime       int `json:"relay-lifetime"` // in seconds
+
+	// PushTimeout is the maximum time of a long-poll request of the push
+	// channel in seconds
+	PushTimeout int `json:"push-timeout"`
+
+	// AlternateAddress is the second IP and/or port for NAT behavior
+	// discovery (RFC 5780), e.g. "192.168.1.2:3479" or ":3479".
+	AlternateAddress string `json:"alternate-address,omitempty"`
+
+	// TrackerInterval is the announce interval of the embedded BitTorrent
+	// tracker in seconds (0 = tracker is disabled), and TrackerUDP enables
+	// the UDP tracker protocol (BEP 15) on the STUN port
+	TrackerInterval int  `json:"tracker-interval"`
+	TrackerUDP      bool `json:"tracker-udp"`
+
+	// DataDir is the directory of update files that is served at path
+	// `/data/` for web seeding (empty = disabled)
+	DataDir string `json:"data-dir,omitempty"`
 }
 
 // DefaultServerConfig returns default server configurations.
@@ -42,6 +72,18 @@ func DefaultServerConfig() *ServerConfig {
 			Filename: "key.pub",
 		},
 		StunPassword: defaultStunPassword,
+		GossipFanout: 4,
+		GossipTTL:    6,
+		PeerLifetime: 300,
+
+		RelayMaxAllocations: 64,
+		RelayBandwidth:      32 * 1024,
+		RelayTotalBandwidth: 1024 * 1024,
+		RelayLifetime:       600,
+
+		PushTimeout: 60,
+
+		TrackerInterval: 120,
 	}
 	return cfg
 }
@@ -49,15 +91,25 @@ func DefaultServerConfig() *ServerConfig {
 // Server is a STUN server implementation for multicast messaging system
 type Server struct {
 	sync.RWMutex
-	Addr  *net.UDPAddr
-	ID    PeerID
-	peers SessionTable
-	cfg   *ServerConfig
-
-	udpConn   *net.UDPConn
-	publicKey *rsa.PublicKey
+	Addr      *net.UDPAddr
+	ID        PeerID
+	peers     SessionTable
+	peersSeen LastSeenTable
+	relays    *relayTable
+	tracker   *tracker
+	webSeed   fasthttp.RequestHandler
+	cfg       *ServerConfig
+
+	udpConn  *net.UDPConn
+	natConns [2][2]*net.UDPConn
+	keyring  *Keyring
 
 	updates      map[string]*Notification
+	revisions    map[string]uint64 // revision when each update was modified
+	revision     uint64
+	epoch        int64
+	changed      chan struct{} // closed when an update is modified
+	infoHashes   map[metainfo.Hash]string
 	lastModified time.Time
 	lastSaved    time.Time
 }
@@ -67,7 +119,7 @@ func NewServer(cfg ServerConfig) (*Server, error) {
 	var (
 		id   *PeerID
 		addr *net.UDPAddr
-		pub  *rsa.PublicKey
+		kr   *Keyring
 		err  error
 	)
 
@@ -81,18 +133,27 @@ func NewServer(cfg ServerConfig) (*Server, error) {
 		return nil, errors.Wrap(err, "Cannot get local ID")
 	}
 
-	// load public key file
-	if pub, err = LoadPublicKey(cfg.PublicKey.Filename); err != nil {
-		return nil, fmt.Errorf("ERROR: failed loading public key file '%s: %v",
-			cfg.PublicKey.Filename, err)
+	// load trusted keys
+	if kr, err = loadKeyring(cfg.PublicKey, cfg.Keyring); err != nil {
+		return nil, fmt.Errorf("ERROR: failed loading keyring: %v", err)
 	}
 
 	s := &Server{
 		Addr:      addr,
 		ID:        *id,
 		peers:     make(SessionTable),
+		peersSeen: make(LastSeenTable),
+		relays:    newRelayTable(cfg.RelayTotalBandwidth),
 		cfg:       &cfg,
-		publicKey: pub,
+		keyring:   kr,
+		epoch:     time.Now().UnixNano(),
+		changed:   make(chan struct{}),
+	}
+	if cfg.TrackerInterval > 0 {
+		s.tracker = newTracker(time.Duration(cfg.TrackerInterval) * time.Second)
+	}
+	if len(cfg.DataDir) > 0 {
+		s.webSeed = newWebSeedHandler(cfg.DataDir, len(pathData)-1, nil)
 	}
 	if err = s.loadUpdates(); err != nil {
 		return nil, errors.Wrap(err, "failed loading update database")
@@ -120,6 +181,12 @@ func (s *Server) serveTCP() {
 
 func (s *Server) serveHTTPRequest(ctx *fasthttp.RequestCtx) {
 	switch {
+	case bytes.Compare(ctx.Method(), strGET) == 0 && bytes.Compare(ctx.Path(), pathUpdates) == 0:
+		s.servePushRequest(ctx)
+	case bytes.Compare(ctx.Method(), strGET) == 0 && bytes.Compare(ctx.Path(), pathAnnounce) == 0:
+		s.serveAnnounce(ctx)
+	case s.webSeed != nil && bytes.HasPrefix(ctx.Path(), pathData):
+		s.webSeed(ctx)
 	case bytes.Compare(ctx.Method(), strGET) == 0:
 		s.serveGetRequest(ctx)
 	case bytes.Compare(ctx.Method(), strPOST) == 0:
@@ -145,7 +212,7 @@ func (s *Server) servePostRequest(ctx *fasthttp.RequestCtx) {
 		ctx.SetStatusCode(406)
 		return
 	}
-	err = n.Verify(s.publicKey)
+	err = n.Verify(s.keyring)
 	if err != nil {
 		ctx.SetStatusCode(400)
 		return
@@ -162,32 +229,49 @@ func (s *Server) servePostRequest(ctx *fasthttp.RequestCtx) {
 			return
 		}
 	}
+	if n.UUID == UUIDKeyring {
+		if err = s.applyKeyring(&n); err != nil {
+			log.Printf("failed applying keyring version:%d - %v", n.Version, err)
+			ctx.SetStatusCode(400)
+			return
+		}
+	}
 	s.updates[n.UUID] = &n
+	s.modified(n.UUID)
 	s.lastModified = time.Now()
 	ctx.SetStatusCode(200)
 
-	go func() {
-		for i := 0; i < 5; i++ {
-			s.sendUpdateNotificationOverUDP(&n)
-			time.Sleep(time.Second)
-		}
-	}()
+	go s.sendUpdateNotificationOverUDP(&n)
 }
 
+// sendUpdateNotificationOverUDP gossips the notification to a random subset
+// of peers, which will forward it to the others.
 func (s *Server) sendUpdateNotificationOverUDP(n *Notification) {
-	// send notification via UDP
-	w := new(bytes.Buffer)
-	if err := n.Write(w); err != nil {
+	// send notification via UDP, in the compact form if it is too large
+	kind, b, err := n.gossipData(false)
+	if err != nil {
 		log.Printf("sendUpdateNotificationOverUDP - failed generating []byte of notification uuid:%s version:%d - %v", n.UUID, n.Version, err)
 		return
 	}
+	_, data, err := newGossipMessage(kind, b, s.cfg.GossipTTL)
+	if err == nil {
+		data, err = frameMessage(topicGossip, data)
+	}
+	if err != nil {
+		log.Printf("sendUpdateNotificationOverUDP - failed generating gossip message of notification uuid:%s version:%d - %v", n.UUID, n.Version, err)
+		return
+	} else if len(data) > stunMaxPacketDataSize {
+		// peers will receive it from other peers or by reading TCP
+		log.Printf("sendUpdateNotificationOverUDP - notification uuid:%s version:%d is too large (%d bytes)", n.UUID, n.Version, len(data))
+		return
+	}
 	msg := stunMessagePool.Get().(*stun.Message)
 	msg.Reset()
 	defer stunMessagePool.Put(msg)
-	err := msg.Build(
+	err = msg.Build(
 		stun.TransactionID,
 		stunDataIndication,
-		PeerMessage(w.Bytes()),
+		PeerMessage(data),
 		&s.ID,
 		stun.NewShortTermIntegrity(s.cfg.StunPassword),
 		stun.Fingerprint,
@@ -198,7 +282,8 @@ func (s *Server) sendUpdateNotificationOverUDP(n *Notification) {
 
 	s.RLock()
 	defer s.RUnlock()
-	for id, addrs := range s.peers {
+	for _, id := range s.randomPeers(s.cfg.GossipFanout) {
+		addrs := s.peers[id]
 		if err == nil {
 			_, err = s.udpConn.WriteToUDP(msg.Raw, addrs[0])
 		}
@@ -210,6 +295,23 @@ func (s *Server) sendUpdateNotificationOverUDP(n *Notification) {
 	}
 }
 
+// randomPeers returns at most `n` IDs of peers that are randomly selected from
+// the session table. The caller must hold the lock.
+func (s *Server) randomPeers(n int) []PeerID {
+	pids := make([]PeerID, 0, len(s.peers))
+	for id := range s.peers {
+		pids = append(pids, id)
+	}
+	if n > len(pids) {
+		n = len(pids)
+	}
+	selected := make([]PeerID, n)
+	for i, j := range rand.Perm(len(pids))[:n] {
+		selected[i] = pids[j]
+	}
+	return selected
+}
+
 func (s *Server) serveUDP() {
 	conn, err := net.ListenUDP("udp", s.Addr)
 	if err != nil {
@@ -217,8 +319,14 @@ func (s *Server) serveUDP() {
 		return
 	}
 	s.udpConn = conn
+	s.natConns[0][0] = conn
+	if err = s.listenAlternate(); err != nil {
+		log.Printf("NAT discovery is disabled: %v", err)
+	}
 
 	ExecEvery(time.Duration(s.cfg.SessionAdvertiseTime)*time.Second, s.advertiseSessionTable)
+	ExecEvery(time.Duration(s.cfg.SessionAdvertiseTime)*time.Second, s.expirePeers)
+	ExecEvery(time.Duration(s.cfg.SessionAdvertiseTime)*time.Second, s.expireRelays)
 	ExecEvery(time.Duration(s.cfg.SnapshotTime)*time.Second, s.saveUpdates)
 
 	log.Printf("Serving UDP (STUN) at %s with id:%s", s.Addr.String(), s.ID.String())
@@ -228,7 +336,8 @@ func (s *Server) serveUDP() {
 		go s.udpWorker(w, jobs)
 	}
 
-	buf := make([]byte, 2048)
+	// relayed messages can be as large as data indications
+	buf := make([]byte, 64*1024)
 	for {
 		n, addr, err := conn.ReadFrom(buf)
 		if err != nil {
@@ -238,7 +347,13 @@ func (s *Server) serveUDP() {
 
 		msg := buf[:n]
 		if !stun.IsMessage(msg) {
-			log.Printf("message sent by %s is not STUN", addr)
+			if s.tracker != nil && s.cfg.TrackerUDP {
+				if err = s.serveUDPTracker(conn, addr, msg); err != nil {
+					log.Printf("ERROR: serveUDPTracker - %v", err)
+				}
+			} else {
+				log.Printf("message sent by %s is not STUN", addr)
+			}
 			continue
 		}
 
@@ -282,10 +397,20 @@ func (s *Server) processMessage(c net.PacketConn, addr net.Addr, req, res *stun.
 	if err := validateMessage(req, nil, s.cfg.StunPassword); err != nil {
 		return errors.Wrap(err, "Invalid message")
 	}
-	if req.Type == stun.BindingRequest {
-		return s.registerPeer(c, addr, req, res)
+	if isNATDiscoveryRequest(req) {
+		return s.respondNATDiscovery(0, 0, addr, req, res)
 	}
-	return fmt.Errorf("message type is not STUN binding")
+	switch req.Type {
+	case stun.BindingRequest:
+		return s.registerPeer(c, addr, req, res)
+	case stunAllocateRequest:
+		return s.allocateRelay(c, addr, req, res)
+	case stunSendIndication:
+		return s.relayMessage(c, addr, req)
+	case stunConnectRequest:
+		return s.introducePeers(c, addr, req, res)
+	}
+	return fmt.Errorf("message type is not STUN binding, allocate, send, or connect")
 }
 
 func (s *Server) registerPeer(conn net.PacketConn, addr net.Addr, req, res *stun.Message) error {
@@ -378,6 +503,10 @@ func (s *Server) updateSessionTable(
 				Port: torrentPorts[1],
 			},
 		}
+		if s.relays.active(pid) {
+			session = append(session, s.relayAddr())
+		}
+		s.peersSeen[pid] = time.Now()
 		if old, ok := s.peers[pid]; ok && old.Equal(session) {
 			return false, nil
 		}
@@ -425,6 +554,50 @@ func (s *Server) advertiseNewPeer(pid PeerID, c net.PacketConn, msg *stun.Messag
 	}
 }
 
+// expirePeers removes peers that have not sent binding requests within
+// PeerLifetime, then advertises the removal to the remaining peers.
+func (s *Server) expirePeers() {
+	s.Lock()
+	removed := make(SessionTable)
+	for _, pid := range s.peersSeen.Expired(time.Duration(s.cfg.PeerLifetime) * time.Second) {
+		log.Printf("peer %s has expired", pid)
+		delete(s.peers, pid)
+		delete(s.peersSeen, pid)
+		s.relays.Lock()
+		delete(s.relays.allocations, pid)
+		s.relays.Unlock()
+		removed[pid] = Session{}
+	}
+	s.Unlock()
+	if len(removed) == 0 {
+		return
+	}
+
+	msg := stunMessagePool.Get().(*stun.Message)
+	defer stunMessagePool.Put(msg)
+	msg.Reset()
+	err := msg.Build(
+		stun.TransactionID,
+		stunBindingIndication,
+		&s.ID,
+		&removed,
+		stun.NewShortTermIntegrity(s.cfg.StunPassword),
+		stun.Fingerprint,
+	)
+	if err != nil {
+		log.Printf("cannot build message to advertise removed peers: %v", err)
+		return
+	}
+
+	s.RLock()
+	defer s.RUnlock()
+	for pid, addrs := range s.peers {
+		if _, err = s.udpConn.WriteToUDP(msg.Raw, addrs[0]); err != nil {
+			log.Printf("ERROR: failed advertising removed peers to %s[%s] - %v", pid, addrs[0], err)
+		}
+	}
+}
+
 func (s *Server) advertiseSessionTable() {
 	s.RLock()
 	defer s.RUnlock()
@@ -489,6 +662,8 @@ func (s *Server) loadUpdates() error {
 	s.Lock()
 	defer s.Unlock()
 	s.updates = make(map[string]*Notification)
+	s.revisions = make(map[string]uint64)
+	s.infoHashes = make(map[metainfo.Hash]string)
 	if _, err := os.Stat(s.cfg.Database); err != nil {
 		// database file does not exist
 		return nil
@@ -497,5 +672,18 @@ func (s *Server) loadUpdates() error {
 	if err == nil {
 		err = json.NewDecoder(f).Decode(&s.updates)
 	}
+	for uuid := range s.updates {
+		s.revision++
+		s.revisions[uuid] = s.revision
+		s.indexInfoHash(uuid)
+	}
+	// the database holds the keyring notification, which may revoke the keys
+	// of other notifications
+	if n, ok := s.updates[UUIDKeyring]; ok {
+		if err := s.applyKeyring(n); err != nil {
+			log.Printf("failed applying keyring version:%d - %v", n.Version, err)
+		}
+	}
+	s.dropUntrustedUpdates()
 	return err
 }
@@ -0,0 +1,271 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"math/big"
+
+	"github.com/pkg/errors"
+)
+
+// Signature algorithms. A Signature without an algorithm is an RSA
+// signature of an older version.
+const (
+	algorithmRSA     = "rsa-sha256"
+	algorithmECDSA   = "ecdsa-p256-sha256"
+	algorithmEd25519 = "ed25519"
+)
+
+// Signature formats, which define the signed payload. The payload of
+// signatureFormatJSON is the JSON of the notification without signatures,
+// which is only verified for compatibility with older versions. The payload
+// of signatureFormatBencode is the bencoded dictionary of the notification
+// without the "signatures" key, whose keys are sorted, so other tools can
+// produce it. The signature is over the SHA-256 hash of the payload.
+const (
+	signatureFormatJSON    = 0
+	signatureFormatBencode = 1
+)
+
+const (
+	sshKeyRSA       = "ssh-rsa"
+	sshKeyECDSA     = "ecdsa-sha2-nistp256"
+	sshKeyEd25519   = "ssh-ed25519"
+	sshCurveP256    = "nistp256"
+	sshPrivateMagic = "openssh-key-v1\x00"
+)
+
+var errInvalidSSHKey = errors.New("invalid OpenSSH key")
+
+// keyAlgorithm returns the signature algorithm of given public key.
+func keyAlgorithm(pub crypto.PublicKey) (string, error) {
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		return algorithmRSA, nil
+	case *ecdsa.PublicKey:
+		if pub.Curve == elliptic.P256() {
+			return algorithmECDSA, nil
+		}
+		return "", fmt.Errorf("ECDSA curve %s is not supported", pub.Curve.Params().Name)
+	case ed25519.PublicKey:
+		return algorithmEd25519, nil
+	}
+	return "", fmt.Errorf("key type %T is not supported", pub)
+}
+
+// signHashed returns the Signature of given SHA-256 hash using given
+// private key.
+func signHashed(key crypto.Signer, hashed []byte) (Signature, error) {
+	algorithm, err := keyAlgorithm(key.Public())
+	if err != nil {
+		return Signature{}, err
+	}
+	var opts crypto.SignerOpts = crypto.SHA256
+	if algorithm == algorithmEd25519 {
+		// Ed25519 signs the hash as a message
+		opts = crypto.Hash(0)
+	}
+	sig, err := key.Sign(rand.Reader, hashed, opts)
+	if err != nil {
+		return Signature{}, err
+	}
+	s := Signature{Algorithm: algorithm, Signature: sig}
+	if cs, ok := key.(*certificateSigner); ok {
+		s.Certificate = cs.chain
+	}
+	return s, nil
+}
+
+// verifyHashed verifies Signature `s` of given SHA-256 hash using given
+// public key.
+func verifyHashed(pub crypto.PublicKey, hashed []byte, s Signature) error {
+	algorithm, err := keyAlgorithm(pub)
+	if err != nil {
+		return err
+	}
+	if s.Algorithm != algorithm && !(s.Algorithm == "" && algorithm == algorithmRSA) {
+		return fmt.Errorf("signature algorithm '%s' does not match the %s key", s.Algorithm, algorithm)
+	}
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(pub, crypto.SHA256, hashed, s.Signature)
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(pub, hashed, s.Signature) {
+			return errors.New("ecdsa: verification error")
+		}
+	case ed25519.PublicKey:
+		if !ed25519.Verify(pub, hashed, s.Signature) {
+			return errors.New("ed25519: verification error")
+		}
+	}
+	return nil
+}
+
+// sshReader reads the fields of the OpenSSH wire format (RFC 4251).
+type sshReader struct {
+	b   []byte
+	err error
+}
+
+func (r *sshReader) uint32() uint32 {
+	if r.err != nil {
+		return 0
+	}
+	if len(r.b) < 4 {
+		r.err = errInvalidSSHKey
+		return 0
+	}
+	v := binary.BigEndian.Uint32(r.b)
+	r.b = r.b[4:]
+	return v
+}
+
+func (r *sshReader) bytes() []byte {
+	n := r.uint32()
+	if r.err != nil {
+		return nil
+	}
+	if uint64(len(r.b)) < uint64(n) {
+		r.err = errInvalidSSHKey
+		return nil
+	}
+	v := r.b[:n]
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *sshReader) string() string {
+	return string(r.bytes())
+}
+
+func (r *sshReader) mpint() *big.Int {
+	return new(big.Int).SetBytes(r.bytes())
+}
+
+// readSSHPublicKey reads the fields of a public key of given type.
+func readSSHPublicKey(r *sshReader, keyType string) (crypto.PublicKey, error) {
+	var pub crypto.PublicKey
+	switch keyType {
+	case sshKeyRSA:
+		e, n := r.mpint(), r.mpint()
+		if r.err == nil && !e.IsInt64() {
+			return nil, errInvalidSSHKey
+		}
+		pub = &rsa.PublicKey{N: n, E: int(e.Int64())}
+	case sshKeyECDSA:
+		if r.string() != sshCurveP256 && r.err == nil {
+			return nil, errInvalidSSHKey
+		}
+		x, y := elliptic.Unmarshal(elliptic.P256(), r.bytes())
+		if r.err == nil && x == nil {
+			return nil, errInvalidSSHKey
+		}
+		pub = &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}
+	case sshKeyEd25519:
+		b := r.bytes()
+		if r.err == nil && len(b) != ed25519.PublicKeySize {
+			return nil, errInvalidSSHKey
+		}
+		pub = ed25519.PublicKey(b)
+	default:
+		return nil, fmt.Errorf("OpenSSH key type '%s' is not supported", keyType)
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	return pub, nil
+}
+
+// parseOpenSSHPublicKey parses a public key in the authorized_keys format,
+// i.e. `<type> <base64 data> [comment]`.
+func parseOpenSSHPublicKey(line []byte) (crypto.PublicKey, error) {
+	fields := bytes.Fields(line)
+	if len(fields) < 2 {
+		return nil, errInvalidSSHKey
+	}
+	data, err := base64.StdEncoding.DecodeString(string(fields[1]))
+	if err != nil {
+		return nil, errInvalidSSHKey
+	}
+	r := sshReader{b: data}
+	if keyType := r.string(); r.err != nil || keyType != string(fields[0]) {
+		return nil, errInvalidSSHKey
+	}
+	return readSSHPublicKey(&r, string(fields[0]))
+}
+
+// parseOpenSSHPrivateKey parses the content of an unencrypted
+// "OPENSSH PRIVATE KEY" PEM block.
+func parseOpenSSHPrivateKey(b []byte) (crypto.Signer, error) {
+	if !bytes.HasPrefix(b, []byte(sshPrivateMagic)) {
+		return nil, errInvalidSSHKey
+	}
+	r := sshReader{b: b[len(sshPrivateMagic):]}
+	cipher, kdf := r.string(), r.string()
+	r.bytes() // kdf options
+	n := r.uint32()
+	if r.err != nil {
+		return nil, r.err
+	} else if cipher != "none" || kdf != "none" {
+		return nil, fmt.Errorf("encrypted OpenSSH keys are not supported")
+	} else if n != 1 {
+		return nil, fmt.Errorf("OpenSSH file has %d keys, expected 1", n)
+	}
+	r.bytes() // public key
+	r = sshReader{b: r.bytes(), err: r.err}
+	if check1, check2 := r.uint32(), r.uint32(); r.err == nil && check1 != check2 {
+		return nil, errInvalidSSHKey
+	}
+	keyType := r.string()
+	if r.err != nil {
+		return nil, r.err
+	}
+	if keyType == sshKeyRSA {
+		n, e, d, _, p, q := r.mpint(), r.mpint(), r.mpint(), r.mpint(), r.mpint(), r.mpint()
+		if r.err != nil || !e.IsInt64() {
+			return nil, errInvalidSSHKey
+		}
+		key := &rsa.PrivateKey{
+			PublicKey: rsa.PublicKey{N: n, E: int(e.Int64())},
+			D:         d,
+			Primes:    []*big.Int{p, q},
+		}
+		if err := key.Validate(); err != nil {
+			return nil, err
+		}
+		key.Precompute()
+		return key, nil
+	}
+	pub, err := readSSHPublicKey(&r, keyType)
+	if err != nil {
+		return nil, err
+	}
+	switch pub := pub.(type) {
+	case *ecdsa.PublicKey:
+		d := r.mpint()
+		if r.err != nil {
+			return nil, r.err
+		}
+		return &ecdsa.PrivateKey{PublicKey: *pub, D: d}, nil
+	case ed25519.PublicKey:
+		// the private key is the seed followed by the public key
+		b := r.bytes()
+		if r.err != nil || len(b) != ed25519.PrivateKeySize || !pub.Equal(ed25519.PrivateKey(b).Public()) {
+			return nil, errInvalidSSHKey
+		}
+		return ed25519.PrivateKey(b), nil
+	}
+	return nil, errInvalidSSHKey
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/zeebo/bencode"
+)
+
+func sshString(b []byte) []byte {
+	l := make([]byte, 4)
+	binary.BigEndian.PutUint32(l, uint32(len(b)))
+	return append(l, b...)
+}
+
+// sshKeys returns the OpenSSH public key and private key blocks of an
+// Ed25519 key.
+func sshKeys(key ed25519.PrivateKey) ([]byte, []byte) {
+	pub := append(sshString([]byte(sshKeyEd25519)), sshString(key.Public().(ed25519.PublicKey))...)
+	priv := []byte{0, 0, 0, 1, 0, 0, 0, 1}
+	priv = append(priv, pub...)
+	priv = append(priv, sshString(key)...)
+	priv = append(priv, sshString([]byte("comment"))...)
+	for i := byte(1); len(priv)%8 != 0; i++ {
+		priv = append(priv, i)
+	}
+	b := []byte(sshPrivateMagic)
+	for _, s := range [][]byte{[]byte("none"), []byte("none"), nil} {
+		b = append(b, sshString(s)...)
+	}
+	b = append(b, 0, 0, 0, 1)
+	b = append(b, sshString(pub)...)
+	b = append(b, sshString(priv)...)
+	line := sshKeyEd25519 + " " + base64.StdEncoding.EncodeToString(pub) + " comment\n"
+	return []byte(line), pem.EncodeToMemory(&pem.Block{Type: "OPENSSH PRIVATE KEY", Bytes: b})
+}
+
+func TestLoadKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 1024)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	sshPub, sshPriv := sshKeys(edKey)
+
+	pemFile := func(typ string, b []byte, err error) []byte {
+		if err != nil {
+			t.Fatal(err)
+		}
+		return pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: b})
+	}
+	pkcs8 := func(key interface{}) []byte {
+		b, err := x509.MarshalPKCS8PrivateKey(key)
+		return pemFile("PRIVATE KEY", b, err)
+	}
+	pkix := func(pub interface{}) []byte {
+		b, err := x509.MarshalPKIXPublicKey(pub)
+		return pemFile("PUBLIC KEY", b, err)
+	}
+
+	for _, tc := range []struct {
+		name      string
+		priv, pub []byte
+		algorithm string
+	}{
+		{"rsa-pkcs1", pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)}),
+			pkix(&rsaKey.PublicKey), algorithmRSA},
+		{"ecdsa-pkcs8", pkcs8(ecKey), pkix(&ecKey.PublicKey), algorithmECDSA},
+		{"ed25519-pkcs8", pkcs8(edKey), pkix(edKey.Public()), algorithmEd25519},
+		{"ed25519-openssh", sshPriv, sshPub, algorithmEd25519},
+	} {
+		privFile, pubFile := filepath.Join(dir, tc.name), filepath.Join(dir, tc.name+".pub")
+		ioutil.WriteFile(privFile, tc.priv, 0600)
+		ioutil.WriteFile(pubFile, tc.pub, 0644)
+		key, err := LoadPrivateKey(privFile)
+		if err != nil {
+			t.Errorf("%s: failed loading private key: %v", tc.name, err)
+			continue
+		}
+		pub, err := LoadPublicKey(pubFile)
+		if err != nil {
+			t.Errorf("%s: failed loading public key: %v", tc.name, err)
+			continue
+		}
+
+		n := newTestNotification(t, key)
+		if s := n.Signatures[signatureName]; s.Algorithm != tc.algorithm {
+			t.Errorf("%s: got algorithm '%s'", tc.name, s.Algorithm)
+		}
+		if err = n.Verify(newTestKeyring(t, 1, pub)); err != nil {
+			t.Errorf("%s: failed verifying notification: %v", tc.name, err)
+		}
+		if err = n.Verify(newTestKeyring(t, 1, &rsaKey.PublicKey)); err == nil && tc.algorithm != algorithmRSA {
+			t.Errorf("%s: notification should not be verified with another key", tc.name)
+		}
+	}
+
+	ioutil.WriteFile(filepath.Join(dir, "invalid"), []byte("ssh-ed25519 AAAA"), 0644)
+	if _, err = LoadPublicKey(filepath.Join(dir, "invalid")); err == nil {
+		t.Errorf("an invalid public key should not be loaded")
+	}
+}
+
+func TestVerifyLegacySignature(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hashed := make([]byte, 32)
+	rand.Read(hashed)
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hashed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = verifyHashed(&key.PublicKey, hashed, Signature{Signature: sig}); err != nil {
+		t.Errorf("failed verifying a signature without algorithm: %v", err)
+	}
+	if err = verifyHashed(&key.PublicKey, hashed, Signature{Algorithm: algorithmEd25519, Signature: sig}); err == nil {
+		t.Errorf("a signature of another algorithm should not be verified")
+	}
+}
+
+func TestCanonicalSignature(t *testing.T) {
+	pub, key, _ := ed25519.GenerateKey(rand.Reader)
+	kr := newTestKeyring(t, 1, pub)
+	n := newTestNotification(t, key)
+	n.Nodes = []metainfo.Node{"127.0.0.1:6881"}
+	n.URLList = []string{"http://localhost/data/"}
+	if err := n.Sign(key); err != nil {
+		t.Fatal(err)
+	}
+	if s := n.Signatures[signatureName]; s.Format != signatureFormatBencode {
+		t.Errorf("got signature format %d", s.Format)
+	}
+
+	// the payload is the bencoded notification without signatures, which
+	// can be produced from the decoded dictionary
+	var b bytes.Buffer
+	if err := n.Write(&b); err != nil {
+		t.Fatal(err)
+	}
+	var dict map[string]interface{}
+	if err := bencode.DecodeBytes(b.Bytes(), &dict); err != nil {
+		t.Fatal(err)
+	}
+	delete(dict, "signatures")
+	payload, err := bencode.EncodeBytes(dict)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hashed, _ := n.hashed(signatureFormatBencode)
+	if h := sha256.Sum256(payload); !bytes.Equal(h[:], hashed) {
+		t.Errorf("signed payload is not the bencoded dictionary without signatures")
+	}
+
+	// signatures survive the JSON and bencode encodings
+	var jn Notification
+	data, _ := json.Marshal(n)
+	if err = json.Unmarshal(data, &jn); err != nil {
+		t.Fatal(err)
+	} else if err = jn.Verify(kr); err != nil {
+		t.Errorf("failed verifying notification decoded from JSON: %v", err)
+	}
+	bn, err := ReadNotification(&b)
+	if err != nil {
+		t.Fatal(err)
+	} else if err = bn.Verify(kr); err != nil {
+		t.Errorf("failed verifying notification decoded from bencode: %v", err)
+	}
+
+	// legacy signatures over JSON are verified unless they are rejected
+	legacy := *n
+	legacy.Signatures = nil
+	hashed, _ = legacy.hashed(signatureFormatJSON)
+	s, err := signHashed(key, hashed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacy.Signatures = map[string]Signature{signatureName: s}
+	if err = legacy.Verify(kr); err != nil {
+		t.Errorf("failed verifying legacy signature: %v", err)
+	}
+	kr.RejectLegacy = true
+	if err = legacy.Verify(kr); err == nil {
+		t.Errorf("legacy signature should be rejected")
+	}
+	if err = n.Verify(kr); err != nil {
+		t.Errorf("failed verifying signature with legacy signatures rejected: %v", err)
+	}
+}
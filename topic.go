@@ -0,0 +1,151 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// frameVersion is the first byte of the framing header of overlay messages.
+// The header is followed by the topic length (1 byte), the topic, and the data.
+const frameVersion = 0x01
+
+// topicDefault is the topic of messages that are read by Read and ReadMsgFrom.
+const topicDefault = ""
+
+// topicBufferSize is the number of messages buffered for each topic.
+const topicBufferSize = 16
+
+var (
+	errInvalidFrame      = errors.New("invalid message frame")
+	errAlreadySubscribed = errors.New("topic has been subscribed")
+)
+
+// MessageHandler handles a message of a topic sent by a peer.
+type MessageHandler func(pid PeerID, data []byte)
+
+// frameMessage returns given data prefixed by the framing header of a topic.
+func frameMessage(topic string, data []byte) ([]byte, error) {
+	if len(topic) > 255 {
+		return nil, fmt.Errorf("topic '%s' is longer than 255 bytes", topic)
+	}
+	b := make([]byte, 0, 2+len(topic)+len(data))
+	b = append(b, frameVersion, byte(len(topic)))
+	b = append(b, topic...)
+	return append(b, data...), nil
+}
+
+// parseFrame returns the topic and data of a framed message.
+func parseFrame(b []byte) (string, []byte, error) {
+	if len(b) < 2 || b[0] != frameVersion || len(b) < 2+int(b[1]) {
+		return "", nil, errInvalidFrame
+	}
+	n := 2 + int(b[1])
+	return string(b[2:n]), b[n:], nil
+}
+
+// overlayTopics holds the message buffers of the topics that have been
+// subscribed.
+type overlayTopics struct {
+	sync.RWMutex
+	channels map[string]chan peerData
+}
+
+func newOverlayTopics() *overlayTopics {
+	return &overlayTopics{
+		channels: map[string]chan peerData{
+			topicDefault: make(chan peerData, topicBufferSize),
+		},
+	}
+}
+
+func (ts *overlayTopics) channel(topic string) (chan peerData, bool) {
+	ts.RLock()
+	defer ts.RUnlock()
+	c, ok := ts.channels[topic]
+	return c, ok
+}
+
+// Subscribe registers a handler of messages of given topic. The handler is
+// called by a goroutine of the topic, hence a slow handler only holds up its
+// own topic.
+func (overlay *OverlayConn) Subscribe(topic string, handler MessageHandler) error {
+	overlay.topics.Lock()
+	defer overlay.topics.Unlock()
+	if _, ok := overlay.topics.channels[topic]; ok {
+		return errAlreadySubscribed
+	}
+	c := make(chan peerData, topicBufferSize)
+	overlay.topics.channels[topic] = c
+	go func() {
+		for pd := range c {
+			handler(pd.pid, pd.data)
+		}
+	}()
+	return nil
+}
+
+// Unsubscribe removes the handler of given topic.
+func (overlay *OverlayConn) Unsubscribe(topic string) {
+	if topic == topicDefault {
+		return
+	}
+	overlay.topics.Lock()
+	defer overlay.topics.Unlock()
+	if c, ok := overlay.topics.channels[topic]; ok {
+		delete(overlay.topics.channels, topic)
+		close(c)
+	}
+}
+
+// dispatch passes a framed message to the subscriber of its topic.
+func (overlay *OverlayConn) dispatch(pid PeerID, b []byte) error {
+	topic, data, err := parseFrame(b)
+	if err != nil {
+		return errors.Wrapf(err, "%s sent a message without valid frame", pid)
+	}
+	overlay.topics.RLock()
+	defer overlay.topics.RUnlock()
+	c, ok := overlay.topics.channels[topic]
+	if !ok {
+		log.Printf("<- %s sent a message of unsubscribed topic '%s'", pid, topic)
+		return nil
+	}
+	select {
+	case c <- peerData{pid: pid, data: data}:
+		return nil
+	default:
+		return errBufferFull
+	}
+}
+
+// WriteTopicTo sends a message of given topic to given peers, or to all peers
+// when `pids` is nil.
+func (overlay *OverlayConn) WriteTopicTo(topic string, b []byte, pids []PeerID) (int, error) {
+	frame, err := frameMessage(topic, b)
+	if err != nil {
+		return 0, err
+	}
+	if _, err = overlay.writeFrameTo(frame, pids); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// DeliverTopicTo sends a message of given topic like DeliverMsgTo.
+func (overlay *OverlayConn) DeliverTopicTo(topic string, b []byte, pids []PeerID, done func(PeerID, error)) (int, error) {
+	frame, err := frameMessage(topic, b)
+	if err != nil {
+		return 0, err
+	}
+	if _, err = overlay.deliverFrameTo(frame, pids, done); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
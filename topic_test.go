@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestFrameMessage(t *testing.T) {
+	b, err := frameMessage("digest", []byte("hello"))
+	if err != nil {
+		t.Fatalf("failed framing message: %v", err)
+	}
+	topic, data, err := parseFrame(b)
+	if err != nil {
+		t.Fatalf("failed parsing frame: %v", err)
+	} else if topic != "digest" || !bytes.Equal(data, []byte("hello")) {
+		t.Errorf("frame: got (%s, %s), expected (digest, hello)", topic, data)
+	}
+
+	for _, b := range [][]byte{nil, []byte("d2:id"), {frameVersion, 3, 'a'}} {
+		if _, _, err = parseFrame(b); err != errInvalidFrame {
+			t.Errorf("parsing %v: got %v, expected %v", b, err, errInvalidFrame)
+		}
+	}
+	if _, err = frameMessage(string(make([]byte, 256)), nil); err == nil {
+		t.Errorf("a topic longer than 255 bytes should be rejected")
+	}
+}
+
+func TestDispatch(t *testing.T) {
+	overlay := &OverlayConn{topics: newOverlayTopics()}
+	received := make(chan string, 1)
+	if err := overlay.Subscribe("status", func(pid PeerID, data []byte) {
+		received <- string(data)
+	}); err != nil {
+		t.Fatalf("failed subscribing: %v", err)
+	}
+	if err := overlay.Subscribe("status", nil); err != errAlreadySubscribed {
+		t.Errorf("subscribing twice: got %v, expected %v", err, errAlreadySubscribed)
+	}
+
+	b, _ := frameMessage("status", []byte("ok"))
+	if err := overlay.dispatch(PeerID{}, b); err != nil {
+		t.Fatalf("failed dispatching: %v", err)
+	}
+	select {
+	case data := <-received:
+		if data != "ok" {
+			t.Errorf("data: got %s, expected ok", data)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("the handler has not been called")
+	}
+
+	b, _ = frameMessage(topicDefault, []byte("default"))
+	for i := 0; i < topicBufferSize; i++ {
+		if err := overlay.dispatch(PeerID{}, b); err != nil {
+			t.Fatalf("failed dispatching: %v", err)
+		}
+	}
+	if err := overlay.dispatch(PeerID{}, b); err != errBufferFull {
+		t.Errorf("dispatching to a full topic: got %v, expected %v", err, errBufferFull)
+	}
+
+	overlay.Unsubscribe("status")
+	b, _ = frameMessage("status", []byte("ok"))
+	if err := overlay.dispatch(PeerID{}, b); err != nil {
+		t.Errorf("dispatching an unsubscribed topic: got %v, expected nil", err)
+	}
+}
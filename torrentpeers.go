@@ -0,0 +1,95 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"log"
+	"net"
+
+	"github.com/anacrolix/torrent"
+)
+
+// torrentAddr returns the address of a peer's torrent client, which is
+// the internal address when the peer is behind the same NAT, otherwise
+// the external address. It returns nil if the session has no torrent
+// addresses. The caller must hold the lock.
+func (overlay *OverlayConn) torrentAddr(sess Session) *net.UDPAddr {
+	if len(sess) < 4 {
+		return nil
+	}
+	addr := sess[2]
+	if overlay.externalAddr != nil && sess[2].IP.Equal(overlay.externalAddr.IP) {
+		addr = sess[3]
+	}
+	if addr.Port <= 0 {
+		return nil
+	}
+	return addr
+}
+
+// TorrentAddrs returns the addresses of the torrent clients of given peers,
+// or all peers when `pids` is nil, excluding this overlay.
+func (overlay *OverlayConn) TorrentAddrs(pids []PeerID) []*net.UDPAddr {
+	overlay.RLock()
+	defer overlay.RUnlock()
+	var addrs []*net.UDPAddr
+	for _, sess := range overlay.sessions(pids) {
+		if addr := overlay.torrentAddr(sess); addr != nil {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+// peersAdded passes the peers that have been added to the session table
+// to the handler of the configuration.
+func (overlay *OverlayConn) peersAdded(pids []PeerID) {
+	if len(pids) > 0 && overlay.Config.peersAdded != nil {
+		go overlay.Config.peersAdded(pids)
+	}
+}
+
+// torrentPeers returns the torrent clients of given overlay peers, or all
+// peers when `pids` is nil.
+func (c *Cluster) torrentPeers(pids []PeerID) []torrent.Peer {
+	if c.Overlay == nil {
+		return nil
+	}
+	addrs := c.Overlay.TorrentAddrs(pids)
+	peers := make([]torrent.Peer, len(addrs))
+	for i, addr := range addrs {
+		peers[i] = torrent.Peer{
+			IP:   addr.IP,
+			Port: addr.Port,
+		}
+	}
+	return peers
+}
+
+// addTorrentPeers adds the torrent clients of given overlay peers to
+// the torrents of the cluster's updates, so that the torrents do not depend
+// on trackers or DHT to find each other.
+func (c *Cluster) addTorrentPeers(pids []PeerID) {
+	c.addDHTNodes(pids)
+	peers := c.torrentPeers(pids)
+	if len(peers) == 0 {
+		return
+	}
+	c.agent.RLock()
+	updates := make([]*Update, 0, len(c.updates))
+	for _, u := range c.updates {
+		updates = append(updates, u)
+	}
+	c.agent.RUnlock()
+
+	for _, u := range updates {
+		u.Lock()
+		if u.torrent != nil {
+			u.torrent.AddPeers(peers)
+		}
+		u.Unlock()
+	}
+	log.Printf("addTorrentPeers[%s] - added %d peers to %d torrents", c.Name, len(peers), len(updates))
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTorrentAddrs(t *testing.T) {
+	overlay := newTestOverlay(OverlayConfig{PeerLifetime: 300})
+	overlay.externalAddr = &net.UDPAddr{IP: net.IPv4(1, 1, 1, 1), Port: 3478}
+	session := func(external net.IP, port int) Session {
+		return Session{
+			&net.UDPAddr{IP: external, Port: 1000},
+			&net.UDPAddr{IP: net.IPv4(192, 168, 0, 2), Port: 1000},
+			&net.UDPAddr{IP: external, Port: port},
+			&net.UDPAddr{IP: net.IPv4(192, 168, 0, 2), Port: port},
+		}
+	}
+	overlay.peers[overlay.ID] = session(net.IPv4(1, 1, 1, 1), 6881)
+	overlay.peers[PeerID{2}] = session(net.IPv4(1, 1, 1, 1), 6882)
+	overlay.peers[PeerID{3}] = session(net.IPv4(2, 2, 2, 2), 6883)
+	overlay.peers[PeerID{4}] = session(net.IPv4(2, 2, 2, 2), 0)
+	overlay.peers[PeerID{5}] = testSession(6885)
+
+	addrs := overlay.TorrentAddrs(nil)
+	if len(addrs) != 2 {
+		t.Fatalf("addresses: got %v, expected 2 addresses", addrs)
+	}
+	for _, addr := range addrs {
+		switch addr.Port {
+		case 6882:
+			if !addr.IP.Equal(net.IPv4(192, 168, 0, 2)) {
+				t.Errorf("a peer behind the same NAT should be reached internally, got %s", addr)
+			}
+		case 6883:
+			if !addr.IP.Equal(net.IPv4(2, 2, 2, 2)) {
+				t.Errorf("other peers should be reached externally, got %s", addr)
+			}
+		default:
+			t.Errorf("unexpected address %s", addr)
+		}
+	}
+	if addrs = overlay.TorrentAddrs([]PeerID{{3}}); len(addrs) != 1 || addrs[0].Port != 6883 {
+		t.Errorf("addresses of %s: got %v", PeerID{3}, addrs)
+	}
+}
+
+func TestPeersAdded(t *testing.T) {
+	added := make(chan []PeerID, 1)
+	overlay := newTestOverlay(OverlayConfig{
+		PeerLifetime: 300,
+		peersAdded:   func(pids []PeerID) { added <- pids },
+	})
+	overlay.peers[PeerID{2}] = testSession(2000)
+	overlay.peersSeen[PeerID{2}] = time.Now().Add(-time.Minute)
+	overlay.mergePeers(peerExchange{
+		PeerID{2}: {Session: testSession(2000), Age: 1},
+		PeerID{3}: {Session: testSession(3000), Age: 1},
+	})
+	select {
+	case pids := <-added:
+		if len(pids) != 1 || pids[0] != (PeerID{3}) {
+			t.Errorf("added peers: got %v, expected [%s]", pids, PeerID{3})
+		}
+	case <-time.After(time.Second):
+		t.Errorf("the handler has not been called")
+	}
+}
@@ -0,0 +1,352 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	torrentbencode "github.com/anacrolix/torrent/bencode"
+	"github.com/anacrolix/torrent/metainfo"
+	bttracker "github.com/anacrolix/torrent/tracker"
+	"github.com/pkg/errors"
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	// trackerMaxPeers is the maximum number of peers in an announce response
+	trackerMaxPeers = 50
+
+	// udpTrackerProtocolID is the connection ID of UDP connect requests (BEP 15)
+	udpTrackerProtocolID = 0x41727101980
+
+	// udpTrackerConnectionLifetime is the lifetime of UDP connection IDs
+	udpTrackerConnectionLifetime = 2 * time.Minute
+)
+
+var (
+	pathAnnounce = []byte("/announce")
+
+	errUnknownInfoHash = errors.New("unknown info hash")
+)
+
+// trackerPeer is a peer of a swarm.
+type trackerPeer struct {
+	IP      net.IP
+	Port    int
+	left    uint64
+	expired time.Time
+}
+
+// compactPeers returns the compact peer list (BEP 23 and BEP 7) of given peers
+// that have IP addresses of `size` bytes.
+func compactPeers(peers []trackerPeer, size int) []byte {
+	var buf bytes.Buffer
+	for _, p := range peers {
+		ip := p.IP.To4()
+		if size == net.IPv6len && ip == nil {
+			ip = p.IP.To16()
+		} else if size == net.IPv6len {
+			continue
+		}
+		if ip == nil {
+			continue
+		}
+		buf.Write(ip)
+		binary.Write(&buf, binary.BigEndian, uint16(p.Port))
+	}
+	return buf.Bytes()
+}
+
+// tracker is a BitTorrent tracker of the server. It only tracks the swarms of
+// the info-hashes that are accepted by the server.
+type tracker struct {
+	sync.Mutex
+	interval time.Duration
+	swarms   map[metainfo.Hash]map[[20]byte]*trackerPeer
+	secret   []byte
+}
+
+func newTracker(interval time.Duration) *tracker {
+	t := &tracker{
+		interval: interval,
+		swarms:   make(map[metainfo.Hash]map[[20]byte]*trackerPeer),
+		secret:   make([]byte, 16),
+	}
+	crand.Read(t.secret)
+	return t
+}
+
+// announce updates the peer of given request in its swarm, then returns
+// the other peers of the swarm, and the numbers of seeders and leechers.
+func (t *tracker) announce(req *bttracker.AnnounceRequest, ip net.IP) ([]trackerPeer, int32, int32) {
+	var (
+		ih       = metainfo.Hash(req.InfoHash)
+		now      = time.Now()
+		peers    []trackerPeer
+		seeders  int32
+		leechers int32
+	)
+
+	t.Lock()
+	defer t.Unlock()
+	swarm, ok := t.swarms[ih]
+	if !ok {
+		swarm = make(map[[20]byte]*trackerPeer)
+		t.swarms[ih] = swarm
+	}
+	if req.Event == bttracker.Stopped {
+		delete(swarm, req.PeerId)
+	} else {
+		swarm[req.PeerId] = &trackerPeer{
+			IP:      ip,
+			Port:    int(req.Port),
+			left:    req.Left,
+			expired: now.Add(2 * t.interval),
+		}
+	}
+	for id, p := range swarm {
+		if now.After(p.expired) {
+			delete(swarm, id)
+			continue
+		} else if p.left == 0 {
+			seeders++
+		} else {
+			leechers++
+		}
+		if id != req.PeerId {
+			peers = append(peers, *p)
+		}
+	}
+
+	n := int(req.NumWant)
+	if n <= 0 || n > trackerMaxPeers {
+		n = trackerMaxPeers
+	}
+	if n > len(peers) {
+		n = len(peers)
+	}
+	selected := make([]trackerPeer, n)
+	for i, j := range rand.Perm(len(peers))[:n] {
+		selected[i] = peers[j]
+	}
+	return selected, seeders, leechers
+}
+
+// remove removes the swarm of given info-hash.
+func (t *tracker) remove(ih metainfo.Hash) {
+	t.Lock()
+	defer t.Unlock()
+	delete(t.swarms, ih)
+}
+
+// connectionID returns the UDP connection ID of given address that is issued
+// in the `n`-th period of udpTrackerConnectionLifetime.
+func (t *tracker) connectionID(addr *net.UDPAddr, n int64) int64 {
+	h := sha256.New()
+	h.Write(t.secret)
+	h.Write(addr.IP)
+	binary.Write(h, binary.BigEndian, int64(addr.Port))
+	binary.Write(h, binary.BigEndian, n)
+	return int64(binary.BigEndian.Uint64(h.Sum(nil)) &^ (1 << 63))
+}
+
+// validConnectionID returns true if given connection ID has been issued to
+// the address within udpTrackerConnectionLifetime.
+func (t *tracker) validConnectionID(addr *net.UDPAddr, id int64) bool {
+	n := time.Now().UnixNano() / int64(udpTrackerConnectionLifetime)
+	return id == t.connectionID(addr, n) || id == t.connectionID(addr, n-1)
+}
+
+// indexInfoHash updates the info-hashes of the notification of given UUID,
+// which are of its payload and of its patch if any. The caller must hold
+// the lock.
+func (s *Server) indexInfoHash(uuid string) {
+	for ih, u := range s.infoHashes {
+		if u == uuid {
+			delete(s.infoHashes, ih)
+			if s.tracker != nil {
+				s.tracker.remove(ih)
+			}
+		}
+	}
+	if n, ok := s.updates[uuid]; ok {
+		if ih, err := n.infoHash(); err != nil {
+			log.Printf("failed computing info-hash of notification uuid:%s - %v", uuid, err)
+		} else {
+			s.infoHashes[ih] = uuid
+		}
+		if n.Delta == nil {
+			return
+		}
+		if ih, err := n.Delta.infoHash(n); err != nil {
+			log.Printf("failed computing info-hash of the patch of notification uuid:%s - %v", uuid, err)
+		} else {
+			s.infoHashes[ih] = uuid
+		}
+	}
+}
+
+// knownInfoHash returns true if given info-hash belongs to a notification of
+// the server.
+func (s *Server) knownInfoHash(ih metainfo.Hash) bool {
+	s.RLock()
+	defer s.RUnlock()
+	_, ok := s.infoHashes[ih]
+	return ok
+}
+
+// serveAnnounce serves an HTTP announce request (BEP 3).
+func (s *Server) serveAnnounce(ctx *fasthttp.RequestCtx) {
+	var (
+		req  bttracker.AnnounceRequest
+		args = ctx.QueryArgs()
+	)
+
+	failure := func(reason string) {
+		b, _ := torrentbencode.Marshal(map[string]string{"failure reason": reason})
+		ctx.SetStatusCode(200)
+		ctx.Write(b)
+	}
+	if s.tracker == nil {
+		ctx.SetStatusCode(404)
+		return
+	}
+	ih, id := args.Peek("info_hash"), args.Peek("peer_id")
+	if len(ih) != len(req.InfoHash) || len(id) != len(req.PeerId) {
+		failure("invalid info_hash or peer_id")
+		return
+	}
+	copy(req.InfoHash[:], ih)
+	copy(req.PeerId[:], id)
+	if !s.knownInfoHash(req.InfoHash) {
+		failure(errUnknownInfoHash.Error())
+		return
+	}
+	port, err := args.GetUint("port")
+	if err != nil || port <= 0 || port > 65535 {
+		failure("invalid port")
+		return
+	}
+	req.Port = uint16(port)
+	if n, err := args.GetUint("left"); err == nil {
+		req.Left = uint64(n)
+	}
+	if n, err := args.GetUint("numwant"); err == nil {
+		req.NumWant = int32(n)
+	}
+	switch string(args.Peek("event")) {
+	case "started":
+		req.Event = bttracker.Started
+	case "completed":
+		req.Event = bttracker.Completed
+	case "stopped":
+		req.Event = bttracker.Stopped
+	}
+
+	peers, seeders, leechers := s.tracker.announce(&req, ctx.RemoteIP())
+	res := map[string]interface{}{
+		"interval":   int(s.tracker.interval / time.Second),
+		"complete":   seeders,
+		"incomplete": leechers,
+	}
+	if string(args.Peek("compact")) == "0" {
+		list := make([]map[string]interface{}, len(peers))
+		for i, p := range peers {
+			list[i] = map[string]interface{}{"ip": p.IP.String(), "port": p.Port}
+		}
+		res["peers"] = list
+	} else {
+		res["peers"] = compactPeers(peers, net.IPv4len)
+		if b := compactPeers(peers, net.IPv6len); len(b) > 0 {
+			res["peers6"] = b
+		}
+	}
+	b, err := torrentbencode.Marshal(res)
+	if err != nil {
+		log.Printf("serveAnnounce - failed encoding response: %v", err)
+		ctx.SetStatusCode(500)
+		return
+	}
+	ctx.SetStatusCode(200)
+	ctx.Write(b)
+}
+
+// serveUDPTracker serves a UDP tracker request (BEP 15) that is sent to
+// the STUN port.
+func (s *Server) serveUDPTracker(conn net.PacketConn, addr net.Addr, msg []byte) error {
+	var (
+		header bttracker.RequestHeader
+		r      = bytes.NewReader(msg)
+	)
+
+	uaddr, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return fmt.Errorf("%s is not a UDP address", addr)
+	} else if err := binary.Read(r, binary.BigEndian, &header); err != nil {
+		return errors.Wrapf(err, "%s sent an invalid tracker request", addr)
+	}
+	reply := func(parts ...interface{}) error {
+		var buf bytes.Buffer
+		for _, p := range parts {
+			if err := binary.Write(&buf, binary.BigEndian, p); err != nil {
+				return err
+			}
+		}
+		_, err := conn.WriteTo(buf.Bytes(), addr)
+		return err
+	}
+	replyError := func(reason string) error {
+		return reply(bttracker.ResponseHeader{
+			Action:        bttracker.ActionError,
+			TransactionId: header.TransactionId,
+		}, []byte(reason))
+	}
+
+	switch header.Action {
+	case bttracker.ActionConnect:
+		if header.ConnectionId != udpTrackerProtocolID {
+			return fmt.Errorf("%s sent a connect request with invalid protocol ID", addr)
+		}
+		n := time.Now().UnixNano() / int64(udpTrackerConnectionLifetime)
+		return reply(bttracker.ResponseHeader{
+			Action:        bttracker.ActionConnect,
+			TransactionId: header.TransactionId,
+		}, bttracker.ConnectionResponse{
+			ConnectionId: s.tracker.connectionID(uaddr, n),
+		})
+	case bttracker.ActionAnnounce:
+		var req bttracker.AnnounceRequest
+		if !s.tracker.validConnectionID(uaddr, header.ConnectionId) {
+			return replyError("invalid connection ID")
+		} else if err := binary.Read(r, binary.BigEndian, &req); err != nil {
+			return replyError("invalid announce request")
+		} else if !s.knownInfoHash(req.InfoHash) {
+			return replyError(errUnknownInfoHash.Error())
+		}
+		peers, seeders, leechers := s.tracker.announce(&req, uaddr.IP)
+		size := net.IPv4len
+		if uaddr.IP.To4() == nil {
+			size = net.IPv6len
+		}
+		return reply(bttracker.ResponseHeader{
+			Action:        bttracker.ActionAnnounce,
+			TransactionId: header.TransactionId,
+		}, bttracker.AnnounceResponseHeader{
+			Interval: int32(s.tracker.interval / time.Second),
+			Leechers: leechers,
+			Seeders:  seeders,
+		}, compactPeers(peers, size))
+	}
+	return replyError("action is not supported")
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+
+	torrentbencode "github.com/anacrolix/torrent/bencode"
+	"github.com/anacrolix/torrent/metainfo"
+	bttracker "github.com/anacrolix/torrent/tracker"
+	"github.com/valyala/fasthttp"
+)
+
+func newTestTrackerServer(t *testing.T) (*Server, metainfo.Hash) {
+	n := &Notification{
+		UUID:    "a",
+		Version: 1,
+		Info:    metainfo.Info{Name: "a", PieceLength: minPieceLength, Length: 1},
+	}
+	s := &Server{
+		cfg:        &ServerConfig{TrackerInterval: 60, TrackerUDP: true},
+		tracker:    newTracker(time.Minute),
+		updates:    map[string]*Notification{"a": n},
+		infoHashes: make(map[metainfo.Hash]string),
+	}
+	s.indexInfoHash("a")
+	ih, err := n.infoHash()
+	if err != nil {
+		t.Fatalf("failed computing info-hash: %v", err)
+	}
+	return s, ih
+}
+
+func TestTrackerAnnounce(t *testing.T) {
+	tr := newTracker(time.Minute)
+	req := bttracker.AnnounceRequest{InfoHash: [20]byte{1}, PeerId: [20]byte{1}, Port: 1000}
+	if peers, _, leechers := tr.announce(&req, net.IPv4(10, 0, 0, 1)); len(peers) != 0 || leechers != 0 {
+		t.Errorf("first announce: got %d peers and %d leechers, expected none", len(peers), leechers)
+	}
+
+	req2 := bttracker.AnnounceRequest{InfoHash: [20]byte{1}, PeerId: [20]byte{2}, Port: 2000, Left: 10}
+	peers, seeders, leechers := tr.announce(&req2, net.IPv4(10, 0, 0, 2))
+	if len(peers) != 1 || peers[0].Port != 1000 {
+		t.Errorf("peers: got %v, expected the first peer", peers)
+	} else if seeders != 1 || leechers != 1 {
+		t.Errorf("got %d seeders and %d leechers, expected 1 and 1", seeders, leechers)
+	}
+
+	req.Event = bttracker.Stopped
+	tr.announce(&req, net.IPv4(10, 0, 0, 1))
+	if peers, _, _ = tr.announce(&req2, net.IPv4(10, 0, 0, 2)); len(peers) != 0 {
+		t.Errorf("a stopped peer should have been removed")
+	}
+
+	b := compactPeers([]trackerPeer{{IP: net.IPv4(10, 0, 0, 1), Port: 1000}, {IP: net.ParseIP("::1"), Port: 1}}, net.IPv4len)
+	if len(b) != 6 || b[0] != 10 || b[4] != 0x03 || b[5] != 0xe8 {
+		t.Errorf("compact peers: got %v", b)
+	}
+}
+
+func TestServeAnnounce(t *testing.T) {
+	s, ih := newTestTrackerServer(t)
+
+	announce := func(ih metainfo.Hash, peerID string) map[string]interface{} {
+		var (
+			req fasthttp.Request
+			ctx fasthttp.RequestCtx
+		)
+		req.SetRequestURI(fmt.Sprintf("/announce?info_hash=%s&peer_id=%s&port=6881&left=0",
+			url.QueryEscape(string(ih[:])), peerID))
+		ctx.Init(&req, &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1)}, nil)
+		s.serveAnnounce(&ctx)
+		var res map[string]interface{}
+		if err := torrentbencode.Unmarshal(ctx.Response.Body(), &res); err != nil {
+			t.Fatalf("failed decoding response: %v", err)
+		}
+		return res
+	}
+
+	if res := announce(metainfo.Hash{1}, "aaaaaaaaaaaaaaaaaaaa"); res["failure reason"] != errUnknownInfoHash.Error() {
+		t.Errorf("unknown info-hash: got %v", res)
+	}
+	announce(ih, "aaaaaaaaaaaaaaaaaaaa")
+	res := announce(ih, "bbbbbbbbbbbbbbbbbbbb")
+	if _, ok := res["failure reason"]; ok {
+		t.Fatalf("announce failed: %v", res)
+	} else if peers, _ := res["peers"].(string); len(peers) != 6 {
+		t.Errorf("peers: got %v, expected one compact peer", res["peers"])
+	}
+
+	s.Lock()
+	delete(s.updates, "a")
+	s.indexInfoHash("a")
+	s.Unlock()
+	if res = announce(ih, "aaaaaaaaaaaaaaaaaaaa"); res["failure reason"] != errUnknownInfoHash.Error() {
+		t.Errorf("removed info-hash: got %v", res)
+	}
+}
+
+func TestTrackerDelta(t *testing.T) {
+	s, ih := newTestTrackerServer(t)
+	n := s.updates["a"]
+	n.Delta = &Delta{
+		BaseVersion: 1,
+		Info:        metainfo.Info{Name: "a-delta", PieceLength: minPieceLength, Length: 1},
+	}
+	s.indexInfoHash("a")
+	dih, err := n.Delta.infoHash(n)
+	if err != nil {
+		t.Fatalf("failed computing info-hash of the patch: %v", err)
+	}
+	if !s.knownInfoHash(ih) || !s.knownInfoHash(dih) {
+		t.Errorf("the info-hashes of the payload and the patch should be known")
+	}
+
+	delete(s.updates, "a")
+	s.indexInfoHash("a")
+	if s.knownInfoHash(ih) || s.knownInfoHash(dih) {
+		t.Errorf("the info-hashes of a removed notification should not be known")
+	}
+}
+
+func TestServeUDPTracker(t *testing.T) {
+	s, ih := newTestTrackerServer(t)
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			s.serveUDPTracker(conn, addr, buf[:n])
+		}
+	}()
+
+	res, err := bttracker.Announce{
+		TrackerUrl: fmt.Sprintf("udp://%s", conn.LocalAddr()),
+		Request:    bttracker.AnnounceRequest{InfoHash: ih, PeerId: [20]byte{1}, Port: 6881, NumWant: -1},
+	}.Do()
+	if err != nil {
+		t.Fatalf("failed announcing: %v", err)
+	} else if res.Interval != 60 || res.Seeders != 1 {
+		t.Errorf("response: got %+v", res)
+	}
+
+	_, err = bttracker.Announce{
+		TrackerUrl: fmt.Sprintf("udp://%s", conn.LocalAddr()),
+		Request:    bttracker.AnnounceRequest{InfoHash: [20]byte{1}, PeerId: [20]byte{1}, Port: 6881},
+	}.Do()
+	if err == nil {
+		t.Errorf("an unknown info-hash should be rejected")
+	}
+}
@@ -33,6 +33,12 @@ const (
 	// $ uuidgen --sha1 --namespace @oid --name /bin/sh
 	UUIDShell = "f5adf0cb-b0e1-5a22-97f1-09092f566438"
 
+	// UUIDKeyring is the UUID of keyring notifications, which add or revoke
+	// the trusted keys of a cluster.
+	// Generated by invoking:
+	// $ uuidgen --sha1 --namespace @oid --name p2p-update/keyring
+	UUIDKeyring = "d54efc12-ff9b-57f4-a005-c60c149d6493"
+
 	// DeployFailsLimit is the maximum fails of deployment. Exceeding this value
 	// means that the update should not be deployed.
 	DeployFailsLimit = 5
@@ -40,6 +46,18 @@ const (
 	// ShellExecutionTimeout is the maximum execution time of a shell script
 	// before timeout.
 	ShellExecutionTimeout = 600 // in seconds
+
+	// ResendInterval is the interval of sending the update notification until
+	// a peer acknowledges it.
+	ResendInterval = time.Minute
+
+	// ResendLimit is the maximum times of sending the update notification
+	// when no peer acknowledges it.
+	ResendLimit = 10
+
+	// sourceRetryInterval is the interval of downloading the missing pieces
+	// from a source other than BitTorrent.
+	sourceRetryInterval = time.Minute
 )
 
 // Update represents a system update that should be downloaded and deployed on
@@ -48,24 +66,38 @@ type Update struct {
 	sync.RWMutex
 
 	Notification Notification `json:"notification"`
+	Cluster      string       `json:"cluster,omitempty"`
 	Deployed     time.Time    `json:"deployed"`
 	Source       string       `json:"source"`
 	Stopped      bool         `json:"stopped"`
-	Sent         bool         `json:"sent"`
 	DeployFails  int          `json:"deploy-fails"`
 	Missing      int64        `json:"missing"`
 
-	torrent *torrent.Torrent
-	agent   *Agent
+	// DeltaSource is the patch file of the notification's Delta, which is
+	// copied to the data directory when the update is submitted
+	DeltaSource string `json:"delta-source,omitempty"`
+
+	// Delivered maps IDs of peers that have acknowledged the notification
+	// to the time of their acknowledgements
+	Delivered map[string]time.Time `json:"delivered,omitempty"`
+
+	torrent          *torrent.Torrent
+	agent            *Agent
+	cluster          *Cluster
+	sent             time.Time
+	sends            int
+	deliveryModified bool
+	fetchers         []Fetcher
 }
 
-// NewUpdate returns an Update instance from given notification and agent.
-func NewUpdate(n Notification, a *Agent) *Update {
+// NewUpdate returns an Update instance from given notification and cluster.
+func NewUpdate(n Notification, c *Cluster) *Update {
 	return &Update{
 		Notification: n,
+		Cluster:      c.Name,
 		Stopped:      true,
-		Sent:         false,
-		agent:        a,
+		agent:        c.agent,
+		cluster:      c,
 	}
 }
 
@@ -73,19 +105,28 @@ func NewUpdate(n Notification, a *Agent) *Update {
 func LoadUpdateFromFile(filename string, a *Agent) (*Update, error) {
 	u := Update{
 		Stopped: true,
-		Sent:    false,
 		agent:   a,
 	}
 	f, err := os.Open(filename)
 	if err != nil {
 		return nil, err
 	}
-	return &u, json.NewDecoder(f).Decode(&u)
+	defer f.Close()
+	if err = json.NewDecoder(f).Decode(&u); err != nil {
+		return nil, err
+	}
+	if u.cluster = a.cluster(u.Cluster); u.cluster == nil {
+		return nil, fmt.Errorf("agent does not join cluster '%s'", u.Cluster)
+	}
+	return &u, nil
 }
 
 // MetadataFilename returns the name of the update metadata file.
 func (u *Update) MetadataFilename() string {
 	filename := fmt.Sprintf("%s-v%d", u.Notification.UUID, u.Notification.Version)
+	if len(u.Cluster) > 0 {
+		filename = fmt.Sprintf("%s-%s", u.Cluster, filename)
+	}
 	return filepath.Join(u.agent.metadataDir, filename)
 }
 
@@ -108,7 +149,7 @@ func (u *Update) Write(w io.Writer) error {
 // Verify verifies the update. It returns an error if the verification fails,
 // otherwise nil.
 func (u *Update) Verify(a *Agent) error {
-	if err := u.Notification.Verify(a.PublicKey); err != nil {
+	if err := u.Notification.Verify(u.cluster.Keyring); err != nil {
 		log.Printf("verification failed: %v", err)
 		return errUpdateVerificationFailed
 	}
@@ -121,9 +162,10 @@ func (u *Update) Start(a *Agent) error {
 	defer u.Unlock()
 
 	var (
-		mi  *metainfo.MetaInfo
-		old *Update
-		err error
+		mi   *metainfo.MetaInfo
+		old  *Update
+		base string
+		err  error
 	)
 
 	if err = u.Verify(a); err != nil {
@@ -135,10 +177,14 @@ func (u *Update) Start(a *Agent) error {
 	if old, err = a.addUpdate(u); err != nil {
 		return err
 	}
+	if u.Notification.UUID == UUIDKeyring {
+		u.cluster.applyKeyring(&u.Notification)
+	}
 	if old == nil {
 		log.Printf("older update of uuid:%s does not exist", u.Notification.UUID)
 	} else {
 		old.Stop()
+		base = u.keepDeltaBase(old)
 		if err = old.Delete(); err != nil {
 			log.Printf("WARNING: failed to delete update uuid:%s version:%d - %v",
 				old.Notification.UUID, old.Notification.Version, err)
@@ -150,8 +196,35 @@ func (u *Update) Start(a *Agent) error {
 	if mi, err = u.Notification.torrentMetainfo(); err != nil {
 		return fmt.Errorf("failed generating torrent metainfo: %v", err)
 	}
-	if u.torrent, err = a.torrentClient.AddTorrent(mi); err != nil {
-		return fmt.Errorf("failed adding torrent: %v", err)
+	a.defaultTracker(mi)
+	if a.peerFilter != nil {
+		a.peerFilter.allow(mi.Nodes)
+	}
+	var peers []torrent.Peer
+	if u.cluster != nil {
+		peers = u.cluster.torrentPeers(nil)
+	}
+	tf := newTorrentFetcher(a.torrentClient, mi, peers)
+	fetchers := []Fetcher{tf}
+	if d := u.Notification.Delta; d != nil {
+		if dmi, err := d.torrentMetainfo(&u.Notification); err != nil {
+			log.Printf("WARNING: invalid delta of update uuid:%s version:%d - %v",
+				u.Notification.UUID, u.Notification.Version, err)
+		} else {
+			a.defaultTracker(dmi)
+			fetchers = append(fetchers, newDeltaFetcher(a.torrentClient, dmi, a.dataDir, base, tf))
+		}
+	}
+	if err = tf.Start(); err != nil {
+		return err
+	}
+	u.torrent = tf.t
+	u.fetchers = append(fetchers, u.sourceFetchers(a)...)
+	for _, f := range u.fetchers[1:] {
+		if err := f.Start(); err != nil {
+			log.Printf("WARNING: failed starting fetcher of update uuid:%s version:%d - %v",
+				u.Notification.UUID, u.Notification.Version, err)
+		}
 	}
 	u.Stopped = false
 	log.Printf("started update: %s", u.String())
@@ -162,29 +235,60 @@ func (u *Update) Start(a *Agent) error {
 	return nil
 }
 
+// defaultTracker sets the agent's tracker as the announce URL of given
+// torrent Metainfo if the Metainfo has no trackers, e.g. the Metainfo of
+// a compact notification.
+func (a *Agent) defaultTracker(mi *metainfo.MetaInfo) {
+	if len(mi.Announce) == 0 && len(mi.AnnounceList) == 0 {
+		mi.Announce = a.Config.BitTorrent.Tracker
+	}
+}
+
+// sourceFetchers returns the fetchers of the agent's sources, which start
+// immediately, and of the notification's web seeds, which start after
+// WebSeedWait. The caller must hold the lock.
+func (u *Update) sourceFetchers(a *Agent) []Fetcher {
+	var fetchers []Fetcher
+	for _, s := range a.Config.Sources {
+		src, err := newPieceSource(s)
+		if err != nil {
+			log.Printf("WARNING: invalid source - %v", err)
+			continue
+		}
+		fetchers = append(fetchers, newSourceFetcher(src, u.torrent, 0, sourceRetryInterval))
+	}
+	wait := time.Duration(a.Config.BitTorrent.WebSeedWait) * time.Second
+	for _, s := range u.Notification.URLList {
+		fetchers = append(fetchers, newSourceFetcher(httpSource(s), u.torrent, wait, sourceRetryInterval))
+	}
+	return fetchers
+}
+
 func (u *Update) monitor(a *Agent) {
 	toSave := true
 	for {
 		time.Sleep(5 * time.Second)
 
 		u.Lock()
-		if u.Stopped || u.torrent == nil {
+		if u.Stopped || len(u.fetchers) == 0 {
+			u.Unlock()
 			break
 		}
-		if !u.Sent {
-			if err := u.Notification.Write(a.Overlay); err != nil {
+		if u.resendNeeded(a) {
+			u.sent = time.Now()
+			if err := u.send(); err != nil {
 				log.Printf("failed sending update uuid:%s version:%d : %v",
 					u.Notification.UUID, u.Notification.Version, err)
 			} else {
-				u.Sent = true
-				toSave = true
+				u.sends++
 			}
 		}
-		u.Missing = u.torrent.BytesMissing()
-		if u.Missing > 0 {
-			<-u.torrent.GotInfo()
-			u.torrent.DownloadAll()
-		} else if !a.Config.Proxy && u.Deployed.Year() < 2000 {
+		if u.deliveryModified {
+			u.deliveryModified = false
+			toSave = true
+		}
+		_, u.Missing = u.fetchers[0].Progress()
+		if u.Missing == 0 && !a.Config.Proxy && u.Deployed.Year() < 2000 {
 			u.deploy()
 			toSave = true
 		}
@@ -198,17 +302,55 @@ func (u *Update) monitor(a *Agent) {
 	}
 }
 
+// resendNeeded returns true if the notification should be sent, which is
+// once without acknowledgements, otherwise every ResendInterval until a peer
+// acknowledges it or ResendLimit is reached. The caller must hold the lock.
+func (u *Update) resendNeeded(a *Agent) bool {
+	if !a.Config.Overlay.Acknowledged {
+		return u.sends == 0
+	}
+	return len(u.Delivered) == 0 && u.sends < ResendLimit && time.Since(u.sent) > ResendInterval
+}
+
+// send gossips the notification. With acknowledgements, it records the peers
+// that acknowledge it.
+func (u *Update) send() error {
+	kind, b, err := u.Notification.gossipData(u.agent.Config.Overlay.CompactNotifications)
+	if err != nil {
+		return err
+	}
+	if !u.agent.Config.Overlay.Acknowledged {
+		_, err = u.cluster.Gossip.WriteKind(kind, b)
+		return err
+	}
+	return u.cluster.Gossip.DeliverKind(kind, b, func(pid PeerID, err error) {
+		if err != nil {
+			log.Printf("failed delivering update uuid:%s version:%d to %s: %v",
+				u.Notification.UUID, u.Notification.Version, pid, err)
+			return
+		}
+		u.Lock()
+		defer u.Unlock()
+		if u.Delivered == nil {
+			u.Delivered = make(map[string]time.Time)
+		}
+		u.Delivered[pid.String()] = time.Now()
+		u.deliveryModified = true
+	})
+}
+
 // Stop stops the lifecycle of the update.
 func (u *Update) Stop() {
 	u.Lock()
 	defer u.Unlock()
 	log.Printf("stopping update: %v", u.String())
 	u.Stopped = true
-	if u.torrent != nil {
-		u.torrent.Drop()
-		<-u.torrent.Closed()
-		u.torrent = nil
+	// the torrent is the storage of the other fetchers, so it stops last
+	for i := len(u.fetchers) - 1; i >= 0; i-- {
+		u.fetchers[i].Stop()
 	}
+	u.fetchers = nil
+	u.torrent = nil
 	log.Printf("stopped update: %v", u.String())
 }
 
@@ -225,6 +367,12 @@ func (u *Update) Delete() error {
 	if err := os.RemoveAll(filename); err != nil {
 		log.Printf("WARNING: failed removing update file %s", filename)
 	}
+	if u.Notification.Delta != nil {
+		filename = filepath.Join(u.agent.dataDir, u.Notification.Delta.Info.Name)
+		if err := os.RemoveAll(filename); err != nil {
+			log.Printf("WARNING: failed removing patch file %s", filename)
+		}
+	}
 
 	filename = u.MetadataFilename()
 	if err := os.RemoveAll(filename); err != nil {
@@ -238,7 +386,7 @@ func (u *Update) Delete() error {
 
 func (u *Update) String() string {
 	var b bytes.Buffer
-	b.WriteString(fmt.Sprintf("uuid:%v version:%d", u.Notification.UUID, u.Notification.Version))
+	b.WriteString(fmt.Sprintf("cluster:%s uuid:%v version:%d", u.Cluster, u.Notification.UUID, u.Notification.Version))
 	if u.torrent != nil {
 		b.WriteString(fmt.Sprintf(" completed/missing:%v/%v",
 			u.torrent.BytesCompleted(), u.torrent.BytesMissing()))
@@ -274,6 +422,8 @@ func (u *Update) deploy() {
 		err = u.deployWith(apk)
 	case UUIDShell:
 		err = u.deployWith(shell)
+	case UUIDKeyring:
+		// the keyring change has been applied when the update started
 	default:
 		u.DeployFails++
 		log.Printf("ERROR: Unrecognized uuid:%s", u.Notification.UUID)
@@ -0,0 +1,122 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"log"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/valyala/fasthttp"
+)
+
+// webSeedTimeout is the maximum time of downloading a piece from a web seed
+const webSeedTimeout = time.Minute
+
+var (
+	// pathData is the path prefix of the server's web seed
+	pathData = []byte("/data/")
+
+	strHEAD = []byte("HEAD")
+)
+
+// fileRange is a part of a piece that is stored in a file of a torrent.
+type fileRange struct {
+	Path   []string
+	Offset int64
+	Length int64
+}
+
+// pieceRanges returns the parts of given piece in the files of the torrent.
+func pieceRanges(info *metainfo.Info, piece int) []fileRange {
+	var (
+		ranges []fileRange
+		p      = info.Piece(piece)
+		begin  = p.Offset()
+		end    = begin + p.Length()
+		offset int64
+	)
+	for _, fi := range info.UpvertedFiles() {
+		fileEnd := offset + fi.Length
+		if fileEnd > begin && offset < end {
+			b, e := begin, end
+			if b < offset {
+				b = offset
+			}
+			if e > fileEnd {
+				e = fileEnd
+			}
+			ranges = append(ranges, fileRange{Path: fi.Path, Offset: b - offset, Length: e - b})
+		}
+		offset = fileEnd
+	}
+	return ranges
+}
+
+// webSeedURL returns the URL of given file of the torrent at web seed `u`
+// (BEP 19). The name of the torrent is appended if `u` ends with a slash or
+// the torrent has multiple files.
+func webSeedURL(u string, info *metainfo.Info, path []string) string {
+	if !strings.HasSuffix(u, "/") && !info.IsDir() {
+		return u
+	}
+	if !strings.HasSuffix(u, "/") {
+		u += "/"
+	}
+	parts := append([]string{info.Name}, path...)
+	for i, p := range parts {
+		parts[i] = url.PathEscape(p)
+	}
+	return u + strings.Join(parts, "/")
+}
+
+// newWebSeedHandler returns a handler that serves the files in given
+// directory, after stripping a path prefix of `prefixSize` bytes. It only
+// serves the addresses that are not blocked by `filter` if it is not nil.
+func newWebSeedHandler(dir string, prefixSize int, filter *clusterFilter) fasthttp.RequestHandler {
+	fs := fasthttp.FS{
+		Root:            dir,
+		AcceptByteRange: true,
+	}
+	if prefixSize > 0 {
+		fs.PathRewrite = fasthttp.NewPathPrefixStripper(prefixSize)
+	}
+	handler := fs.NewRequestHandler()
+	return func(ctx *fasthttp.RequestCtx) {
+		if bytes.Compare(ctx.Method(), strGET) != 0 && bytes.Compare(ctx.Method(), strHEAD) != 0 {
+			ctx.SetStatusCode(400)
+			return
+		}
+		if filter != nil {
+			if _, blocked := filter.Lookup(ctx.RemoteIP()); blocked {
+				ctx.SetStatusCode(403)
+				return
+			}
+		}
+		handler(ctx)
+	}
+}
+
+// serveWebSeed serves the data directory over HTTP, so that the agent is
+// a web seed of its updates.
+func (a *Agent) serveWebSeed() {
+	var filter *clusterFilter
+	if a.Config.BitTorrent.ClusterPeersOnly {
+		filter = a.peerFilter
+	}
+	addr := a.Config.BitTorrent.WebSeedAddress
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		log.Printf("ERROR: invalid web seed address '%s': %v", addr, err)
+		return
+	}
+	log.Printf("serving web seed at %s", addr)
+	if err := fasthttp.ListenAndServe(addr, newWebSeedHandler(a.dataDir, 0, filter)); err != nil {
+		log.Printf("ERROR: failed serving web seed at %s - %v", addr, err)
+	}
+}
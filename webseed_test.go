@@ -0,0 +1,43 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+func TestPieceRanges(t *testing.T) {
+	info := &metainfo.Info{
+		Name:        "a",
+		PieceLength: 10,
+		Files: []metainfo.FileInfo{
+			{Path: []string{"x"}, Length: 15},
+			{Path: []string{"y"}, Length: 3},
+			{Path: []string{"z"}, Length: 7},
+		},
+		Pieces: make([]byte, 3*metainfo.HashSize),
+	}
+	ranges := pieceRanges(info, 1)
+	if len(ranges) != 3 {
+		t.Fatalf("ranges of piece 1: got %v", ranges)
+	}
+	expected := []fileRange{{[]string{"x"}, 10, 5}, {[]string{"y"}, 0, 3}, {[]string{"z"}, 0, 2}}
+	for i, r := range ranges {
+		if r.Path[0] != expected[i].Path[0] || r.Offset != expected[i].Offset || r.Length != expected[i].Length {
+			t.Errorf("range %d: got %v, expected %v", i, r, expected[i])
+		}
+	}
+	if ranges = pieceRanges(info, 2); len(ranges) != 1 || ranges[0].Offset != 2 || ranges[0].Length != 5 {
+		t.Errorf("ranges of the last piece: got %v", ranges)
+	}
+
+	if u := webSeedURL("http://a/b/", info, []string{"x y"}); u != "http://a/b/a/x%20y" {
+		t.Errorf("multi-file URL: got %s", u)
+	}
+	info.Files = nil
+	if u := webSeedURL("http://a/b", info, nil); u != "http://a/b" {
+		t.Errorf("single-file URL: got %s", u)
+	} else if u = webSeedURL("http://a/b/", info, nil); u != "http://a/b/a" {
+		t.Errorf("single-file URL with slash: got %s", u)
+	}
+}